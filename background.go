@@ -0,0 +1,118 @@
+package imghash
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/pkg/errors"
+)
+
+// How transparent pixels are filled in before an image is hashed.
+type BackgroundMode byte
+
+const (
+	// Ignores the alpha channel entirely, so fully transparent pixels hash as whatever colour they happen to
+	// hold. This is how every file was hashed before backgrounds were added, so it is the default.
+	BackgroundNone BackgroundMode = iota
+
+	// Composites the image over a single colour.
+	BackgroundSolid
+
+	// Composites the image over a checkerboard of two colours, with a fixed number of cells across each side
+	// of the image so the pattern is the same no matter the resolution.
+	BackgroundCheckerboard
+)
+
+// The background transparent images are composited over before hashing. Since the background changes the
+// hash of every transparent image, it is recorded in the file so queries can be hashed the same way.
+type Background struct {
+	Mode BackgroundMode
+
+	// The colour of a solid background, or of the top-left cell of a checkerboard. The alpha is ignored.
+	Color color.NRGBA
+
+	// The colour of every other cell of a checkerboard. The alpha is ignored.
+	Alt color.NRGBA
+
+	// The number of checkerboard cells across each side of the image, 8 if zero.
+	Cells uint8
+}
+
+func (bg Background) cells() int {
+	if bg.Cells == 0 {
+		return 8
+	}
+	return int(bg.Cells)
+}
+
+// Returns the background colour at (x, y) of a w x h image.
+func (bg Background) at(x, y, w, h int) color.NRGBA {
+	if bg.Mode == BackgroundCheckerboard && (x*bg.cells()/w+y*bg.cells()/h)%2 == 1 {
+		return bg.Alt
+	}
+	return bg.Color
+}
+
+// Returns a copy of the image composited over the background, leaving the original untouched.
+// The image is returned as is if the background is BackgroundNone.
+func (bg Background) composite(img *image.NRGBA) *image.NRGBA {
+	if bg.Mode == BackgroundNone {
+		return img
+	}
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		src, row := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):], dst.Pix[y*dst.Stride:]
+		for x := 0; x < w; x++ {
+			p, c := src[4*x:4*x+4], bg.at(x, y, w, h)
+			a := uint32(p[3])
+
+			row[4*x+0] = uint8((uint32(p[0])*a + uint32(c.R)*(255-a) + 127) / 255)
+			row[4*x+1] = uint8((uint32(p[1])*a + uint32(c.G)*(255-a) + 127) / 255)
+			row[4*x+2] = uint8((uint32(p[2])*a + uint32(c.B)*(255-a) + 127) / 255)
+			row[4*x+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// Returns the ffmpeg filter that composites frames over the background the same way composite does,
+// or an empty string if the background is BackgroundNone.
+func (bg Background) ffmpegFilter() string {
+	if bg.Mode == BackgroundNone {
+		return ""
+	}
+
+	channel := func(fn string, c1, c2 uint8) string {
+		fill := fmt.Sprint(c1)
+		if bg.Mode == BackgroundCheckerboard {
+			fill = fmt.Sprintf("if(mod(floor(X*%[1]d/W)+floor(Y*%[1]d/H),2),%[2]d,%[3]d)", bg.cells(), c2, c1)
+		}
+		return fmt.Sprintf("floor((%s(X,Y)*alpha(X,Y)+%s*(255-alpha(X,Y))+127)/255)", fn, fill)
+	}
+
+	return fmt.Sprintf("format=rgba,geq=r='%s':g='%s':b='%s':a=255",
+		channel("r", bg.Color.R, bg.Alt.R),
+		channel("g", bg.Color.G, bg.Alt.G),
+		channel("b", bg.Color.B, bg.Alt.B),
+	)
+}
+
+// Encodes the background as the mode, both RGB colours and the cell count.
+func (bg Background) marshal() []byte {
+	return []byte{byte(bg.Mode), bg.Color.R, bg.Color.G, bg.Color.B, bg.Alt.R, bg.Alt.G, bg.Alt.B, bg.Cells}
+}
+
+func (bg *Background) unmarshal(data []byte) error {
+	if len(data) != 8 {
+		return errors.Errorf("background section must be 8 bytes, not %d", len(data))
+	}
+
+	bg.Mode = BackgroundMode(data[0])
+	bg.Color = color.NRGBA{data[1], data[2], data[3], 0xff}
+	bg.Alt = color.NRGBA{data[4], data[5], data[6], 0xff}
+	bg.Cells = data[7]
+	return nil
+}
@@ -0,0 +1,175 @@
+package imghash
+
+import (
+	"image"
+
+	"github.com/pkg/errors"
+)
+
+// BatchHasher hashes runs of frames packed back to back in one contiguous slice of RGBA pixels, such as the raw output
+// of ffmpeg, reusing its buffers from one frame to the next. Difference hashes without tiles, colour or preprocessing
+// are hashed straight out of the slice without allocating anything per frame; everything else is hashed the same way
+// NewFromPath would, from views into the slice rather than copies.
+//
+// A BatchHasher isn't safe to use from more than one goroutine at once.
+type BatchHasher struct {
+	hasher Hasher
+	opts   Options
+
+	// The size of each frame in the slice, and of the part of it that is scaled for the hash
+	fw, fh int
+	sw, sh int
+
+	// Set if frames can be hashed by differenceHashPix directly
+	fast *differenceHasher
+	luma []uint8
+
+	// The number of frames hashed so far, which gives each hash its index
+	frames uint32
+}
+
+// Creates a batch hasher for the hasher and options, returning an error of type UnknownHasher if no hasher is
+// registered under the name in the options. Options.Windows and Options.AutoCrop don't apply to frames in a batch.
+func NewBatchHasher(opts Options) (*BatchHasher, error) {
+	if opts.Hasher == "" {
+		opts.Hasher = DefaultHasher
+	}
+
+	hasher, err := LookupHasher(opts.Hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	return newBatchHasher(hasher, opts), nil
+}
+
+func newBatchHasher(hasher Hasher, opts Options) *BatchHasher {
+	b := &BatchHasher{hasher: hasher, opts: opts}
+
+	// With tiles a frame is the scaled image with the tile canvas stacked under it, padded to the wider of the two
+	k := opts.Preprocess.scale()
+	w, h := hasher.Size()
+	b.sw, b.sh = w*k, h*k
+	b.fw, b.fh = b.sw, b.sh
+	if opts.Tiles > 0 {
+		c := tileCanvas(opts.Tiles) * k
+		if c > b.fw {
+			b.fw = c
+		}
+		b.fh += c
+	}
+
+	if d, ok := hasher.(differenceHasher); ok && opts.Tiles == 0 && !opts.Colour && !opts.Diagonal && len(opts.Preprocess) == 0 {
+		b.fast = &d
+		b.luma = make([]uint8, w*h)
+	}
+	return b
+}
+
+// Returns the width and height of each frame the batch hasher expects, which is the hasher's size unless the options
+// add tiles or preprocessing. With tiles, each frame holds the image scaled to the hasher's size in its top-left corner
+// with the tile canvas directly below it.
+func (b *BatchHasher) FrameSize() (int, int) {
+	return b.fw, b.fh
+}
+
+// HashFrames hashes every frame in pix, which must be a whole number of frames of FrameSize, appending a hash for
+// each to dst and returning it. Each hash's Index counts the frames the batch hasher has hashed so far starting at 1,
+// so a long video can be hashed in chunks. The planes of every hash in one call share a single allocation.
+func (b *BatchHasher) HashFrames(dst []Hash, pix []uint8) ([]Hash, error) {
+	size := 4 * b.fw * b.fh
+	if len(pix)%size != 0 {
+		return dst, errors.Errorf("buffer length must be a multiple of frame size (%d), but was %d", size, len(pix))
+	}
+	frames := len(pix) / size
+
+	if b.fast != nil {
+		return b.hashFast(dst, pix, frames), nil
+	}
+
+	frame := &image.NRGBA{Stride: 4 * b.fw, Rect: image.Rect(0, 0, b.fw, b.fh)}
+	for i := 0; i < frames; i++ {
+		b.frames++
+		frame.Pix = pix[i*size : (i+1)*size]
+
+		hash, err := b.hashFrame(frame)
+		if err != nil {
+			return dst, errors.Wrapf(err, "frame %d", b.frames)
+		}
+
+		hash.Index = b.frames
+		dst = append(dst, hash)
+	}
+	return dst, nil
+}
+
+// Hashes frames straight out of pix with differenceHashPix.
+func (b *BatchHasher) hashFast(dst []Hash, pix []uint8, frames int) []Hash {
+	w, h := b.fast.Size()
+	words := len(NewBitSet((w - 1) * (h - 1)))
+
+	planes := 2
+	if b.opts.MaskThreshold > 0 {
+		planes = 4
+	}
+	slab := make(BitSet, planes*words*frames)
+
+	// Appending one at a time could grow dst several times, so it's grown once up front
+	if cap(dst)-len(dst) < frames {
+		dst = append(dst, make([]Hash, frames)...)[:len(dst)]
+	}
+
+	// Hashes are filled in where they lie, since they're large enough that copying them in is noticeable
+	size := 4 * w * h
+	start := len(dst)
+	dst = dst[:start+frames]
+	for i := range dst[start:] {
+		b.frames++
+
+		hash := &dst[start+i]
+		*hash = Hash{Index: b.frames}
+		hash.VHash, slab = slab[:words:words], slab[words:]
+		hash.HHash, slab = slab[:words:words], slab[words:]
+		if b.opts.MaskThreshold > 0 {
+			hash.VMask, slab = slab[:words:words], slab[words:]
+			hash.HMask, slab = slab[:words:words], slab[words:]
+		}
+
+		differenceHashPix(pix[i*size:], 4*w, w, h, b.luma, b.opts.MaskThreshold, hash.HHash, hash.VHash, hash.HMask, hash.VMask)
+		hash.Information = informationScore(b.luma, hash, b.fast.Bits())
+	}
+	return dst
+}
+
+// Hashes a single frame the same way NewFromPath would, preprocessing it and hashing its tiles if the options ask.
+func (b *BatchHasher) hashFrame(frame *image.NRGBA) (Hash, error) {
+	w, h := b.hasher.Size()
+	k := b.opts.Preprocess.scale()
+
+	scaled, err := b.opts.Preprocess.finish(frame.SubImage(image.Rect(0, 0, b.sw, b.sh)).(*image.NRGBA), w, h, b.opts.Filter)
+	if err != nil {
+		return Hash{}, errors.Wrap(err, "preprocessing")
+	}
+
+	hash, err := hashScaled(scaled, b.hasher, b.opts)
+	if err != nil {
+		return Hash{}, errors.Wrap(err, "creating hash")
+	}
+
+	if b.opts.Tiles > 0 {
+		c := tileCanvas(b.opts.Tiles)
+		canvas, err := b.opts.Preprocess.finish(frame.SubImage(image.Rect(0, b.sh, c*k, b.sh+c*k)).(*image.NRGBA), c, c, b.opts.Filter)
+		if err != nil {
+			return Hash{}, errors.Wrap(err, "preprocessing tiles")
+		}
+
+		if hash.Tiles, err = tileHashes(canvas, b.opts.Tiles); err != nil {
+			return Hash{}, errors.Wrap(err, "creating tile hashes")
+		}
+	}
+	return hash, nil
+}
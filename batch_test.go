@@ -0,0 +1,161 @@
+package imghash
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Returns n frames of random opaque pixels drawn from rng of the given size, packed back to back.
+func randomFrames(rng *rand.Rand, n, w, h int) []uint8 {
+	pix := make([]uint8, n*4*w*h)
+	rng.Read(pix)
+	for i := 3; i < len(pix); i += 4 {
+		pix[i] = 0xff
+	}
+	return pix
+}
+
+// Every frame of a batch must hash exactly as it would on its own, whether it takes the fast path or not.
+func TestBatchHasher(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"dhash", Options{}},
+		{"masked", Options{MaskThreshold: 8}},
+		{"dhash17x17", Options{Hasher: "dhash17x17"}},
+		{"phash", Options{Hasher: "phash"}},
+		{"tiles", Options{Tiles: 2, Colour: true}},
+		{"preprocess", Options{Preprocess: Preprocess{{Kind: StepBlur, Sigma: 1}}}},
+	}
+
+	for _, test := range tests {
+		batch, err := NewBatchHasher(test.opts)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if fast := batch.fast != nil; fast != (test.name == "dhash" || test.name == "masked" || test.name == "dhash17x17") {
+			t.Fatalf("%s: fast path was %v", test.name, fast)
+		}
+
+		fw, fh := batch.FrameSize()
+		pix := randomFrames(rng, 30, fw, fh)
+
+		// Splitting the frames across two calls mustn't change their indices
+		half := 4 * fw * fh * 10
+		hashes, err := batch.HashFrames(nil, pix[:half])
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if hashes, err = batch.HashFrames(hashes, pix[half:]); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if len(hashes) != 30 {
+			t.Fatalf("%s: got %d hashes, expected 30", test.name, len(hashes))
+		}
+
+		single := newBatchHasher(batch.hasher, batch.opts)
+		single.fast = nil
+		for i, h := range hashes {
+			frame := &image.NRGBA{Pix: pix[i*4*fw*fh : (i+1)*4*fw*fh], Stride: 4 * fw, Rect: image.Rect(0, 0, fw, fh)}
+			want, err := single.hashFrame(frame)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if h.Index != uint32(i+1) || !h.Equal(want) || !h.VMask.Equal(want.VMask) || !h.HMask.Equal(want.HMask) || !h.Tiles.Equal(want.Tiles) {
+				t.Fatalf("%s: frame %d hashed as %v, expected %v", test.name, i, h, want)
+			}
+		}
+	}
+
+	batch, _ := NewBatchHasher(Options{})
+	if _, err := batch.HashFrames(nil, make([]uint8, 10)); err == nil {
+		t.Fatal("expected an error hashing part of a frame")
+	}
+}
+
+// Hashing a batch of difference hashes into room that's already there must allocate nothing but the planes.
+func TestBatchHasherAllocs(t *testing.T) {
+	batch, err := NewBatchHasher(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pix := randomFrames(rand.New(rand.NewSource(1)), 256, width, height)
+	dst := make([]Hash, 0, 256)
+	if n := testing.AllocsPerRun(10, func() { batch.HashFrames(dst, pix) }); n > 1 {
+		t.Fatalf("hashing 256 frames made %v allocations, expected 1", n)
+	}
+}
+
+// Frames that aren't batched, like those with tiles, are hashed and scored from a single pass over their luma.
+func TestHashScaledAllocs(t *testing.T) {
+	hasher, _ := LookupHasher(DefaultHasher)
+	img := randomImage(rand.New(rand.NewSource(1)), image.NewNRGBA(image.Rect(0, 0, width, height)))
+
+	// The luma and the two planes
+	if n := testing.AllocsPerRun(10, func() { hashScaled(img, hasher, Options{}) }); n > 3 {
+		t.Fatalf("hashing a frame made %v allocations, expected 3", n)
+	}
+	// Plus the diagonal, which shares the luma
+	if n := testing.AllocsPerRun(10, func() { hashScaled(img, hasher, Options{Diagonal: true}) }); n > 4 {
+		t.Fatalf("hashing a frame with its diagonal made %v allocations, expected 4", n)
+	}
+}
+
+// Three hours of video at the 12 frames a second ffmpegRunner samples at.
+const benchFrames = 3 * 60 * 60 * 12
+
+var benchPix []uint8
+
+func benchmarkFrames(b *testing.B) []uint8 {
+	if benchPix == nil {
+		benchPix = randomFrames(rand.New(rand.NewSource(1)), benchFrames, width, height)
+	}
+	b.SetBytes(int64(len(benchPix)))
+	b.ResetTimer()
+	return benchPix
+}
+
+// Hashes three hours of frames one at a time through the Hasher interface, the way ffmpegRunner used to.
+func BenchmarkHashFramesSingle(b *testing.B) {
+	hasher, _ := LookupHasher(DefaultHasher)
+	pix := benchmarkFrames(b)
+	start := time.Now()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for n := 0; n < b.N; n++ {
+		hashes := make([]Hash, benchFrames)
+		for i := range hashes {
+			copy(img.Pix, pix[i*len(img.Pix):])
+			hashes[i], _ = hashScaled(img, hasher, Options{})
+		}
+	}
+	b.ReportMetric(float64(benchFrames*b.N)/time.Since(start).Seconds(), "frames/s")
+}
+
+// Hashes three hours of frames in chunks the size ffmpegRunner reads them in. The hashes are allocated up front, the
+// same as the single frame benchmark, so only the hashing itself is compared.
+func BenchmarkHashFramesBatch(b *testing.B) {
+	batch, _ := NewBatchHasher(Options{})
+	pix := benchmarkFrames(b)
+	start := time.Now()
+
+	chunk := batchFrames * 4 * width * height
+	for n := 0; n < b.N; n++ {
+		hashes := make([]Hash, 0, benchFrames)
+		for i := 0; i < len(pix); i += chunk {
+			end := i + chunk
+			if end > len(pix) {
+				end = len(pix)
+			}
+			hashes, _ = batch.HashFrames(hashes, pix[i:end])
+		}
+	}
+	b.ReportMetric(float64(benchFrames*b.N)/time.Since(start).Seconds(), "frames/s")
+}
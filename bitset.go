@@ -0,0 +1,103 @@
+package imghash
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// A variable width hash, where bit i is stored in word i/64 at position i%64.
+// Hashes of up to 64 bits fit in a single word, so they are stored exactly as a plain uint64 was.
+type BitSet []uint64
+
+// Returns an empty bitset large enough to hold n bits.
+func NewBitSet(n int) BitSet {
+	return make(BitSet, (n+63)/64)
+}
+
+// Sets bit i, which must be within the bitset's length.
+func (b BitSet) Set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+// Returns whether bit i is set, treating bits past the end of the bitset as unset.
+func (b BitSet) Get(i int) bool {
+	if i/64 >= len(b) {
+		return false
+	}
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+// Returns the number of set bits.
+func (b BitSet) Count() (n int) {
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return
+}
+
+// Returns the hamming distance between the two bitsets. If one is longer than the other the
+// missing words are treated as zero, so every set bit in the extra words counts towards the distance.
+func (b BitSet) Distance(o BitSet) (n int) {
+	if len(b) < len(o) {
+		b, o = o, b
+	}
+
+	for i, w := range o {
+		n += bits.OnesCount64(b[i] ^ w)
+	}
+	return n + b[len(o):].Count()
+}
+
+// Identical to Distance, but ignores every bit that is set in either mask. Empty masks ignore nothing.
+func (b BitSet) MaskedDistance(o, mask1, mask2 BitSet) (n int) {
+	if len(mask1) == 0 && len(mask2) == 0 {
+		return b.Distance(o)
+	}
+
+	words := len(b)
+	if len(o) > words {
+		words = len(o)
+	}
+
+	for i := 0; i < words; i++ {
+		var w1, w2, m uint64
+		if i < len(b) {
+			w1 = b[i]
+		}
+		if i < len(o) {
+			w2 = o[i]
+		}
+		if i < len(mask1) {
+			m |= mask1[i]
+		}
+		if i < len(mask2) {
+			m |= mask2[i]
+		}
+		n += bits.OnesCount64((w1 ^ w2) &^ m)
+	}
+	return
+}
+
+// Returns whether both bitsets have the same length and bits.
+func (b BitSet) Equal(o BitSet) bool {
+	if len(b) != len(o) {
+		return false
+	}
+
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Formats the bitset as hexadecimal with the most significant word first, so a single word prints like a uint64 would.
+func (b BitSet) String() string {
+	var sb strings.Builder
+	for i := len(b) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%016x", b[i])
+	}
+	return sb.String()
+}
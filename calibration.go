@@ -0,0 +1,418 @@
+package imghash
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The file magic for calibration files. Abbreviation of Difference Hash Calibration.
+const CalibrationMagic = "DHC"
+
+const (
+	calibrationVersion1 byte = iota + 1
+	// Records the metric and colour mode the distances were measured with, version 1 files are always MaskedMetric
+	// distances without colour
+	calibrationVersion2
+
+	latestCalibrationVersion = calibrationVersion2
+)
+
+// The tags metrics are recorded with in calibration files, which can't change once files have been written with them.
+const (
+	metricMasked byte = iota + 1
+	metricSum
+	metricWeighted
+	metricMax
+	metricVertical
+	metricHorizontal
+)
+
+// A pair of hashes labelled with whether they came from the same image, used to fit a Calibration.
+type LabelledPair struct {
+	A, B Hash
+	Same bool
+}
+
+// Calibration turns distances between hashes from one hasher into the probability that they came from the same image,
+// using a logistic curve over the distance as a fraction of the hasher's bits fitted to labelled pairs. Unlike a raw
+// distance, the same confidence means roughly the same thing for every hasher. The metric and colour mode the distances
+// were measured with are recorded too, since the curve means nothing for distances measured any other way.
+type Calibration struct {
+	hasher string
+	bits   int
+	pairs  int
+
+	// The metric distances were measured with, always one of the metrics here, and whether colour distances were added
+	metric Metric
+	colour ColourMode
+
+	// The confidence at distance d is 1 / (1 + e^-(intercept + slope*d/bits))
+	intercept, slope float64
+}
+
+// Fits a calibration for the named hasher from pairs of its hashes, measuring each pair the way a Tree with the default
+// MaskedMetric does, with colour left out. Returns an error of type UnknownHasher if the hasher isn't registered.
+func NewCalibration(hasher string, pairs []LabelledPair) (*Calibration, error) {
+	return NewCalibrationWithMetric(hasher, MaskedMetric{}, ColourIgnore, pairs)
+}
+
+// Identical to NewCalibration, but measures each pair the way a tree with the given metric and colour mode does, and
+// can only be used with such a tree. The metric must be one of the metrics here, since other metrics can't be recorded.
+func NewCalibrationWithMetric(hasher string, metric Metric, colour ColourMode, pairs []LabelledPair) (*Calibration, error) {
+	var same, different []int
+	for _, p := range pairs {
+		d := metric.Distance(&p.A, &p.B)
+		if colour == ColourRequire {
+			d += p.A.ColourDistance(p.B)
+		}
+
+		if p.Same {
+			same = append(same, d)
+		} else {
+			different = append(different, d)
+		}
+	}
+	return NewCalibrationFromDistancesWithMetric(hasher, metric, colour, same, different)
+}
+
+// Identical to NewCalibration, but fits the distances of pairs that are known to be of the same image, and of pairs
+// known to be of different images. There must be at least one of each. The distances are taken to have been measured
+// with MaskedMetric and colour left out.
+func NewCalibrationFromDistances(hasher string, same, different []int) (*Calibration, error) {
+	return NewCalibrationFromDistancesWithMetric(hasher, MaskedMetric{}, ColourIgnore, same, different)
+}
+
+// Identical to NewCalibrationFromDistances, but records that the distances were measured with the given metric and
+// colour mode, so the calibration can only be used with a tree that measures them the same way.
+func NewCalibrationFromDistancesWithMetric(hasher string, metric Metric, colour ColourMode, same, different []int) (*Calibration, error) {
+	h, err := LookupHasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMetric(metric); err != nil {
+		return nil, err
+	} else if _, _, err := metricTag(metric); err != nil {
+		return nil, err
+	} else if len(same) == 0 || len(different) == 0 {
+		return nil, errors.Errorf("calibrating needs pairs of both kinds, but got %d same and %d different", len(same), len(different))
+	}
+
+	c := &Calibration{hasher: hasher, bits: h.Bits(), pairs: len(same) + len(different), metric: metric, colour: colour}
+	if err := c.fit(same, different); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Fits the logistic curve with Platt's method, which replaces the 0 and 1 labels with targets just inside them so the fit
+// still converges when every same pair is closer than every different pair, as they usually are.
+func (c *Calibration) fit(same, different []int) error {
+	// Distances are whole numbers, so pairs are grouped by distance and each group is weighed once
+	var size int
+	for _, d := range append(append([]int(nil), same...), different...) {
+		if d < 0 {
+			return errors.Errorf("distances can't be negative, got %d", d)
+		} else if d >= size {
+			size = d + 1
+		}
+	}
+
+	pos, neg := float64(len(same)), float64(len(different))
+	hi, lo := (pos+1)/(pos+2), 1/(neg+2)
+
+	count, target := make([]float64, size), make([]float64, size)
+	for _, d := range same {
+		count[d]++
+		target[d] += hi
+	}
+	for _, d := range different {
+		count[d]++
+		target[d] += lo
+	}
+
+	softplus := func(z float64) float64 { return math.Max(z, 0) + math.Log1p(math.Exp(-math.Abs(z))) }
+	loss := func(a, b float64) (l float64) {
+		for d, n := range count {
+			if n > 0 {
+				z := a + b*float64(d)/float64(c.bits)
+				l += target[d]*softplus(-z) + (n-target[d])*softplus(z)
+			}
+		}
+		return
+	}
+
+	a, b := math.Log((pos+1)/(neg+1)), 0.0
+	l := loss(a, b)
+	for iter := 0; iter < 100; iter++ {
+		var ga, gb, haa, hab, hbb float64
+		for d, n := range count {
+			if n == 0 {
+				continue
+			}
+
+			x := float64(d) / float64(c.bits)
+			p := 1 / (1 + math.Exp(-(a + b*x)))
+			g, w := n*p-target[d], n*p*(1-p)
+			ga, gb = ga+g, gb+g*x
+			haa, hab, hbb = haa+w, hab+w*x, hbb+w*x*x
+		}
+
+		if math.Abs(ga) < 1e-9 && math.Abs(gb) < 1e-9 {
+			break
+		}
+
+		// A tiny ridge keeps the Hessian invertible when every pair is at the same distance
+		haa, hbb = haa+1e-12, hbb+1e-12
+		det := haa*hbb - hab*hab
+		da, db := (hbb*ga-hab*gb)/det, (haa*gb-hab*ga)/det
+
+		// Newton steps can overshoot far from the optimum, so they're halved until the loss goes down
+		step := 1.0
+		for ; step > 1e-10; step /= 2 {
+			if nl := loss(a-step*da, b-step*db); nl <= l {
+				a, b, l = a-step*da, b-step*db, nl
+				break
+			}
+		}
+		if step <= 1e-10 {
+			break
+		}
+	}
+
+	if b >= 0 {
+		return errors.New("pairs of the same image aren't any closer than pairs of different images")
+	}
+	c.intercept, c.slope = a, b
+	return nil
+}
+
+// Returns the name of the hasher the calibration was fitted for.
+func (c *Calibration) Hasher() string {
+	return c.hasher
+}
+
+// Returns the metric the calibration's distances were measured with.
+func (c *Calibration) Metric() Metric {
+	return c.metric
+}
+
+// Returns whether the calibration's distances had colour distances added on.
+func (c *Calibration) ColourMode() ColourMode {
+	return c.colour
+}
+
+// Returns the tag a metric is recorded with and its parameters, which are the weights of a WeightedMetric. Returns an
+// error for any metric from outside this package, since there's no way to tell whether a tree's measures the same.
+func metricTag(m Metric) (byte, []int, error) {
+	switch m := m.(type) {
+	case MaskedMetric:
+		return metricMasked, nil, nil
+	case SumMetric:
+		return metricSum, nil, nil
+	case WeightedMetric:
+		return metricWeighted, []int{m.Vertical, m.Horizontal, m.Diagonal}, nil
+	case MaxMetric:
+		return metricMax, nil, nil
+	case VerticalMetric:
+		return metricVertical, nil, nil
+	case HorizontalMetric:
+		return metricHorizontal, nil, nil
+	}
+	return 0, nil, errors.Errorf("distances measured with %T can't be calibrated, only those of the metrics here", m)
+}
+
+// Returns the metric recorded with the tag and parameters, the opposite of metricTag.
+func taggedMetric(tag byte, params []int) (Metric, error) {
+	want := 0
+	if tag == metricWeighted {
+		want = 3
+	}
+
+	if len(params) != want {
+		return nil, errors.Errorf("metric %d has %d parameters, want %d", tag, len(params), want)
+	}
+
+	switch tag {
+	case metricMasked:
+		return MaskedMetric{}, nil
+	case metricSum:
+		return SumMetric{}, nil
+	case metricWeighted:
+		return WeightedMetric{Vertical: params[0], Horizontal: params[1], Diagonal: params[2]}, nil
+	case metricMax:
+		return MaxMetric{}, nil
+	case metricVertical:
+		return VerticalMetric{}, nil
+	case metricHorizontal:
+		return HorizontalMetric{}, nil
+	}
+	return nil, errors.Errorf("unknown metric %d", tag)
+}
+
+// Returns the number of labelled pairs the calibration was fitted from.
+func (c *Calibration) Pairs() int {
+	return c.pairs
+}
+
+// Returns the probability that two hashes this far apart came from the same image.
+func (c *Calibration) Confidence(dist int) float64 {
+	return 1 / (1 + math.Exp(-(c.intercept + c.slope*float64(dist)/float64(c.bits))))
+}
+
+// Returns the largest distance with at least the given confidence, to be passed to Tree.NearestDist, or -1 if even
+// identical hashes are less confident than that.
+func (c *Calibration) MaxDistance(confidence float64) int {
+	if confidence <= 0 {
+		return math.MaxInt32
+	} else if confidence >= 1 || c.Confidence(0) < confidence {
+		return -1
+	}
+
+	d := int(math.Floor((math.Log(confidence/(1-confidence)) - c.intercept) / c.slope * float64(c.bits)))
+
+	// Rounding can leave the boundary a distance out either way
+	for d > 0 && c.Confidence(d) < confidence {
+		d--
+	}
+	for c.Confidence(d+1) >= confidence {
+		d++
+	}
+	return d
+}
+
+// Writes calibrations for any number of hashers to the given output path, appending the appropriate file extension.
+// Each hasher can only have one calibration in a file.
+func WriteCalibrations(path string, cals ...*Calibration) error {
+	buf := []byte(CalibrationMagic)
+	buf = append(buf, latestCalibrationVersion)
+	buf = putUint32(buf, uint32(len(cals)))
+
+	seen := make(map[string]bool)
+	for _, c := range cals {
+		if seen[c.hasher] {
+			return errors.Errorf("hasher %q is calibrated more than once", c.hasher)
+		}
+		seen[c.hasher] = true
+
+		tag, params, err := metricTag(c.metric)
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, byte(len(c.hasher)))
+		buf = append(buf, c.hasher...)
+		buf = append(buf, tag, byte(len(params)))
+		for _, p := range params {
+			buf = putUint32(buf, uint32(p))
+		}
+		buf = append(buf, byte(c.colour))
+		buf = putUint32(buf, uint32(c.bits))
+		buf = putUint32(buf, uint32(c.pairs))
+		buf = putUint64(buf, math.Float64bits(c.intercept))
+		buf = putUint64(buf, math.Float64bits(c.slope))
+	}
+
+	if err := os.WriteFile(path+"."+strings.ToLower(CalibrationMagic), buf, 0666); err != nil {
+		return errors.Wrap(err, "writing output")
+	}
+	return nil
+}
+
+// Reads every calibration in a file written by WriteCalibrations, keyed by the name of its hasher. Returns InvalidHeader
+// if the file isn't a calibration file.
+func LoadCalibrations(name string) (map[string]*Calibration, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, errors.Wrap(err, "reading header data")
+	}
+
+	if string(header[:3]) != CalibrationMagic {
+		return nil, InvalidHeader
+	}
+
+	version := header[3]
+	if version < calibrationVersion1 || version > latestCalibrationVersion {
+		return nil, errors.Errorf("unknown calibration file version %d", version)
+	}
+
+	count := binary.LittleEndian.Uint32(header[4:])
+	cals := make(map[string]*Calibration, count)
+	for i := uint32(0); i < count; i++ {
+		c, err := readCalibration(file, version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading calibration %d", i)
+		}
+		cals[c.hasher] = c
+	}
+	return cals, nil
+}
+
+// Reads a single calibration from a file of the given version.
+func readCalibration(r io.Reader, version byte) (*Calibration, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	name := make([]byte, length[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, err
+	}
+
+	// Version 1 calibrations were all fitted to the distances a default tree measures
+	c := &Calibration{hasher: string(name), metric: MaskedMetric{}, colour: ColourIgnore}
+	if version >= calibrationVersion2 {
+		// The metric's tag and number of parameters, then each parameter and the colour mode
+		var tag [2]byte
+		if _, err := io.ReadFull(r, tag[:]); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 4*int(tag[1])+1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		params := make([]int, tag[1])
+		for p := range params {
+			params[p] = int(binary.LittleEndian.Uint32(buf[4*p:]))
+		}
+
+		var err error
+		if c.metric, err = taggedMetric(tag[0], params); err != nil {
+			return nil, errors.Wrapf(err, "calibration for %q", c.hasher)
+		}
+
+		c.colour = ColourMode(buf[len(buf)-1])
+		if c.colour > ColourRequire {
+			return nil, errors.Errorf("calibration for %q has an unknown colour mode %d", c.hasher, c.colour)
+		}
+	}
+
+	buf := make([]byte, 24)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	c.bits = int(binary.LittleEndian.Uint32(buf))
+	c.pairs = int(binary.LittleEndian.Uint32(buf[4:]))
+	c.intercept = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+	c.slope = math.Float64frombits(binary.LittleEndian.Uint64(buf[16:]))
+
+	if c.bits <= 0 {
+		return nil, errors.Errorf("calibration for %q has %d bits", c.hasher, c.bits)
+	}
+	return c, nil
+}
@@ -0,0 +1,213 @@
+package imghash
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a copy of a hash with n random bits of each plane flipped, which may flip the same bit twice.
+func noisyHash(h Hash, n int, index uint32) Hash {
+	c := Hash{VHash: append(BitSet(nil), h.VHash...), HHash: append(BitSet(nil), h.HHash...), Index: index}
+	for i := 0; i < n; i++ {
+		c.VHash[0] ^= 1 << uint(rand.Intn(64))
+		c.HHash[0] ^= 1 << uint(rand.Intn(64))
+	}
+	return c
+}
+
+// Copies of an image are a few bits apart and different images are about half their bits apart,
+// so a fitted calibration should be confident of the first and not the second.
+func TestCalibration(t *testing.T) {
+	var pairs []LabelledPair
+	for i := 0; i < 500; i++ {
+		h := randomHash(1, 1, 1)
+		pairs = append(pairs, LabelledPair{A: h, B: noisyHash(h, rand.Intn(6), 2), Same: true})
+		pairs = append(pairs, LabelledPair{A: h, B: randomHash(1, 1, 3)})
+	}
+
+	// A couple of mislabelled pairs mustn't stop the fit
+	pairs[0].Same, pairs[1].Same = false, true
+
+	c, err := NewCalibration(DefaultHasher, pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := c.Confidence(0); p < 0.99 {
+		t.Errorf("identical hashes only have a confidence of %f", p)
+	}
+	if p := c.Confidence(64); p > 0.01 {
+		t.Errorf("unrelated hashes have a confidence of %f", p)
+	}
+	for d := 1; d <= 128; d++ {
+		if c.Confidence(d) > c.Confidence(d-1) {
+			t.Fatalf("confidence rises from %d to %d", d-1, d)
+		}
+	}
+
+	d := c.MaxDistance(0.9)
+	if c.Confidence(d) < 0.9 || c.Confidence(d+1) >= 0.9 {
+		t.Errorf("max distance %d for 0.9 is wrong, confidences are %f and %f", d, c.Confidence(d), c.Confidence(d+1))
+	}
+
+	path := filepath.Join(t.TempDir(), "test")
+	if err := WriteCalibrations(path, c); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCalibrations(path + "." + strings.ToLower(CalibrationMagic))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := loaded[DefaultHasher]
+	if l == nil || l.Pairs() != len(pairs) || l.Confidence(d) != c.Confidence(d) || l.Metric() != c.Metric() || l.ColourMode() != c.ColourMode() {
+		t.Fatalf("calibration didn't survive a round trip: %+v vs %+v", l, c)
+	}
+
+	// Tree results carry the confidence of their distance
+	hashes := []Hash{randomHash(1, 1, 1), randomHash(1, 1, 2)}
+	query := noisyHash(hashes[0], 2, 0)
+
+	tree := NewTree(hashes)
+	if err := tree.SetCalibration(l); err != nil {
+		t.Fatal(err)
+	}
+
+	q := tree.NearestDist(&query, 128)
+	for _, item := range q {
+		if math.Abs(item.Confidence-c.Confidence(item.Dist)) > 1e-12 {
+			t.Errorf("result at distance %d has confidence %f, want %f", item.Dist, item.Confidence, c.Confidence(item.Dist))
+		}
+	}
+	if len(q) != 2 || q[0].Confidence < 0.9 || q[1].Confidence > 0.1 {
+		t.Errorf("results weren't calibrated: %+v", q)
+	}
+
+	other, _ := NewTreeWithHasher(nil, "ahash")
+	if err := other.SetCalibration(c); err == nil {
+		t.Error("set a dhash calibration on an ahash tree")
+	}
+
+	// Distances measured any other way don't fit the curve, so the tree has to measure them the way the pairs were
+	weighted := WeightedMetric{Vertical: 2, Horizontal: 1}
+	wtree, _ := NewTreeWithMetric(hashes, DefaultHasher, weighted)
+	if err := wtree.SetCalibration(c); err == nil {
+		t.Error("set a masked distance calibration on a tree with a weighted metric")
+	}
+
+	wc, err := NewCalibrationWithMetric(DefaultHasher, weighted, ColourIgnore, pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtree.SetCalibration(wc); err != nil {
+		t.Errorf("couldn't set a weighted calibration on a tree with the same weights: %v", err)
+	}
+
+	if sum, _ := NewTreeWithMetric(hashes, DefaultHasher, WeightedMetric{Vertical: 1, Horizontal: 1}); sum.SetCalibration(wc) == nil {
+		t.Error("set a weighted calibration on a tree with different weights")
+	}
+
+	// The weights are written out, so they still tell the trees apart once loaded
+	if err := WriteCalibrations(path, wc); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = LoadCalibrations(path + "." + strings.ToLower(CalibrationMagic)); err != nil {
+		t.Fatal(err)
+	} else if l := loaded[DefaultHasher]; l.Metric() != weighted || wtree.SetCalibration(l) != nil {
+		t.Errorf("weighted calibration was loaded with %#v", l.Metric())
+	}
+
+	if err := tree.SetCalibration(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetColourMode(ColourRequire); err == nil {
+		t.Error("started requiring colour with a calibration fitted without it")
+	} else if tree.Calibration() != c {
+		t.Error("calibration was dropped by a colour mode that was refused")
+	}
+
+	if err := tree.SetCalibration(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetColourMode(ColourRequire); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetCalibration(c); err == nil {
+		t.Error("set a calibration fitted without colour on a tree requiring colour")
+	}
+}
+
+// Version 1 files were written before calibrations recorded how distances were measured, which was always the way a
+// default tree measures them.
+func TestCalibrationVersion1(t *testing.T) {
+	buf := []byte(CalibrationMagic)
+	buf = append(buf, calibrationVersion1)
+	buf = putUint32(buf, 1)
+	buf = append(buf, byte(len(DefaultHasher)))
+	buf = append(buf, DefaultHasher...)
+	buf = putUint32(buf, 128)
+	buf = putUint32(buf, 10)
+	buf = putUint64(buf, math.Float64bits(5))
+	buf = putUint64(buf, math.Float64bits(-40))
+
+	path := filepath.Join(t.TempDir(), "v1.dhc")
+	if err := os.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCalibrations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := loaded[DefaultHasher]
+	if c == nil || c.Pairs() != 10 || c.Metric() != (MaskedMetric{}) || c.ColourMode() != ColourIgnore {
+		t.Fatalf("version 1 calibration was loaded as %+v", c)
+	}
+	if p := c.Confidence(0); math.Abs(p-1/(1+math.Exp(-5))) > 1e-12 {
+		t.Errorf("version 1 calibration has a confidence of %f at 0", p)
+	}
+	if err := NewTree(nil).SetCalibration(c); err != nil {
+		t.Errorf("couldn't set a version 1 calibration on a default tree: %v", err)
+	}
+}
+
+// A metric from outside the package can't be recorded, so a tree using it could never be told apart from another.
+type oddMetric struct{}
+
+func (oddMetric) Distance(a, b *Hash) int { return a.Distance(*b) % 7 }
+
+func TestCalibrationErrors(t *testing.T) {
+	if _, err := NewCalibrationFromDistancesWithMetric(DefaultHasher, oddMetric{}, ColourIgnore, []int{1}, []int{6}); err == nil {
+		t.Error("calibrated a metric from outside the package")
+	}
+	if _, err := NewCalibrationFromDistancesWithMetric(DefaultHasher, WeightedMetric{Vertical: -1}, ColourIgnore, []int{1}, []int{60}); err == nil {
+		t.Error("calibrated a metric with a negative weight")
+	}
+
+	if _, err := NewCalibrationFromDistances(DefaultHasher, []int{1, 2}, nil); err == nil {
+		t.Error("calibrated without any different pairs")
+	}
+
+	if _, err := NewCalibrationFromDistances(DefaultHasher, []int{60, 64}, []int{1, 2}); err == nil {
+		t.Error("calibrated with same pairs further apart than different ones")
+	}
+
+	if _, err := NewCalibrationFromDistances("nothash", []int{1}, []int{60}); err == nil {
+		t.Error("calibrated an unknown hasher")
+	}
+
+	// Perfectly separated pairs still give a finite curve
+	c, err := NewCalibrationFromDistances(DefaultHasher, []int{0, 1, 2, 3}, []int{50, 60, 64, 70})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := c.Confidence(30); math.IsNaN(p) || p <= 0 || p >= 1 {
+		t.Errorf("confidence between the two groups is %f", p)
+	}
+}
@@ -0,0 +1,154 @@
+package imghash
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// The number of frames a clip signature covers when Options.ClipFrames is left at DefaultClipFrames, which is five
+// seconds of video at the 12 frames per second videos are hashed at.
+const DefaultClipFrames = 60
+
+const (
+	// Each clip is split into this many segments of consecutive frames, which are voted on separately so the
+	// signature also captures how the clip changes over time.
+	clipSegments = 4
+
+	// Clips start every 1/clipSteps of their length, so a query clip is never more than half a step out of line with
+	// the nearest indexed clip.
+	clipSteps = 10
+)
+
+// ClipSignatures computes temporal signatures over sliding windows of length consecutive frame hashes, such as every
+// frame of a video before it is deduplicated. Each window is split into four segments, and every bit of the vertical
+// and horizontal hashes is set in a segment's part of the signature if it is set in most of the segment's frames. A
+// clip's signature barely changes when frames are dropped, shifted or recompressed, so a clip can be looked up in a tree
+// of them with a single search rather than by voting over its frames.
+//
+// Each signature is returned as a Hash whose VHash holds the signature, whose Index is the index of the clip's first
+// frame, and whose Source is the first frame's source. There are none if there are fewer frames than length.
+func ClipSignatures(frames []Hash, length int) ([]Hash, error) {
+	if err := checkClipFrames(length); err != nil {
+		return nil, err
+	} else if len(frames) < length || length == 0 {
+		return nil, nil
+	}
+
+	nv, nh := len(frames[0].VHash), len(frames[0].HHash)
+	words := nv + nh
+	for i := range frames {
+		if len(frames[i].VHash) != nv || len(frames[i].HHash) != nh {
+			return nil, errors.Errorf("frame %d has a different size to the first", i)
+		}
+	}
+
+	step := length / clipSteps
+	if step < 1 {
+		step = 1
+	}
+
+	// Like windows, the last clip always ends on the last frame, even if that's less than a full step on
+	var starts []int
+	for s := 0; s+length < len(frames); s += step {
+		starts = append(starts, s)
+	}
+	starts = append(starts, len(frames)-length)
+
+	counts := make([]int, 64*words)
+	clips := make([]Hash, len(starts))
+	slab := make(BitSet, len(starts)*clipSegments*words)
+	for c, start := range starts {
+		sig := slab[: clipSegments*words : clipSegments*words]
+		slab = slab[clipSegments*words:]
+
+		for s := 0; s < clipSegments; s++ {
+			first, last := start+s*length/clipSegments, start+(s+1)*length/clipSegments
+			for i := range counts {
+				counts[i] = 0
+			}
+
+			for _, f := range frames[first:last] {
+				countBits(counts, f.VHash)
+				countBits(counts[64*nv:], f.HHash)
+			}
+
+			out := sig[s*words:]
+			for i, n := range counts {
+				if 2*n > last-first {
+					out[i/64] |= 1 << uint(i%64)
+				}
+			}
+		}
+
+		clips[c] = Hash{VHash: sig, Index: frames[start].Index, Source: frames[start].Source}
+	}
+	return clips, nil
+}
+
+// Computes the clip signatures of every run of hashes sharing a source, such as each video in a directory. Sources with
+// fewer than length frames, like still images, have none.
+func clipsBySource(hashes []Hash, length int) ([]Hash, error) {
+	var clips []Hash
+	for start := 0; start < len(hashes) && length > 0; {
+		end := start + 1
+		for end < len(hashes) && hashes[end].Source == hashes[start].Source {
+			end++
+		}
+
+		c, err := ClipSignatures(hashes[start:end], length)
+		if err != nil {
+			return nil, err
+		}
+		clips = append(clips, c...)
+		start = end
+	}
+	return clips, nil
+}
+
+// Adds one to the count of every bit set in b.
+func countBits(counts []int, b BitSet) {
+	for w, word := range b {
+		for ; word != 0; word &= word - 1 {
+			counts[64*w+bits.TrailingZeros64(word)]++
+		}
+	}
+}
+
+// Returns an error if n isn't a valid number of frames per clip.
+func checkClipFrames(n int) error {
+	if n != 0 && (n < clipSegments || n > math.MaxUint16) {
+		return errors.Errorf("clips must be between %d and %d frames long, not %d", clipSegments, math.MaxUint16, n)
+	}
+	return nil
+}
+
+// Constructs a tree of the clip signatures of every file, so a clip hashed with ClipSignatures can be looked up with
+// NearestN or NearestDist. Returns an error if the files were created by different hashers, with different options that
+// change how images are hashed, or with clips of different lengths.
+func NewTreeFromClips(files ...*File) (*Tree, error) {
+	if len(files) == 0 {
+		return NewTreeWithHasher(nil, DefaultHasher)
+	}
+
+	var clips []Hash
+	for _, f := range files {
+		if err := files[0].comparable(f); err != nil {
+			return nil, errors.Wrap(err, "building clip tree")
+		}
+		if f.clipFrames != files[0].clipFrames {
+			return nil, errors.Errorf("cannot mix clips of %d and %d frames in one tree", files[0].clipFrames, f.clipFrames)
+		}
+		clips = append(clips, f.clips...)
+	}
+
+	t, err := NewTreeWithHasher(clips, files[0].hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each signature holds the vertical and horizontal bits of every segment
+	t.bits = clipSegments * t.hasher.Bits()
+	return t, nil
+}
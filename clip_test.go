@@ -0,0 +1,153 @@
+package imghash
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the hashes of every frame of a simulated video, made of scenes whose frames drift a bit at a time.
+func videoHashes(frames int, source uint32) []Hash {
+	var (
+		hashes []Hash
+		scene  Hash
+	)
+
+	for i := 0; i < frames; i++ {
+		if i%(30+rand.Intn(60)) == 0 {
+			scene = randomHash(1, 1, 0)
+		} else {
+			scene = noisyHash(scene, 1, 0)
+		}
+
+		h := noisyHash(scene, 0, uint32(i+1))
+		h.Source = source
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// A noisy clip cut from anywhere in a video must be found with a single search, close to where it was cut from.
+func TestClipSignatures(t *testing.T) {
+	var hashes []Hash
+	for s := uint32(0); s < 4; s++ {
+		hashes = append(hashes, videoHashes(1200, s)...)
+	}
+
+	clips, err := clipsBySource(hashes, DefaultClipFrames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every video gets a clip each step, and one more aligned to its end
+	if want := 4 * ((1200-DefaultClipFrames+5)/6 + 1); len(clips) != want {
+		t.Fatalf("got %d clips, want %d", len(clips), want)
+	}
+	if last := clips[len(clips)-1]; last.Source != 3 || last.Index != 1200-DefaultClipFrames+1 {
+		t.Errorf("last clip starts at frame %d of source %d", last.Index, last.Source)
+	}
+	if n := len(clips[0].VHash); n != clipSegments*2 {
+		t.Fatalf("signatures are %d words, want %d", n, clipSegments*2)
+	}
+
+	tree, err := NewTreeWithHasher(append([]Hash(nil), clips...), DefaultHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		source, start := rand.Intn(4), rand.Intn(1200-DefaultClipFrames)
+		frames := hashes[1200*source+start : 1200*source+start+DefaultClipFrames]
+
+		query := make([]Hash, len(frames))
+		for j := range frames {
+			query[j] = noisyHash(frames[j], 4, 0)
+		}
+
+		q, err := ClipSignatures(query, DefaultClipFrames)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(q) != 1 {
+			t.Fatalf("a clip of exactly %d frames gave %d signatures", DefaultClipFrames, len(q))
+		}
+
+		var best *heapItem
+		for _, item := range tree.NearestDist(&q[0], 128) {
+			if best == nil || item.Dist < best.Dist {
+				item := item
+				best = &item
+			}
+		}
+
+		if best == nil || best.Item.Source != uint32(source) || abs64(int64(best.Item.Index)-int64(start+1)) > DefaultClipFrames/clipSteps {
+			t.Fatalf("clip at frame %d of source %d matched %+v", start+1, source, best)
+		}
+	}
+
+	if c, err := ClipSignatures(hashes[:DefaultClipFrames-1], DefaultClipFrames); err != nil || len(c) != 0 {
+		t.Errorf("a video shorter than a clip gave %d clips and %v", len(c), err)
+	}
+	if _, err := ClipSignatures(hashes, clipSegments-1); err == nil {
+		t.Error("clips shorter than the number of segments were accepted")
+	}
+}
+
+// Clips are stored in their own section and make up their own trees.
+func TestFileClips(t *testing.T) {
+	hashes := videoHashes(300, 0)
+	clips, err := ClipSignatures(hashes, DefaultClipFrames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFile()
+	f.hashes = hashes
+	f.clips = clips
+	f.clipFrames = DefaultClipFrames
+
+	loaded := roundTrip(t, f)
+	if loaded.ClipFrames() != DefaultClipFrames || loaded.Options().ClipFrames != DefaultClipFrames {
+		t.Errorf("file recorded clips of %d frames", loaded.ClipFrames())
+	}
+	if len(loaded.Clips()) != len(clips) {
+		t.Fatalf("loaded %d clips, want %d", len(loaded.Clips()), len(clips))
+	}
+	for i, c := range loaded.Clips() {
+		if c.Index != clips[i].Index || c.Source != clips[i].Source || !c.VHash.Equal(clips[i].VHash) {
+			t.Fatalf("clip %d is %+v, want %+v", i, c, clips[i])
+		}
+	}
+
+	tree, err := NewTreeFromClips(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != len(clips) {
+		t.Errorf("tree holds %d clips, want %d", tree.Len(), len(clips))
+	}
+	if want := clipSegments * tree.Hasher().Bits(); tree.Bits() != want {
+		t.Errorf("clip tree has %d bit hashes, want %d", tree.Bits(), want)
+	}
+
+	// A calibration of frame distances puts clips far too close, since they have more bits to differ in
+	c, err := NewCalibrationFromDistances(loaded.hasher, []int{0, 1, 2, 3}, []int{50, 60, 64, 70})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetCalibration(c); err == nil {
+		t.Error("set a calibration of frame hashes on a tree of clips")
+	}
+
+	other := NewFile()
+	other.clipFrames = 2 * DefaultClipFrames
+	if _, err := NewTreeFromClips(loaded, other); err == nil {
+		t.Error("clips of different lengths were mixed in one tree")
+	}
+
+	v1 := NewFileWithVersion(fileVersion1)
+	v1.hashes = hashes[:1]
+	v1.clipFrames = DefaultClipFrames
+	if err := v1.Write(filepath.Join(t.TempDir(), "v1")); err == nil {
+		t.Error("wrote clips to a version 1 file")
+	}
+}
@@ -18,6 +18,8 @@ var (
 	filename = flag.String("f", "", "The name of the file to open for hash testing")
 	option   = flag.String("o", "write", "Option to pass to the hasher (defualt write)")
 	logfile  = flag.String("l", "-", "The location to send hashing logs to (default stdout)")
+	hasher   = flag.String("a", imghash.DefaultHasher, "The hashing algorithm to use when writing, such as ahash, phash, whash, rhash, imagehash-dhash or dhash17x17 (default dhash)")
+	autocrop = flag.Bool("c", false, "Crop black bars off images and videos before hashing them")
 	logger   *imghash.Logger
 )
 
@@ -92,6 +94,11 @@ func testVPTree(dir string) error {
 	return nil
 }
 
+// Returns the hashing options set by the command line flags.
+func options() imghash.Options {
+	return imghash.Options{Hasher: *hasher, AutoCrop: *autocrop}
+}
+
 func main() {
 	flag.Parse()
 
@@ -122,7 +129,7 @@ func main() {
 	logger.Debugln("start")
 	switch *option {
 	case "write":
-		file, err := imghash.NewFromPath(*filename)
+		file, err := imghash.NewFromPathWithOptions(*filename, options())
 		if err != nil {
 			logger.Errorln("Making hash from video: " + err.Error())
 		}
@@ -152,7 +159,7 @@ func main() {
 		logger.Debugln(f2.Length())
 		logger.Debugln(imghash.Compare(f, f2))
 	case "check":
-		ep, err := imghash.NewFromPath(*filename)
+		ep, err := imghash.NewFromPathWithOptions(*filename, options())
 		if err != nil {
 			logger.Errorln("Making hash from video: " + err.Error())
 		}
@@ -0,0 +1,100 @@
+package imghash
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The mean luminance at or below which a row or column at the edge of an image counts as part of a black bar.
+// This is the same default ffmpeg's cropdetect uses, so stills and videos are cropped alike.
+const cropLimit = 24
+
+// DetectBorders returns the active picture area of an image by trimming the black bars around it, such as the
+// letterboxing and pillarboxing added when a video is re-encoded at a different aspect ratio. The bounds of the
+// image are returned if there are no bars, or if the image is black all the way through.
+func DetectBorders(img image.Image) image.Rectangle {
+	b := img.Bounds()
+	return detectBorders(toNRGBA(img)).Add(b.Min)
+}
+
+func detectBorders(img *image.NRGBA) image.Rectangle {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	luma := luminance(img)
+
+	// Returns whether the mean of n pixels starting at i, each step apart, is dark enough to be a bar
+	dark := func(i, step, n int) bool {
+		var sum int
+		for j := 0; j < n; j++ {
+			sum += int(luma[i+j*step])
+		}
+		return sum <= cropLimit*n
+	}
+
+	var r image.Rectangle
+	for r.Min.Y = 0; r.Min.Y < h && dark(r.Min.Y*w, 1, w); r.Min.Y++ {
+	}
+
+	// Nothing but bars, so there's nothing sensible to crop to
+	if r.Min.Y == h {
+		return img.Rect.Sub(img.Rect.Min)
+	}
+
+	for r.Max.Y = h; r.Max.Y > r.Min.Y && dark((r.Max.Y-1)*w, 1, w); r.Max.Y-- {
+	}
+
+	rows := r.Max.Y - r.Min.Y
+	for r.Min.X = 0; r.Min.X < w && dark(r.Min.Y*w+r.Min.X, w, rows); r.Min.X++ {
+	}
+	for r.Max.X = w; r.Max.X > r.Min.X && dark(r.Min.Y*w+r.Max.X-1, w, rows); r.Max.X-- {
+	}
+
+	return r
+}
+
+var cropPattern = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
+
+// Runs ffmpeg's cropdetect over a whole video, returning the largest active picture area it found across every
+// frame. An empty rectangle is returned if cropdetect didn't report anything, such as when every frame is black.
+func cropdetect(name string, opts Options) (image.Rectangle, error) {
+	// Stills that had to go through ffmpeg only have one frame, so none can be skipped
+	filter := fmt.Sprintf("cropdetect=limit=%d:round=2:skip=0:reset=0", cropLimit)
+	if bg := opts.Background.ffmpegFilter(); bg != "" {
+		filter = bg + "," + filter
+	}
+	filter = "fps=12," + filter
+
+	var errbuf bytes.Buffer
+
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-i", name, "-vf", filter, "-f", "null", "-")
+	cmd.Stderr = &errbuf
+
+	if err := cmd.Run(); err != nil {
+		return image.Rectangle{}, errors.Wrapf(err, "running cropdetect (stderr: %s)", errbuf.String())
+	}
+
+	// With reset=0 every line covers all the frames before it, so the last one covers the whole video
+	matches := cropPattern.FindAllSubmatch(errbuf.Bytes(), -1)
+	if len(matches) == 0 {
+		return image.Rectangle{}, nil
+	}
+
+	var n [4]int
+	for i, m := range matches[len(matches)-1][1:] {
+		n[i], _ = strconv.Atoi(string(m)) // The pattern only matches digits
+	}
+	return image.Rect(n[2], n[3], n[2]+n[0], n[3]+n[1]), nil
+}
+
+// Returns the ffmpeg filter that crops every frame to the rectangle, or an empty string if it is empty.
+func cropFilter(r image.Rectangle) string {
+	if r.Empty() {
+		return ""
+	}
+	return fmt.Sprintf("crop=%d:%d:%d:%d", r.Dx(), r.Dy(), r.Min.X, r.Min.Y)
+}
@@ -0,0 +1,618 @@
+package imghash
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// The number of keypoints detected in each image when Options.Features doesn't say otherwise.
+const DefaultFeatures = 500
+
+const (
+	// Images are scaled down so their longest side is at most this many pixels before keypoints are detected.
+	featureWorkSize = 640
+
+	// The pyramid of scales keypoints are detected at, so a crop blown up to fill the frame still matches its source.
+	featureLevels     = 6
+	featureLevelScale = 1.2
+
+	// How much brighter or darker than the centre 9 contiguous pixels of the FAST circle must be to make a corner.
+	fastThreshold = 20
+
+	// BRIEF samples pairs of pixels within this radius of a keypoint, and orientations are measured within patchRadius.
+	briefRadius = 13
+	patchRadius = 15
+
+	// Keypoints closer than this to the edge are skipped, so every rotation of the sampling pattern stays inside.
+	featureBorder = 20
+
+	// Orientations are rounded to one of this many angles, each with its own rotated copy of the BRIEF pattern.
+	briefAngles = 30
+
+	// The most bits two descriptors can differ by and still match, and how much better than the runner up the best
+	// match must be.
+	maxDescriptorDistance = 64
+	descriptorRatio       = 0.8
+
+	// The number of random pairs of matches geometric verification tries, and how far from its predicted position a
+	// match can be, as a fraction of the candidate's diagonal, while still agreeing with the transform.
+	ransacIterations = 500
+	ransacTolerance  = 0.015
+
+	// How far apart the scale and rotation of a match's keypoints can be from the transform's, as a natural log and
+	// in radians. Keypoints are only found at the scales of the pyramid, so the scale can be off by most of a level.
+	ransacScaleError = 0.6
+	ransacAngleError = math.Pi / 6
+)
+
+// A 256 bit rotated BRIEF descriptor, whose bits each compare the brightness of two pixels around a keypoint.
+type Descriptor [4]uint64
+
+// Returns the number of bits that differ between two descriptors.
+func (d *Descriptor) Distance(o *Descriptor) int {
+	return bits.OnesCount64(d[0]^o[0]) + bits.OnesCount64(d[1]^o[1]) + bits.OnesCount64(d[2]^o[2]) + bits.OnesCount64(d[3]^o[3])
+}
+
+// A corner found by the FAST detector, positioned in the pixels of the original image.
+type Keypoint struct {
+	X, Y float32
+
+	// The size of a pyramid pixel in original pixels at the level the keypoint was found at.
+	Scale float32
+
+	// The direction from the keypoint to the centroid of the brightness around it, in radians.
+	Angle float32
+
+	Descriptor Descriptor
+}
+
+// The local features of an image, which still match when only a small part of the image is left, see MatchFeatures.
+type Features struct {
+	// The area of the original image that was searched for keypoints, which excludes any borders that were cropped off.
+	Bounds image.Rectangle
+
+	Keypoints []Keypoint
+}
+
+// How the local features of a query lined up with a candidate's.
+type FeatureMatch struct {
+	// The number of descriptors that matched, and how many of those agree on where the query lies in the candidate.
+	Matches, Inliers int
+
+	// The similarity transform that maps the query onto the candidate, as a complex multiplier that scales and rotates
+	// followed by a translation. Both are zero if fewer than two matches agree.
+	Transform, Offset complex128
+
+	// The query's bounds mapped onto the candidate and clipped to its bounds, which is where a crop was taken from.
+	Region image.Rectangle
+}
+
+// Returns how much larger the query is in the candidate than in itself.
+func (m FeatureMatch) Scale() float64 {
+	return cmplx.Abs(m.Transform)
+}
+
+// Returns how far the query was rotated anticlockwise to line up with the candidate, in radians.
+func (m FeatureMatch) Angle() float64 {
+	return cmplx.Phase(m.Transform)
+}
+
+// Returns the value of a splitmix64 generator and its next state. It's used rather than math/rand so the BRIEF pattern,
+// and with it every stored descriptor, doesn't depend on the standard library's generator.
+func splitmix64(state uint64) (uint64, uint64) {
+	state += 0x9e3779b97f4a7c15
+	z := state
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31, state
+}
+
+// The pairs of points each descriptor bit compares, as x1, y1, x2, y2, drawn from a gaussian around the keypoint like
+// BRIEF's second sampling strategy. Each angle has its own rotated copy.
+var briefPattern = func() (pattern [briefAngles][256][4]int) {
+	var base [256][4]float64
+
+	state := uint64(0x6272696566) // "brief"
+	for i := range base {
+		for j := 0; j < 4; j += 2 {
+			var a, b uint64
+			a, state = splitmix64(state)
+			b, state = splitmix64(state)
+
+			// Box-Muller, with u1 kept away from 0
+			u1, u2 := (float64(a>>11)+1)/(1<<53+1), float64(b>>11)/(1<<53)
+			r := math.Sqrt(-2*math.Log(u1)) * 2 * patchRadius / 5
+			base[i][j] = math.Max(-briefRadius, math.Min(briefRadius, math.Round(r*math.Cos(2*math.Pi*u2))))
+			base[i][j+1] = math.Max(-briefRadius, math.Min(briefRadius, math.Round(r*math.Sin(2*math.Pi*u2))))
+		}
+	}
+
+	for a := range pattern {
+		sin, cos := math.Sincos(2 * math.Pi * float64(a) / briefAngles)
+		for i, p := range base {
+			for j := 0; j < 4; j += 2 {
+				pattern[a][i][j] = int(math.Round(p[j]*cos - p[j+1]*sin))
+				pattern[a][i][j+1] = int(math.Round(p[j]*sin + p[j+1]*cos))
+			}
+		}
+	}
+	return
+}()
+
+// The offsets of the 16 pixel Bresenham circle of radius 3 FAST tests, clockwise from the top.
+var fastCircle = [16][2]int{
+	{0, -3}, {1, -3}, {2, -2}, {3, -1}, {3, 0}, {3, 1}, {2, 2}, {1, 3},
+	{0, 3}, {-1, 3}, {-2, 2}, {-3, 1}, {-3, 0}, {-3, -1}, {-2, -2}, {-1, -3},
+}
+
+// A single level of the image pyramid, as luma.
+type featureLevel struct {
+	pix  []uint8
+	w, h int
+}
+
+// Returns the FAST-9 score of a pixel, or 0 if it isn't a corner. A corner has 9 contiguous pixels on the circle that are
+// all brighter or all darker than the centre by more than the threshold, and scores by how far past it they all are.
+func (l *featureLevel) fastScore(x, y int, circle *[16]int) int {
+	i := y*l.w + x
+	p := int(l.pix[i])
+
+	// Any 9 contiguous pixels include at least two of the four at the compass points
+	var brighter, darker int
+	for k := 0; k < 16; k += 4 {
+		if v := int(l.pix[i+circle[k]]); v > p+fastThreshold {
+			brighter++
+		} else if v < p-fastThreshold {
+			darker++
+		}
+	}
+	if brighter < 2 && darker < 2 {
+		return 0
+	}
+
+	var sign [16]int
+	var bright, dark int
+	for k := range circle {
+		if v := int(l.pix[i+circle[k]]); v > p+fastThreshold {
+			sign[k] = 1
+			bright += v - p - fastThreshold
+		} else if v < p-fastThreshold {
+			sign[k] = -1
+			dark += p - v - fastThreshold
+		}
+	}
+
+	for _, s := range []int{1, -1} {
+		run := 0
+		for k := 0; k < 16+8; k++ {
+			if sign[k%16] != s {
+				run = 0
+			} else if run++; run >= 9 {
+				if s == 1 {
+					return bright
+				}
+				return dark
+			}
+		}
+	}
+	return 0
+}
+
+// Returns the Harris corner response over the 7x7 block around a pixel, which ranks corners far more reliably than
+// the FAST score does.
+func (l *featureLevel) harris(x, y int) float64 {
+	var a, b, c float64
+	for dy := -3; dy <= 3; dy++ {
+		for dx := -3; dx <= 3; dx++ {
+			i := (y+dy)*l.w + x + dx
+			at := func(o int) float64 { return float64(l.pix[i+o]) }
+
+			w := l.w
+			ix := (at(-w+1) + 2*at(1) + at(w+1)) - (at(-w-1) + 2*at(-1) + at(w-1))
+			iy := (at(w-1) + 2*at(w) + at(w+1)) - (at(-w-1) + 2*at(-w) + at(-w+1))
+			a, b, c = a+ix*ix, b+iy*iy, c+ix*iy
+		}
+	}
+	return a*b - c*c - 0.04*(a+b)*(a+b)
+}
+
+// Returns the angle from a pixel to the intensity centroid of the circle around it.
+func (l *featureLevel) orientation(x, y int) float64 {
+	var m10, m01 float64
+	for dy := -patchRadius; dy <= patchRadius; dy++ {
+		for dx := -patchRadius; dx <= patchRadius; dx++ {
+			if dx*dx+dy*dy > patchRadius*patchRadius {
+				continue
+			}
+			v := float64(l.pix[(y+dy)*l.w+x+dx])
+			m10, m01 = m10+float64(dx)*v, m01+float64(dy)*v
+		}
+	}
+	return math.Atan2(m01, m10)
+}
+
+// Returns a copy of the level smoothed by a 5x5 binomial kernel, so BRIEF's single pixel tests aren't thrown by noise.
+func (l *featureLevel) blur() *featureLevel {
+	kernel := [5]int{1, 4, 6, 4, 1}
+	clamp := func(v, n int) int {
+		if v < 0 {
+			return 0
+		} else if v >= n {
+			return n - 1
+		}
+		return v
+	}
+
+	tmp := make([]int, len(l.pix))
+	for y := 0; y < l.h; y++ {
+		for x := 0; x < l.w; x++ {
+			var sum int
+			for k, c := range kernel {
+				sum += c * int(l.pix[y*l.w+clamp(x+k-2, l.w)])
+			}
+			tmp[y*l.w+x] = sum
+		}
+	}
+
+	out := &featureLevel{pix: make([]uint8, len(l.pix)), w: l.w, h: l.h}
+	for y := 0; y < l.h; y++ {
+		for x := 0; x < l.w; x++ {
+			var sum int
+			for k, c := range kernel {
+				sum += c * tmp[clamp(y+k-2, l.h)*l.w+x]
+			}
+			out.pix[y*l.w+x] = uint8((sum + 128) >> 8)
+		}
+	}
+	return out
+}
+
+// Returns the rotated BRIEF descriptor of a pixel of a blurred level.
+func (l *featureLevel) describe(x, y int, angle float64) (d Descriptor) {
+	a := int(math.Round(angle/(2*math.Pi)*briefAngles)) % briefAngles
+	if a < 0 {
+		a += briefAngles
+	}
+
+	i := y*l.w + x
+	for b, p := range &briefPattern[a] {
+		if l.pix[i+p[1]*l.w+p[0]] < l.pix[i+p[3]*l.w+p[2]] {
+			d[b/64] |= 1 << uint(b%64)
+		}
+	}
+	return
+}
+
+// DetectFeatures finds up to max oriented FAST keypoints in an image, strongest first, and describes each with a
+// rotated BRIEF descriptor, much like ORB. Keypoints are detected at several scales, so they still match a crop that has
+// been enlarged. Images too small to hold a single keypoint have none.
+func DetectFeatures(img image.Image, max int) (*Features, error) {
+	b := img.Bounds()
+	f := &Features{Bounds: b}
+	if max <= 0 || b.Dx() < 2*featureBorder+1 || b.Dy() < 2*featureBorder+1 {
+		return f, nil
+	}
+
+	// Every level is scaled from the same working copy, since scaling a large image six times over is slow
+	ratio := 1.0
+	work := toNRGBA(img)
+	if long := math.Max(float64(b.Dx()), float64(b.Dy())); long > featureWorkSize {
+		ratio = featureWorkSize / long
+
+		var err error
+		work, err = Resize(img, int(math.Round(float64(b.Dx())*ratio)), int(math.Round(float64(b.Dy())*ratio)), FilterArea)
+		if err != nil {
+			return nil, errors.Wrap(err, "scaling image")
+		}
+	}
+
+	// Each level is given a share of the keypoints in proportion to its area, the same way ORB splits them
+	factor := 1 / (featureLevelScale * featureLevelScale)
+	share := float64(max) * (1 - factor) / (1 - math.Pow(factor, featureLevels))
+
+	var keypoints []Keypoint
+	for level := 0; level < featureLevels; level++ {
+		scale := ratio / math.Pow(featureLevelScale, float64(level))
+		w, h := int(math.Round(float64(b.Dx())*scale)), int(math.Round(float64(b.Dy())*scale))
+		if w < 2*featureBorder+1 || h < 2*featureBorder+1 {
+			break
+		}
+
+		quota := int(math.Round(share * math.Pow(factor, float64(level))))
+		if level == featureLevels-1 || quota > max-len(keypoints) {
+			quota = max - len(keypoints)
+		}
+		if quota <= 0 {
+			continue
+		}
+
+		found, err := detectLevel(work, w, h, quota)
+		if err != nil {
+			return nil, errors.Wrapf(err, "pyramid level %d", level)
+		}
+
+		// Positions are converted from the centres of the level's pixels to the original image
+		sx, sy := float64(b.Dx())/float64(w), float64(b.Dy())/float64(h)
+		for _, k := range found {
+			k.X = float32((float64(k.X)+0.5)*sx) + float32(b.Min.X)
+			k.Y = float32((float64(k.Y)+0.5)*sy) + float32(b.Min.Y)
+			k.Scale = float32(sx)
+			keypoints = append(keypoints, k)
+		}
+	}
+
+	f.Keypoints = keypoints
+	return f, nil
+}
+
+// Detects up to quota keypoints in an image scaled to w*h, with their positions in the pixels of that scale.
+func detectLevel(img *image.NRGBA, w, h, quota int) ([]Keypoint, error) {
+	scaled, err := resizeImage(img, w, h, FilterArea)
+	if err != nil {
+		return nil, err
+	}
+
+	level := &featureLevel{pix: luminance(scaled), w: w, h: h}
+
+	var circle [16]int
+	for k, o := range fastCircle {
+		circle[k] = o[1]*w + o[0]
+	}
+
+	scores := make([]int, w*h)
+	for y := featureBorder; y < h-featureBorder; y++ {
+		for x := featureBorder; x < w-featureBorder; x++ {
+			scores[y*w+x] = level.fastScore(x, y, &circle)
+		}
+	}
+
+	type candidate struct {
+		x, y     int
+		response float64
+	}
+
+	// Only corners that score higher than all 8 of their neighbours are kept
+	var candidates []candidate
+	for y := featureBorder; y < h-featureBorder; y++ {
+	next:
+		for x := featureBorder; x < w-featureBorder; x++ {
+			s := scores[y*w+x]
+			if s == 0 {
+				continue
+			}
+
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if n := scores[(y+dy)*w+x+dx]; (dx != 0 || dy != 0) && (n > s || n == s && dy*w+dx < 0) {
+						continue next
+					}
+				}
+			}
+			candidates = append(candidates, candidate{x, y, level.harris(x, y)})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].response > candidates[j].response })
+	if len(candidates) > quota {
+		candidates = candidates[:quota]
+	}
+
+	blurred := level.blur()
+	keypoints := make([]Keypoint, len(candidates))
+	for i, c := range candidates {
+		angle := level.orientation(c.x, c.y)
+		keypoints[i] = Keypoint{X: float32(c.x), Y: float32(c.y), Angle: float32(angle), Descriptor: blurred.describe(c.x, c.y, angle)}
+	}
+	return keypoints, nil
+}
+
+// MatchFeatures matches the keypoints of a query against a candidate's and checks that the matches agree on a single
+// placement of the query within the candidate, allowing any scale, rotation and translation. A query that was cropped
+// out of the candidate usually keeps at least a dozen inliers, while unrelated images rarely get more than a few. The
+// result is deterministic for the same features.
+func MatchFeatures(query, candidate *Features) FeatureMatch {
+	if query == nil || candidate == nil || len(candidate.Keypoints) == 0 {
+		return FeatureMatch{}
+	}
+	return newFeatureColumns([]*Hash{{Features: candidate}}).match(query)[0]
+}
+
+// The query and candidate keypoints paired by their descriptors, with the position of each in its own image and the
+// scale and rotation between them.
+type featurePairs struct {
+	src, dst, turn []complex128
+}
+
+// Pairs a query keypoint with the nearest of the candidate's keypoints, given the distance from its descriptor to each
+// of theirs, if it is clearly closer than the next.
+func (p *featurePairs) add(q *Keypoint, candidate []Keypoint, dist []int32) {
+	best, second, index := math.MaxInt32, math.MaxInt32, -1
+	for j, d := range dist {
+		if d := int(d); d < best {
+			best, second, index = d, best, j
+		} else if d < second {
+			second = d
+		}
+	}
+
+	if best <= maxDescriptorDistance && float64(best) < descriptorRatio*float64(second) {
+		c := &candidate[index]
+		p.src = append(p.src, complex(float64(q.X), float64(q.Y)))
+		p.dst = append(p.dst, complex(float64(c.X), float64(c.Y)))
+		p.turn = append(p.turn, cmplx.Rect(float64(c.Scale/q.Scale), float64(c.Angle-q.Angle)))
+	}
+}
+
+// The descriptors of many hashes' features laid out in columns, so each query keypoint is compared against all of them
+// in a single pass. The keypoints of hash k are those from starts[k] up to starts[k+1]. A tree lays out its hashes once
+// when it's built.
+type featureColumns struct {
+	hashes      []*Hash
+	starts      []int
+	descriptors *columns
+}
+
+// Lays out the descriptors of every hash, which must all have features with keypoints.
+func newFeatureColumns(hashes []*Hash) *featureColumns {
+	starts := make([]int, len(hashes)+1)
+	for k, h := range hashes {
+		starts[k+1] = starts[k] + len(h.Features.Keypoints)
+	}
+
+	descriptors := newColumns(len(Descriptor{}), starts[len(hashes)])
+	for _, h := range hashes {
+		for j := range h.Features.Keypoints {
+			descriptors.add(h.Features.Keypoints[j].Descriptor[:])
+		}
+	}
+	return &featureColumns{hashes: hashes, starts: starts, descriptors: descriptors}
+}
+
+// Matches the query against the features of every hash, returning a match for each in order. The ratio test still
+// needs the nearest and second nearest within each hash, so the distances are split back up by hash before pairing.
+func (fc *featureColumns) match(query *Features) []FeatureMatch {
+	pairs := make([]featurePairs, len(fc.hashes))
+	var dist []int32
+	for i := range query.Keypoints {
+		q := &query.Keypoints[i]
+		dist = fc.descriptors.distances(q.Descriptor[:], dist)
+		for k, h := range fc.hashes {
+			pairs[k].add(q, h.Features.Keypoints, dist[fc.starts[k]:fc.starts[k+1]])
+		}
+	}
+
+	matches := make([]FeatureMatch, len(fc.hashes))
+	for k, h := range fc.hashes {
+		matches[k] = pairs[k].place(query, h.Features)
+	}
+	return matches
+}
+
+// Checks that the paired keypoints agree on a single placement of the query within the candidate.
+func (p *featurePairs) place(query, candidate *Features) FeatureMatch {
+	var m FeatureMatch
+	src, dst, turn := p.src, p.dst, p.turn
+	m.Matches = len(src)
+	if len(src) < 2 {
+		return m
+	}
+
+	cb := candidate.Bounds
+	tolerance := ransacTolerance * math.Hypot(float64(cb.Dx()), float64(cb.Dy()))
+	// Matches only agree with a transform if they land close enough to where it puts them, and if their keypoints were
+	// scaled and rotated by about as much, which weeds out the many chance alignments between similar corners
+	inliers := func(z, t complex128, keep []int) []int {
+		keep = keep[:0]
+		for i := range src {
+			r := turn[i] / z
+			if math.Abs(math.Log(cmplx.Abs(r))) > ransacScaleError || math.Abs(cmplx.Phase(r)) > ransacAngleError {
+				continue
+			}
+
+			if cmplx.Abs(z*src[i]+t-dst[i]) <= tolerance {
+				keep = append(keep, i)
+			}
+		}
+		return keep
+	}
+
+	// A similarity transform is fixed by two matches, so random pairs are tried and the one most matches agree with wins
+	var best, work []int
+	state := uint64(len(src))
+	for iter := 0; iter < ransacIterations; iter++ {
+		var r uint64
+		r, state = splitmix64(state)
+		i, j := int(r%uint64(len(src))), int((r>>32)%uint64(len(src)))
+		if i == j || cmplx.Abs(src[j]-src[i]) < 1 {
+			continue
+		}
+
+		z := (dst[j] - dst[i]) / (src[j] - src[i])
+		if s := cmplx.Abs(z); s < 1.0/8 || s > 8 {
+			continue
+		}
+
+		if work = inliers(z, dst[i]-z*src[i], work); len(work) > len(best) {
+			best, work = work, best
+		}
+	}
+
+	if len(best) < 2 {
+		return m
+	}
+
+	// The transform is refitted to every inlier by least squares, which settles on a few more of them
+	z, t := fitSimilarity(src, dst, best)
+	if refit := inliers(z, t, nil); len(refit) >= len(best) {
+		best = refit
+		z, t = fitSimilarity(src, dst, best)
+	}
+
+	m.Inliers = len(best)
+	m.Transform, m.Offset = z, t
+
+	qb := query.Bounds
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range []image.Point{qb.Min, {qb.Max.X, qb.Min.Y}, {qb.Min.X, qb.Max.Y}, qb.Max} {
+		c := z*complex(float64(p.X), float64(p.Y)) + t
+		minX, minY = math.Min(minX, real(c)), math.Min(minY, imag(c))
+		maxX, maxY = math.Max(maxX, real(c)), math.Max(maxY, imag(c))
+	}
+	m.Region = image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY))).Intersect(cb)
+	return m
+}
+
+// Fits the similarity transform z*p+t that maps the chosen points of src closest to dst by least squares.
+func fitSimilarity(src, dst []complex128, chosen []int) (z, t complex128) {
+	var sc, dc complex128
+	for _, i := range chosen {
+		sc, dc = sc+src[i], dc+dst[i]
+	}
+	n := complex(float64(len(chosen)), 0)
+	sc, dc = sc/n, dc/n
+
+	var num complex128
+	var den float64
+	for _, i := range chosen {
+		s, d := src[i]-sc, dst[i]-dc
+		num += cmplx.Conj(s) * d
+		den += real(s)*real(s) + imag(s)*imag(s)
+	}
+
+	if den == 0 {
+		return 1, dc - sc
+	}
+	z = num / complex(den, 0)
+	return z, dc - z*sc
+}
+
+// NearestFeatures matches the features of e against every entry in the tree that has them, returning those with at least
+// minInliers matches that agree on where e lies in them, most inliers first. Dist is the distance between the global
+// hashes, which is usually large for a heavy crop. Every entry is matched, so this is far slower than the other
+// searches and is best kept for queries they can't find.
+func (t *Tree) NearestFeatures(e *Hash, minInliers int) Queue {
+	var q Queue
+	if e.Features == nil {
+		return q
+	}
+
+	for i, m := range t.features.match(e.Features) {
+		if m.Inliers > 0 && m.Inliers >= minInliers {
+			h := t.features.hashes[i]
+			q = append(q, heapItem{Item: h, Dist: t.metric.Distance(e, h), Features: m})
+		}
+	}
+
+	sort.SliceStable(q, func(i, j int) bool {
+		if q[i].Features.Inliers != q[j].Features.Inliers {
+			return q[i].Features.Inliers > q[j].Features.Inliers
+		}
+		return q[i].Dist < q[j].Dist
+	})
+	return q
+}
@@ -0,0 +1,192 @@
+package imghash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns an image of overlapping random rectangles over smooth blobs, both drawn from rng, which is full of corners to
+// detect.
+func cornerImage(t *testing.T, rng *rand.Rand, w, h int) *image.NRGBA {
+	t.Helper()
+
+	img := blobImage(t, rng, 12, w, h)
+	for i := 0; i < w*h/800; i++ {
+		x, y := rng.Intn(w), rng.Intn(h)
+		r := image.Rect(x, y, x+4+rng.Intn(w/8), y+4+rng.Intn(h/8))
+		c := color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff}
+		draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	return img
+}
+
+// A crop of 30% of the image, enlarged to fill the frame, must still be found and placed where it was cut from.
+func TestMatchFeaturesCrop(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	img := cornerImage(t, rng, 800, 600)
+	crop := image.Rect(310, 140, 310+438, 140+329)
+
+	query, err := Resize(img.SubImage(crop), 800, 600, FilterBilinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig, err := DetectFeatures(img, DefaultFeatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feat, err := DetectFeatures(query, DefaultFeatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orig.Keypoints) < DefaultFeatures/2 || len(orig.Keypoints) > DefaultFeatures {
+		t.Fatalf("detected %d keypoints, want around %d", len(orig.Keypoints), DefaultFeatures)
+	}
+
+	m := MatchFeatures(feat, orig)
+	if m.Inliers < 20 {
+		t.Fatalf("only %d of %d matches agree", m.Inliers, m.Matches)
+	}
+
+	if s := m.Scale(); s < 0.5 || s > 0.6 {
+		t.Errorf("crop was matched at a scale of %f, want %f", s, 438.0/800)
+	}
+
+	for _, d := range []int{m.Region.Min.X - crop.Min.X, m.Region.Min.Y - crop.Min.Y, m.Region.Max.X - crop.Max.X, m.Region.Max.Y - crop.Max.Y} {
+		if d < -8 || d > 8 {
+			t.Errorf("crop was placed at %v, want %v", m.Region, crop)
+			break
+		}
+	}
+
+	// Turning the crop on its side only changes the angle it's matched at
+	rotated := image.NewNRGBA(image.Rect(0, 0, 600, 800))
+	for y := 0; y < 600; y++ {
+		for x := 0; x < 800; x++ {
+			rotated.SetNRGBA(599-y, x, query.NRGBAAt(x, y))
+		}
+	}
+
+	feat90, err := DetectFeatures(rotated, DefaultFeatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := MatchFeatures(feat90, orig); m.Inliers < 20 || math.Abs(math.Abs(m.Angle())-math.Pi/2) > 0.05 {
+		t.Errorf("rotated crop matched with %d inliers at %f radians", m.Inliers, m.Angle())
+	}
+
+	other, err := DetectFeatures(cornerImage(t, rng, 800, 600), DefaultFeatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := MatchFeatures(feat, other); m.Inliers >= 10 {
+		t.Errorf("an unrelated image has %d inliers", m.Inliers)
+	}
+}
+
+// Features are stored in their own section, and the tree finds the original of a crop by them.
+func TestFileFeatures(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var hashes []Hash
+	images := []*image.NRGBA{cornerImage(t, rng, 640, 480), cornerImage(t, rng, 640, 480), cornerImage(t, rng, 500, 500)}
+	for i, img := range images {
+		h, err := HashImageWithOptions(img, Options{Filter: FilterBilinear, Features: 300})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.Index = uint32(i + 1)
+		hashes = append(hashes, h)
+	}
+	hashes = append(hashes, randomHash(1, 1, 4))
+
+	f := NewFile()
+	f.features = 300
+	f.hashes = hashes
+
+	loaded := roundTrip(t, f)
+	if loaded.Features() != 300 || loaded.Options().Features != 300 {
+		t.Errorf("file recorded %d features", loaded.Features())
+	}
+
+	for i, h := range loaded.hashes {
+		if want := hashes[i].Features; want == nil {
+			if h.Features != nil {
+				t.Errorf("hash %d gained features", i)
+			}
+		} else if h.Features == nil || h.Features.Bounds != want.Bounds || len(h.Features.Keypoints) != len(want.Keypoints) {
+			t.Fatalf("hash %d features didn't survive a round trip", i)
+		} else {
+			for j := range want.Keypoints {
+				if h.Features.Keypoints[j] != want.Keypoints[j] {
+					t.Fatalf("hash %d keypoint %d is %+v, want %+v", i, j, h.Features.Keypoints[j], want.Keypoints[j])
+				}
+			}
+		}
+	}
+
+	crop := image.Rect(200, 100, 550, 360)
+	query, err := HashImageWithOptions(images[1].SubImage(crop), Options{Filter: FilterBilinear, Features: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := NewTreeFromFiles(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := tree.NearestFeatures(&query, 10)
+	if len(q) != 1 || q[0].Item.Index != 2 {
+		t.Fatalf("crop matched %+v", q)
+	}
+	if m := MatchFeatures(query.Features, loaded.hashes[1].Features); q[0].Features != m {
+		t.Errorf("tree matched %+v, MatchFeatures matched %+v", q[0].Features, m)
+	}
+	if r := q[0].Features.Region; !r.In(crop.Inset(-8)) || !crop.Inset(8).In(r) {
+		t.Errorf("crop was placed at %v, want %v", r, crop)
+	}
+
+	v1 := NewFileWithVersion(fileVersion1)
+	v1.hashes = hashes[:1]
+	if err := v1.Write(filepath.Join(t.TempDir(), "v1")); err == nil {
+		t.Error("wrote features to a version 1 file")
+	}
+}
+
+// Anything ffmpeg scales has no features, so asking for them must fail rather than leave some hashes without any.
+func TestFeaturesFFmpeg(t *testing.T) {
+	opts := Options{Features: 300, Filter: FilterFFmpeg}
+	if _, err := NewFromPathWithOptions(writePNG(t, cornerImage(t, rand.New(rand.NewSource(1)), 64, 64)), opts); err == nil || !strings.Contains(err.Error(), "features") {
+		t.Errorf("detected features in an image scaled by ffmpeg: %v", err)
+	}
+
+	// Neither of these are ever handed to ffmpeg, since the features are checked for first
+	opts.Filter = FilterBilinear
+	dir := t.TempDir()
+	for _, name := range []string{"video.mp4", "undecodable.png"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("not an image"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewFromPathWithOptions(path, opts); err == nil || !strings.Contains(err.Error(), "features") {
+			t.Errorf("detected features in %s: %v", name, err)
+		}
+	}
+
+	if _, err := NewFromPathWithOptions(dir, opts); err == nil {
+		t.Error("detected features in a directory holding a video")
+	}
+}
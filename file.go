@@ -2,6 +2,7 @@ package imghash
 
 import (
 	"encoding/binary"
+	"image"
 	"io"
 	"math"
 	"os"
@@ -17,26 +18,211 @@ const (
 	size32
 )
 
-// TODO: Consider adding an array of strings at the beginning that has path names, and give each hash a frame index and path index
+// Version 2 files follow the fixed header with a block of sections, each made up of a 1 byte tag,
+// a 4 byte length and the section data. Unknown tags are skipped so older readers can still load newer files.
+const (
+	sectionHasher      byte = iota + 1 // The name of the hasher used to create every hash in the file
+	sectionLayout                      // The number of 64 bit words in each plane of a hash, as uint16s in the order of Hash.planes
+	sectionFilter                      // The filter images were scaled with, as a single byte
+	sectionBackground                  // The background transparent images were composited over, see Background.marshal
+	sectionSources                     // Every source the hashes came from, followed by the source index of each hash
+	sectionMask                        // The threshold the masks of each hash were created with, as a single byte
+	sectionTiles                       // The size of the grid of tiles in each hash, as a single byte
+	sectionPreprocess                  // The preprocessing steps every image was put through before it was hashed
+	sectionFeatures                    // The keypoints of every hash that has them, see File.marshalFeatures
+	sectionClips                       // The temporal signatures of every clip of consecutive frames, see File.marshalClips
+	sectionInformation                 // What is done with low information frames and the score of every hash, see File.marshalInformation
+)
+
+// The layout of every hash in version 1 files, and version 2 files without a layout section.
+var defaultLayout = []int{1, 1}
+
+const (
+	fileVersion1 byte = iota + 1
+	fileVersion2
+
+	latestVersion = fileVersion2
+)
+
+// A single image or video that hashes in a file were created from.
+type Source struct {
+	// The path of the source, relative to the directory the file was created from.
+	Path string
+
+	// The area of the source that was hashed if black bars were cropped off, or empty if it wasn't cropped.
+	Crop image.Rectangle
+}
+
 type File struct {
 	version byte
 	_       [4]byte // Future additions may require more things to be added, better to put in a few extra bytes here to future-proof
 	maxSize byte
 	hashes  []Hash
+	hasher  string
+	filter  Filter
 	path    string
+
+	background    Background
+	sources       []Source
+	maskThreshold uint8
+	tiles         int
+	preprocess    Preprocess
+	features      int
+	clips         []Hash
+	clipFrames    int
+
+	information    InformationMode
+	minInformation uint8
 }
 
 // Creates a new file with the default file version
 func NewFile() *File {
-	return &File{version: 1, maxSize: size32}
+	return NewFileWithVersion(latestVersion)
 }
 
-// Creates a new file with the provided version. Currently only "1" exists as a valid option
+// Creates a new file with the provided version. Currently "1" and "2" exist as valid options, anything else uses the latest version
 func NewFileWithVersion(version byte) *File {
-	if version != 1 {
-		version = 1
+	if version < fileVersion1 || version > latestVersion {
+		version = latestVersion
 	}
-	return &File{version: version, maxSize: size32}
+	return &File{version: version, maxSize: size32, hasher: DefaultHasher}
+}
+
+// Creates a new file with the default file version whose hashes were created by the named hasher
+func NewFileWithHasher(name string) *File {
+	f := NewFile()
+	f.hasher = name
+	return f
+}
+
+// Returns the name of the hasher used to create the hashes in the file
+func (f *File) Hasher() string {
+	return f.hasher
+}
+
+// Returns the threshold used to mark unstable bits in the masks of each hash, or 0 if the hashes have no masks.
+func (f *File) MaskThreshold() uint8 {
+	return f.maskThreshold
+}
+
+// Returns the size of the grid of tiles in each hash, or 0 if the hashes have no tiles.
+func (f *File) Tiles() int {
+	return f.tiles
+}
+
+// Returns the most keypoints detected in each image, or 0 if the hashes have no features.
+func (f *File) Features() int {
+	return f.features
+}
+
+// Returns the temporal signature of every clip of consecutive frames in the file's videos, each held in the VHash of a
+// Hash whose Index is the clip's first frame, see ClipSignatures.
+func (f *File) Clips() []Hash {
+	return f.clips
+}
+
+// Returns the number of frames each clip covers, or 0 if the file has no clips.
+func (f *File) ClipFrames() int {
+	return f.clipFrames
+}
+
+// Returns what was done with frames whose information score is below MinInformation when the file was created.
+func (f *File) InformationMode() InformationMode {
+	return f.information
+}
+
+// Returns the score frames needed to not be low information, or 0 if they were ignored.
+func (f *File) MinInformation() uint8 {
+	return f.minInformation
+}
+
+// Returns the index of every hash flagged as low information, which is none unless the file was created with
+// InformationFlag or InformationDownWeight.
+func (f *File) LowInformation() []uint32 {
+	if f.information != InformationFlag && f.information != InformationDownWeight {
+		return nil
+	}
+
+	var low []uint32
+	for i := range f.hashes {
+		if f.hashes[i].Information < f.minInformation {
+			low = append(low, f.hashes[i].Index)
+		}
+	}
+	return low
+}
+
+// Returns the preprocessing steps every image was put through before it was hashed.
+func (f *File) Preprocess() Preprocess {
+	return f.preprocess
+}
+
+// Returns the options a query has to be hashed with to be compared against the file's hashes, as far as the file
+// records them. Options that only change what is hashed rather than how, such as AutoCrop, are left unset.
+func (f *File) Options() Options {
+	opts := Options{
+		Hasher:         f.hasher,
+		Filter:         f.Filter(),
+		Background:     f.background,
+		MaskThreshold:  f.maskThreshold,
+		Tiles:          f.tiles,
+		Preprocess:     f.preprocess,
+		Features:       f.features,
+		ClipFrames:     f.clipFrames,
+		Information:    f.information,
+		MinInformation: f.minInformation,
+	}
+	if len(f.hashes) > 0 {
+		opts.Colour = len(f.hashes[0].CbHash) > 0
+		opts.Diagonal = len(f.hashes[0].DiagHash) > 0
+	}
+	return opts
+}
+
+// Returns an error if the hashes in the two files were created differently enough that they can't be compared, naming
+// the first option that differs. Colour and diagonal hashes are only compared when both files have hashes to tell.
+func (f *File) comparable(o *File) error {
+	a, b := f.Options(), o.Options()
+	switch {
+	case a.Hasher != b.Hasher:
+		return errors.Errorf("cannot mix %q and %q hashes", a.Hasher, b.Hasher)
+	case a.Filter != b.Filter:
+		return errors.Errorf("cannot mix hashes scaled with the %s and %s filters", a.Filter, b.Filter)
+	case string(a.Background.marshal()) != string(b.Background.marshal()):
+		return errors.New("cannot mix hashes with different backgrounds")
+	case a.MaskThreshold != b.MaskThreshold:
+		return errors.Errorf("cannot mix hashes with mask thresholds of %d and %d", a.MaskThreshold, b.MaskThreshold)
+	case a.Tiles != b.Tiles:
+		return errors.Errorf("cannot mix hashes with %dx%d and %dx%d tiles", a.Tiles, a.Tiles, b.Tiles, b.Tiles)
+	case !a.Preprocess.equal(b.Preprocess):
+		return errors.New("cannot mix hashes with different preprocessing")
+	}
+
+	if len(f.hashes) > 0 && len(o.hashes) > 0 {
+		if a.Colour != b.Colour {
+			return errors.New("cannot mix colour and greyscale hashes")
+		} else if a.Diagonal != b.Diagonal {
+			return errors.New("cannot mix hashes with and without diagonal hashes")
+		}
+	}
+	return nil
+}
+
+// Returns every source the hashes in the file were created from, which Hash.Source indexes into.
+// Files written before sources were recorded have none.
+func (f *File) Sources() []Source {
+	return f.sources
+}
+
+// Returns the background transparent images were composited over before hashing them.
+func (f *File) Background() Background {
+	return f.background
+}
+
+// Returns the filter used to scale images before hashing them, which is FilterFFmpeg for version 1 files. Hashes of
+// images scaled with different filters won't line up as well, so queries should be scaled with the same one.
+func (f *File) Filter() Filter {
+	return f.filter
 }
 
 // Returns the length of the hash array, equivalent to len(*Hashes())
@@ -51,17 +237,78 @@ func (f *File) Hashes() *[]Hash {
 
 // O(n^2) deduplication of hashes
 func (f *File) Deduplicate() {
+	f.deduplicate(equalRule())
+}
+
+// Identical to Deduplicate, but treats hashes as duplicates if the metric puts them within maxDist of each other,
+// keeping the earliest. With a VerticalMetric or HorizontalMetric and a maxDist of 0, hashes only have to agree in
+// one direction to be duplicates.
+func (f *File) DeduplicateWithMetric(metric Metric, maxDist int) {
+	f.deduplicate(metricRule(metric, maxDist))
+}
+
+// How deduplicate and compare decide whether two hashes are the same. Rules that only sum hamming distances can check a
+// hash against every other at once with a HashList, anything else goes a pair at a time.
+type sameRule struct {
+	same func(h1, h2 *Hash) bool
+
+	// Set if same is a summed distance of at most maxDist, including colour if it's set
+	listed  bool
+	colour  bool
+	maxDist int
+}
+
+func equalRule() sameRule {
+	return sameRule{same: func(h1, h2 *Hash) bool { return h1.Equal(*h2) }, listed: true, colour: true}
+}
+
+func metricRule(metric Metric, maxDist int) sameRule {
+	_, sum := metric.(SumMetric)
+	return sameRule{same: func(h1, h2 *Hash) bool { return metric.Distance(h1, h2) <= maxDist }, listed: sum, maxDist: maxDist}
+}
+
+// Returns an empty list for the rule with room for every hash in the first set, or nil if the rule can't use one or the
+// hashes of every set don't all share a layout.
+func (r sameRule) list(sets ...[]Hash) *HashList {
+	if !r.listed || len(sets[0]) == 0 {
+		return nil
+	}
+
+	list := newHashList(&sets[0][0], len(sets[0]), r.colour)
+	for _, hashes := range sets {
+		for i := range hashes {
+			if list.layoutOf(&hashes[i]) != list.layout {
+				return nil
+			}
+		}
+	}
+	return list
+}
+
+func (f *File) deduplicate(rule sameRule) {
 	var ret []Hash
 
+	if list := rule.list(f.hashes); list != nil {
+		for i := range f.hashes {
+			if !list.any(&f.hashes[i], rule.maxDist) {
+				list.add(&f.hashes[i])
+				ret = append(ret, f.hashes[i])
+			}
+		}
+
+		f.hashes = ret
+		return
+	}
+
 outer:
-	for _, h1 := range f.hashes {
-		for _, h2 := range ret {
-			if h1.HHash == h2.HHash && h1.VHash == h2.VHash {
+	for i := range f.hashes {
+		for j := range ret {
+			if rule.same(&f.hashes[i], &ret[j]) {
 				continue outer
 			}
 		}
 
-		ret = append(ret, h1)
+		ret = append(ret, f.hashes[i])
 	}
 
 	f.hashes = ret
@@ -81,20 +328,104 @@ func (f *File) Write(path string) error {
 		f.maxSize = size08
 	} else if maxIndex <= math.MaxUint16 {
 		f.maxSize = size16
+	} else {
+		f.maxSize = size32
+	}
+
+	layout, err := f.layout()
+	if err != nil {
+		return err
+	}
+
+	var sections []byte
+	switch f.version {
+	case fileVersion1:
+		if f.hasher != DefaultHasher {
+			return errors.Errorf("version 1 files can only store %q hashes, not %q", DefaultHasher, f.hasher)
+		}
+
+		if f.filter != FilterFFmpeg {
+			return errors.Errorf("version 1 files can only store images scaled with the %s filter", FilterFFmpeg)
+		}
+
+		if f.background.Mode != BackgroundNone {
+			return errors.New("version 1 files can only store images hashed without a background")
+		}
+
+		if len(f.sources) > 1 {
+			return errors.New("version 1 files can't store more than one source")
+		}
+
+		if len(f.preprocess) > 0 {
+			return errors.New("version 1 files can only store images hashed without preprocessing")
+		}
+
+		if f.hasFeatures() {
+			return errors.New("version 1 files can't store features")
+		}
+
+		if f.clipFrames > 0 || len(f.clips) > 0 {
+			return errors.New("version 1 files can't store clips")
+		}
+
+		if f.information != InformationIgnore {
+			return errors.New("version 1 files can't flag low information frames")
+		}
+
+		for p, n := range layout {
+			if p >= len(defaultLayout) && n != 0 || p < len(defaultLayout) && n != defaultLayout[p] {
+				return errors.New("version 1 files can only store 64 bit vertical and horizontal hashes without masks")
+			}
+		}
+	default:
+		var words []byte
+		for _, n := range layout {
+			words = append(words, byte(n), byte(n>>8))
+		}
+
+		sections = appendSection(sections, sectionHasher, []byte(f.hasher))
+		sections = appendSection(sections, sectionLayout, words)
+		sections = appendSection(sections, sectionFilter, []byte{byte(f.Filter())})
+		sections = appendSection(sections, sectionBackground, f.background.marshal())
+		if len(f.sources) > 0 {
+			sections = appendSection(sections, sectionSources, f.marshalSources())
+		}
+		if f.maskThreshold > 0 {
+			sections = appendSection(sections, sectionMask, []byte{f.maskThreshold})
+		}
+		if f.tiles > 0 {
+			sections = appendSection(sections, sectionTiles, []byte{byte(f.tiles)})
+		}
+		if len(f.preprocess) > 0 {
+			sections = appendSection(sections, sectionPreprocess, f.preprocess.marshal())
+		}
+		if f.hasFeatures() {
+			sections = appendSection(sections, sectionFeatures, f.marshalFeatures())
+		}
+		if f.clipFrames > 0 || len(f.clips) > 0 {
+			sections = appendSection(sections, sectionClips, f.marshalClips())
+		}
+		if f.hasInformation() {
+			sections = appendSection(sections, sectionInformation, f.marshalInformation())
+		}
+		sections = append(putUint32(nil, uint32(len(sections))), sections...)
 	}
 
 	// I did this to save on the number of writes and error checking the default binary package does
 	// It's also necessary since variable index sizes are allowed
 	s := int(f.maxSize)
-	buf := make([]byte, 13+(8+8+s)*f.Length()) // 13 = 3 byte file header + version byte + size byte + 4 for useless + 4 for hash length
+	record := s + 8*layoutSize(layout)
+	start := 13 + len(sections)
+	buf := make([]byte, start+record*f.Length()) // 13 = 3 byte file header + version byte + size byte + 4 for useless + 4 for hash length
 
 	copy(buf[:3], FileMagic[:])
 	buf[3] = f.version
 	buf[4] = byte(f.maxSize)
 	binary.LittleEndian.PutUint32(buf[9:], uint32(f.Length()))
+	copy(buf[13:], sections)
 
 	for i, h := range f.hashes {
-		t := buf[13+(16+s)*i:]
+		t := buf[start+record*i:]
 		switch f.maxSize {
 		case size08:
 			t[0] = uint8(h.Index)
@@ -106,8 +437,13 @@ func (f *File) Write(path string) error {
 			panic("unreachable")
 		}
 
-		binary.LittleEndian.PutUint64(t[f.maxSize+0:], h.VHash)
-		binary.LittleEndian.PutUint64(t[f.maxSize+8:], h.VHash)
+		t = t[f.maxSize:]
+		for p, plane := range h.planes() {
+			for w := 0; w < layout[p]; w++ {
+				binary.LittleEndian.PutUint64(t, (*plane)[w])
+				t = t[8:]
+			}
+		}
 	}
 
 	if err := os.WriteFile(path+"."+strings.ToLower(FileMagic), buf, 0666); err != nil {
@@ -138,11 +474,25 @@ func LoadFromFile(name string) (*File, error) {
 	f.path = name
 	f.version = header[3]
 	f.maxSize = header[4]
+	f.hasher = DefaultHasher
+
+	layout := defaultLayout
+	var sources, features, information []byte
+	if f.version >= fileVersion2 {
+		if layout, sources, features, information, err = f.readSections(file); err != nil {
+			return nil, errors.Wrap(err, "reading header sections")
+		}
+	}
 
 	count := binary.LittleEndian.Uint32(header[9:])
 	f.hashes = make([]Hash, count)
 
-	buf := make([]byte, count*(8+8+uint32(f.maxSize)))
+	// Every plane of every hash shares a single backing array, which saves a lot of small allocations
+	size := layoutSize(layout)
+	words := make(BitSet, int(count)*size)
+
+	record := 8*size + int(f.maxSize)
+	buf := make([]byte, int(count)*record)
 	if _, err := io.ReadFull(file, buf); err != nil {
 		if err == io.ErrUnexpectedEOF {
 			return nil, errors.New("reached end of file. Maybe the number of frames is incorrect?")
@@ -165,29 +515,526 @@ func LoadFromFile(name string) (*File, error) {
 			panic("unreachable")
 		}
 
-		h.VHash = binary.LittleEndian.Uint64(buf[f.maxSize+0:])
-		h.HHash = binary.LittleEndian.Uint64(buf[f.maxSize+8:])
-		buf = buf[f.maxSize+16:]
+		// Planes written by a newer version that this one doesn't know about are skipped over
+		t := buf[f.maxSize:record]
+		for p, plane := range h.planes() {
+			if p >= len(layout) {
+				break
+			}
+
+			n := layout[p]
+			if n == 0 {
+				continue
+			}
+
+			*plane, words = words[:n:n], words[n:]
+			for w := range *plane {
+				(*plane)[w] = binary.LittleEndian.Uint64(t)
+				t = t[8:]
+			}
+		}
+		buf = buf[record:]
+	}
+
+	if sources != nil {
+		if err := f.unmarshalSources(sources); err != nil {
+			return nil, errors.Wrap(err, "reading sources")
+		}
+	}
+
+	if features != nil {
+		if err := f.unmarshalFeatures(features); err != nil {
+			return nil, errors.Wrap(err, "reading features")
+		}
+	}
+
+	if err := f.unmarshalInformation(information); err != nil {
+		return nil, errors.Wrap(err, "reading information scores")
 	}
 
 	return f, nil
 }
 
+// Returns the number of words in each plane of the file's hashes, or an error if they don't all share the same layout.
+func (f *File) layout() ([]int, error) {
+	if len(f.hashes) == 0 {
+		return defaultLayout, nil
+	}
+
+	first := f.hashes[0].planes()
+	layout := make([]int, len(first))
+	for p, plane := range first {
+		layout[p] = len(*plane)
+	}
+
+	for i := range f.hashes {
+		for p, plane := range f.hashes[i].planes() {
+			if len(*plane) != layout[p] {
+				return nil, errors.Errorf("hash %d has %d words in plane %d, expected %d", i, len(*plane), p, layout[p])
+			}
+		}
+	}
+
+	return layout, nil
+}
+
+// Returns the total number of words in a hash with the given layout.
+func layoutSize(layout []int) (n int) {
+	for _, w := range layout {
+		n += w
+	}
+	return
+}
+
+// Encodes the sources as a count followed by each path and crop, then the size of a source index and the index of every hash.
+func (f *File) marshalSources() []byte {
+	buf := putUint32(nil, uint32(len(f.sources)))
+	for _, s := range f.sources {
+		buf = putUint32(buf, uint32(len(s.Path)))
+		buf = append(buf, s.Path...)
+		for _, n := range []int{s.Crop.Min.X, s.Crop.Min.Y, s.Crop.Max.X, s.Crop.Max.Y} {
+			buf = putUint32(buf, uint32(n))
+		}
+	}
+
+	size := size32
+	if len(f.sources) <= math.MaxUint8+1 {
+		size = size08
+	} else if len(f.sources) <= math.MaxUint16+1 {
+		size = size16
+	}
+
+	buf = append(buf, size)
+	for _, h := range f.hashes {
+		switch size {
+		case size08:
+			buf = append(buf, uint8(h.Source))
+		case size16:
+			buf = append(buf, uint8(h.Source), uint8(h.Source>>8))
+		case size32:
+			buf = putUint32(buf, h.Source)
+		}
+	}
+	return buf
+}
+
+func (f *File) unmarshalSources(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("truncated source count")
+	}
+
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	f.sources = make([]Source, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 4 || uint32(len(data)-4) < binary.LittleEndian.Uint32(data)+16 {
+			return errors.Errorf("truncated source %d", i)
+		}
+
+		n := binary.LittleEndian.Uint32(data)
+		s := Source{Path: string(data[4 : 4+n])}
+		data = data[4+n:]
+
+		var r [4]int
+		for j := range r {
+			r[j] = int(int32(binary.LittleEndian.Uint32(data[4*j:])))
+		}
+		s.Crop = image.Rect(r[0], r[1], r[2], r[3])
+		data = data[16:]
+
+		f.sources = append(f.sources, s)
+	}
+
+	if len(data) < 1 || len(data)-1 != int(data[0])*len(f.hashes) {
+		return errors.New("source indices don't match the number of hashes")
+	}
+
+	size := data[0]
+	data = data[1:]
+	for i := range f.hashes {
+		h := &f.hashes[i]
+		switch size {
+		case size08:
+			h.Source = uint32(data[0])
+		case size16:
+			h.Source = uint32(binary.LittleEndian.Uint16(data))
+		case size32:
+			h.Source = binary.LittleEndian.Uint32(data)
+		default:
+			return errors.Errorf("invalid source index size %d", size)
+		}
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// Returns whether any hash in the file has features, or the file was created with them.
+func (f *File) hasFeatures() bool {
+	if f.features > 0 {
+		return true
+	}
+
+	for i := range f.hashes {
+		if f.hashes[i].Features != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Features are variable length, so rather than being a plane they're stored together in their own section: the most
+// keypoints per image as a uint16 and the number of hashes with features, then for each of those its position in the
+// file, its bounds and its keypoints, with every keypoint stored as four float32s and its descriptor.
+func (f *File) marshalFeatures() []byte {
+	buf := []byte{byte(f.features), byte(f.features >> 8)}
+
+	var count uint32
+	for i := range f.hashes {
+		if f.hashes[i].Features != nil {
+			count++
+		}
+	}
+	buf = putUint32(buf, count)
+
+	for i := range f.hashes {
+		feat := f.hashes[i].Features
+		if feat == nil {
+			continue
+		}
+
+		buf = putUint32(buf, uint32(i))
+		for _, n := range []int{feat.Bounds.Min.X, feat.Bounds.Min.Y, feat.Bounds.Max.X, feat.Bounds.Max.Y} {
+			buf = putUint32(buf, uint32(n))
+		}
+
+		buf = putUint32(buf, uint32(len(feat.Keypoints)))
+		for _, k := range feat.Keypoints {
+			for _, v := range []float32{k.X, k.Y, k.Scale, k.Angle} {
+				buf = putUint32(buf, math.Float32bits(v))
+			}
+			for _, w := range k.Descriptor {
+				buf = putUint64(buf, w)
+			}
+		}
+	}
+	return buf
+}
+
+func (f *File) unmarshalFeatures(data []byte) error {
+	if len(data) < 6 {
+		return errors.New("truncated feature header")
+	}
+
+	f.features = int(binary.LittleEndian.Uint16(data))
+	count := binary.LittleEndian.Uint32(data[2:])
+	data = data[6:]
+
+	const keypointSize = 16 + 32
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 24 {
+			return errors.Errorf("truncated features %d", i)
+		}
+
+		index := binary.LittleEndian.Uint32(data)
+		if index >= uint32(len(f.hashes)) {
+			return errors.Errorf("features %d belong to hash %d, but there are only %d", i, index, len(f.hashes))
+		}
+
+		var r [4]int
+		for j := range r {
+			r[j] = int(int32(binary.LittleEndian.Uint32(data[4+4*j:])))
+		}
+
+		n := binary.LittleEndian.Uint32(data[20:])
+		data = data[24:]
+		if uint64(len(data)) < uint64(n)*keypointSize {
+			return errors.Errorf("features %d have %d keypoints, but only %d bytes remain", i, n, len(data))
+		}
+
+		feat := &Features{Bounds: image.Rect(r[0], r[1], r[2], r[3]), Keypoints: make([]Keypoint, n)}
+		for j := range feat.Keypoints {
+			k := &feat.Keypoints[j]
+			k.X = math.Float32frombits(binary.LittleEndian.Uint32(data))
+			k.Y = math.Float32frombits(binary.LittleEndian.Uint32(data[4:]))
+			k.Scale = math.Float32frombits(binary.LittleEndian.Uint32(data[8:]))
+			k.Angle = math.Float32frombits(binary.LittleEndian.Uint32(data[12:]))
+			for w := range k.Descriptor {
+				k.Descriptor[w] = binary.LittleEndian.Uint64(data[16+8*w:])
+			}
+			data = data[keypointSize:]
+		}
+		f.hashes[index].Features = feat
+	}
+
+	if len(data) != 0 {
+		return errors.Errorf("%d bytes left over after the last features", len(data))
+	}
+	return nil
+}
+
+// Clips are stored in their own section rather than as hashes, since they are far larger and only ever searched on
+// their own: the frames per clip and words per signature as uint16s and the number of clips as a uint32, then for each
+// clip its source, the index of its first frame and its signature.
+func (f *File) marshalClips() []byte {
+	var words int
+	if len(f.clips) > 0 {
+		words = len(f.clips[0].VHash)
+	}
+
+	buf := []byte{byte(f.clipFrames), byte(f.clipFrames >> 8), byte(words), byte(words >> 8)}
+	buf = putUint32(buf, uint32(len(f.clips)))
+	for _, c := range f.clips {
+		buf = putUint32(buf, c.Source)
+		buf = putUint32(buf, c.Index)
+		for _, w := range c.VHash {
+			buf = putUint64(buf, w)
+		}
+	}
+	return buf
+}
+
+func (f *File) unmarshalClips(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("truncated clip header")
+	}
+
+	f.clipFrames = int(binary.LittleEndian.Uint16(data))
+	words := int(binary.LittleEndian.Uint16(data[2:]))
+	count := binary.LittleEndian.Uint32(data[4:])
+	data = data[8:]
+
+	record := 8 + 8*words
+	if uint64(len(data)) != uint64(count)*uint64(record) {
+		return errors.Errorf("%d clips of %d words need %d bytes, not %d", count, words, uint64(count)*uint64(record), len(data))
+	}
+
+	// Like hashes, every signature shares a single backing array
+	sigs := make(BitSet, int(count)*words)
+	f.clips = make([]Hash, count)
+	for i := range f.clips {
+		c := &f.clips[i]
+		c.Source = binary.LittleEndian.Uint32(data)
+		c.Index = binary.LittleEndian.Uint32(data[4:])
+		c.VHash, sigs = sigs[:words:words], sigs[words:]
+		for w := range c.VHash {
+			c.VHash[w] = binary.LittleEndian.Uint64(data[8+8*w:])
+		}
+		data = data[record:]
+	}
+	return nil
+}
+
+// Returns whether the file records what to do with low information frames, or any of its hashes have a score.
+func (f *File) hasInformation() bool {
+	if f.information != InformationIgnore {
+		return true
+	}
+
+	for i := range f.hashes {
+		if f.hashes[i].Information > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores the information mode and minimum score as single bytes, followed by the score of every hash in order.
+func (f *File) marshalInformation() []byte {
+	buf := make([]byte, 2, 2+len(f.hashes))
+	buf[0], buf[1] = byte(f.information), f.minInformation
+	for i := range f.hashes {
+		buf = append(buf, f.hashes[i].Information)
+	}
+	return buf
+}
+
+// Reads the information section, or fills in the score the bits of each hash give if the file has none.
+func (f *File) unmarshalInformation(data []byte) error {
+	if data == nil {
+		hasher, err := LookupHasher(f.hasher)
+		for i := range f.hashes {
+			// Without the hasher every bit of each word is assumed to be used
+			bits := 64 * (len(f.hashes[i].VHash) + len(f.hashes[i].HHash))
+			if err == nil {
+				bits = hasher.Bits()
+			}
+			f.hashes[i].Information = uint8(math.Min(math.Round(bitInformation(&f.hashes[i], bits)), 255))
+		}
+		return nil
+	}
+
+	if len(data) != 2+len(f.hashes) {
+		return errors.Errorf("information section must be %d bytes, not %d", 2+len(f.hashes), len(data))
+	}
+
+	f.information, f.minInformation = InformationMode(data[0]), data[1]
+	if err := f.information.validate(); err != nil {
+		return err
+	}
+
+	for i := range f.hashes {
+		f.hashes[i].Information = data[2+i]
+	}
+	return nil
+}
+
+// Appends a single tagged section to buf, returning the extended buffer.
+func appendSection(buf []byte, tag byte, data []byte) []byte {
+	buf = append(buf, tag)
+	buf = putUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// Appends a little endian uint32 to buf, since binary.LittleEndian.AppendUint32 requires a newer Go version.
+func putUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// Appends a little endian uint64 to buf, see putUint32.
+func putUint64(buf []byte, v uint64) []byte {
+	return putUint32(putUint32(buf, uint32(v)), uint32(v>>32))
+}
+
+// Reads the length prefixed section block that follows the fixed header in version 2 files, returning the layout of the
+// hashes and the sources, features and information sections, which can only be read once the hashes have been.
+func (f *File) readSections(r io.Reader) (layout []int, sources, features, information []byte, err error) {
+	layout = defaultLayout
+
+	var length [4]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return
+	}
+
+	buf := make([]byte, binary.LittleEndian.Uint32(length[:]))
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+
+	for len(buf) > 0 {
+		if len(buf) < 5 {
+			return nil, nil, nil, nil, errors.New("truncated section header")
+		}
+
+		tag, size := buf[0], binary.LittleEndian.Uint32(buf[1:])
+		buf = buf[5:]
+		if uint32(len(buf)) < size {
+			return nil, nil, nil, nil, errors.Errorf("section %d is %d bytes but only %d remain", tag, size, len(buf))
+		}
+
+		data := buf[:size]
+		buf = buf[size:]
+
+		switch tag {
+		case sectionHasher:
+			f.hasher = string(data)
+		case sectionLayout:
+			if len(data)%2 != 0 {
+				return nil, nil, nil, nil, errors.Errorf("layout section has an odd length of %d", len(data))
+			}
+
+			layout = make([]int, len(data)/2)
+			for i := range layout {
+				layout[i] = int(binary.LittleEndian.Uint16(data[2*i:]))
+			}
+		case sectionFilter:
+			if len(data) != 1 {
+				return nil, nil, nil, nil, errors.Errorf("filter section must be 1 byte, not %d", len(data))
+			}
+			f.filter = Filter(data[0])
+		case sectionSources:
+			sources = data
+		case sectionFeatures:
+			features = data
+		case sectionInformation:
+			information = data
+		case sectionClips:
+			if err := f.unmarshalClips(data); err != nil {
+				return nil, nil, nil, nil, errors.Wrap(err, "reading clips")
+			}
+		case sectionMask:
+			if len(data) != 1 {
+				return nil, nil, nil, nil, errors.Errorf("mask section must be 1 byte, not %d", len(data))
+			}
+			f.maskThreshold = data[0]
+		case sectionTiles:
+			if len(data) != 1 {
+				return nil, nil, nil, nil, errors.Errorf("tiles section must be 1 byte, not %d", len(data))
+			}
+			f.tiles = int(data[0])
+		case sectionPreprocess:
+			if err := f.preprocess.unmarshal(data); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		case sectionBackground:
+			if err := f.background.unmarshal(data); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+	}
+
+	return
+}
+
 // Compares two files, returning an error if they are not equal explaining the reason.
 func Compare(file1 *File, file2 *File) error {
+	return compare(file1, file2, equalRule())
+}
+
+// Identical to Compare, but a hash in the first file only needs a hash in the second within maxDist of it by the metric.
+func CompareWithMetric(file1 *File, file2 *File, metric Metric, maxDist int) error {
+	if err := checkMetric(metric); err != nil {
+		return err
+	}
+	return compare(file1, file2, metricRule(metric, maxDist))
+}
+
+func compare(file1 *File, file2 *File, rule sameRule) error {
+	if file1.hasher != file2.hasher {
+		return errors.Errorf("File hashers are different: %s vs %s", file1.hasher, file2.hasher)
+	}
+
+	if file1.Filter() != file2.Filter() {
+		return errors.Errorf("File filters are different: %s vs %s", file1.Filter(), file2.Filter())
+	}
+
+	if string(file1.background.marshal()) != string(file2.background.marshal()) {
+		return errors.New("File backgrounds are different")
+	}
+
+	if !file1.preprocess.equal(file2.preprocess) {
+		return errors.New("File preprocessing steps are different")
+	}
+
 	if file1.Length() != file2.Length() {
 		return errors.Errorf("File lengths are different: %d vs %d", file1.Length(), file2.Length())
 	}
 
+	// Every hash in the first file is searched for in a list of the second, as long as they all share one layout
+	if list := rule.list(file2.hashes, file1.hashes); list != nil {
+		for i := range file2.hashes {
+			list.add(&file2.hashes[i])
+		}
+
+		for i := range file1.hashes {
+			if h1 := &file1.hashes[i]; !list.any(h1, rule.maxDist) {
+				return errors.Errorf("Could not find hash in second file: V: %s, H: %s", h1.VHash, h1.HHash)
+			}
+		}
+		return nil
+	}
+
 outer:
-	for _, h1 := range file1.hashes {
-		for _, h2 := range file2.hashes {
-			if h1.VHash == h2.VHash && h1.HHash == h2.HHash {
+	for i := range file1.hashes {
+		h1 := &file1.hashes[i]
+		for j := range file2.hashes {
+			if rule.same(h1, &file2.hashes[j]) {
 				continue outer
 			}
 		}
 
-		return errors.Errorf("Could not find hash in second file: V: %d, H: %d", h1.VHash, h1.HHash)
+		return errors.Errorf("Could not find hash in second file: V: %s, H: %s", h1.VHash, h1.HHash)
 	}
 
 	return nil
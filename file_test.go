@@ -0,0 +1,244 @@
+package imghash
+
+import (
+	"image"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a hash with random planes of the given number of words.
+func randomHash(vwords, hwords int, index uint32) Hash {
+	h := Hash{VHash: make(BitSet, vwords), HHash: make(BitSet, hwords), Index: index}
+	for _, plane := range h.planes() {
+		for w := range *plane {
+			(*plane)[w] = rand.Uint64()
+		}
+	}
+	return h
+}
+
+// Writes the file to a temporary directory and loads it back.
+func roundTrip(t *testing.T, f *File) *File {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test")
+	if err := f.Write(path); err != nil {
+		t.Fatalf("writing file: %s", err)
+	}
+
+	loaded, err := LoadFromFile(path + "." + strings.ToLower(FileMagic))
+	if err != nil {
+		t.Fatalf("loading file: %s", err)
+	}
+	return loaded
+}
+
+// Hashes of every width, index size and file version must survive being written and read back.
+func TestFileRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		version        byte
+		hasher         string
+		vwords, hwords int
+		maxIndex       uint32
+	}{
+		{"v1", fileVersion1, DefaultHasher, 1, 1, 200},
+		{"v2", fileVersion2, DefaultHasher, 1, 1, 70000},
+		{"single plane", fileVersion2, "ahash", 1, 0, 1000},
+		{"17x17", fileVersion2, "dhash17x17", 4, 4, 10},
+	}
+
+	for _, test := range tests {
+		f := NewFileWithVersion(test.version)
+		f.hasher = test.hasher
+		for i := 0; i < 50; i++ {
+			f.hashes = append(f.hashes, randomHash(test.vwords, test.hwords, uint32(rand.Intn(int(test.maxIndex)))))
+		}
+
+		loaded := roundTrip(t, f)
+		if loaded.Hasher() != test.hasher {
+			t.Fatalf("%s: hasher was %q, expected %q", test.name, loaded.Hasher(), test.hasher)
+		}
+
+		if loaded.Length() != f.Length() {
+			t.Fatalf("%s: loaded %d hashes, expected %d", test.name, loaded.Length(), f.Length())
+		}
+
+		for i, h := range loaded.hashes {
+			if !h.Equal(f.hashes[i]) || h.Index != f.hashes[i].Index {
+				t.Fatalf("%s: hash %d was %v, expected %v", test.name, i, h, f.hashes[i])
+			}
+		}
+	}
+}
+
+// Version 1 files have no room to store the hasher or a hash wider than 64 bits, so writing them must fail.
+func TestFileVersion1Limits(t *testing.T) {
+	f := NewFileWithVersion(fileVersion1)
+	f.hashes = []Hash{randomHash(4, 4, 0)}
+	if err := f.Write(filepath.Join(t.TempDir(), "wide")); err == nil {
+		t.Fatal("expected an error writing 256 bit hashes to a version 1 file")
+	}
+
+	f = NewFileWithVersion(fileVersion1)
+	f.hasher = "phash"
+	if err := f.Write(filepath.Join(t.TempDir(), "phash")); err == nil {
+		t.Fatal("expected an error writing phash hashes to a version 1 file")
+	}
+}
+
+// Sources, their crops and the source index of every hash must survive being written and read back.
+func TestFileSources(t *testing.T) {
+	f := NewFile()
+	f.sources = []Source{{Path: "a.mp4", Crop: image.Rect(0, 40, 1920, 1040)}, {Path: "dir/b.png"}}
+	for i := 0; i < 20; i++ {
+		h := randomHash(1, 1, uint32(i))
+		h.Source = uint32(i % 2)
+		f.hashes = append(f.hashes, h)
+	}
+
+	loaded := roundTrip(t, f)
+	if len(loaded.Sources()) != 2 || loaded.Sources()[0] != f.sources[0] || loaded.Sources()[1] != f.sources[1] {
+		t.Fatalf("sources were %v, expected %v", loaded.Sources(), f.sources)
+	}
+
+	for i, h := range loaded.hashes {
+		if h.Source != f.hashes[i].Source {
+			t.Fatalf("hash %d has source %d, expected %d", i, h.Source, f.hashes[i].Source)
+		}
+	}
+}
+
+// Files scaled by ffmpeg and in Go record different filters, so their hashes aren't mixed up. Version 1 files were
+// always scaled by ffmpeg, which is still the default, and images in memory are never handed to it.
+func TestFileFilter(t *testing.T) {
+	for _, filter := range []Filter{FilterBilinear, FilterFFmpeg, FilterLanczos} {
+		f := NewFile()
+		f.filter = filter
+		f.hashes = []Hash{randomHash(1, 1, 0)}
+		if loaded := roundTrip(t, f); loaded.Filter() != filter || loaded.Options().Filter != filter {
+			t.Errorf("file scaled with %s loaded as %s", filter, loaded.Filter())
+		}
+	}
+
+	v1 := NewFileWithVersion(fileVersion1)
+	v1.hashes = []Hash{randomHash(1, 1, 0)}
+	if loaded := roundTrip(t, v1); loaded.Filter() != FilterFFmpeg {
+		t.Errorf("version 1 file loaded as %s", loaded.Filter())
+	}
+
+	v2 := NewFile()
+	v2.hashes = v1.hashes
+	if err := Compare(v1, v2); err != nil {
+		t.Errorf("a new file couldn't be compared with a version 1 file: %v", err)
+	}
+
+	v2.filter = FilterBilinear
+	if err := Compare(v1, v2); err == nil {
+		t.Error("files scaled by ffmpeg and in Go compared equal")
+	}
+
+	img := cornerImage(t, rand.New(rand.NewSource(1)), 64, 48)
+	if _, err := HashImageWithOptions(img, Options{}); err == nil {
+		t.Error("hashed an image in memory with ffmpeg")
+	}
+
+	// Hashers that scale images themselves never go through ffmpeg, so they record the filter the rest was scaled with
+	f, err := NewFromPathWithHasher(writePNG(t, img), "imagehash-dhash")
+	if err != nil {
+		t.Fatal(err)
+	} else if f.Filter() != FilterBilinear {
+		t.Errorf("imagehash file recorded the %s filter", f.Filter())
+	}
+
+	v1.filter = FilterBilinear
+	if err := v1.Write(filepath.Join(t.TempDir(), "v1")); err == nil {
+		t.Error("wrote images scaled in Go to a version 1 file")
+	}
+}
+
+// Trees must refuse to mix files whose hashes were created with different options, since their distances mean nothing.
+func TestFileComparable(t *testing.T) {
+	base := func() *File {
+		f := NewFile()
+		f.hashes = []Hash{randomHash(1, 1, 0)}
+		return f
+	}
+
+	for name, change := range map[string]func(f *File){
+		"hasher":         func(f *File) { f.hasher = "ahash" },
+		"filter":         func(f *File) { f.filter = FilterArea },
+		"background":     func(f *File) { f.background = Background{Mode: BackgroundSolid} },
+		"mask threshold": func(f *File) { f.maskThreshold = 4 },
+		"tiles":          func(f *File) { f.tiles = 4 },
+		"preprocessing":  func(f *File) { f.preprocess = Preprocess{{Kind: StepEqualise}} },
+		"colour": func(f *File) {
+			f.hashes[0].CbHash, f.hashes[0].CrHash = BitSet{rand.Uint64()}, BitSet{rand.Uint64()}
+		},
+		"diagonal": func(f *File) { f.hashes[0].DiagHash = BitSet{rand.Uint64()} },
+	} {
+		changed := base()
+		change(changed)
+		if _, err := NewTreeFromFiles(base(), changed); err == nil {
+			t.Errorf("built a tree from files with different %s", name)
+		}
+		if _, err := NewTreeFromClips(base(), changed); err == nil {
+			t.Errorf("built a clip tree from files with different %s", name)
+		}
+	}
+
+	if _, err := NewTreeFromFiles(base(), base(), NewFile()); err != nil {
+		t.Errorf("files hashed the same way couldn't share a tree: %v", err)
+	}
+}
+
+// Masks and the threshold they were created with must survive being written and read back.
+func TestFileMasks(t *testing.T) {
+	f := NewFile()
+	f.maskThreshold = 4
+	for i := 0; i < 20; i++ {
+		h := randomHash(1, 1, uint32(i))
+		h.VMask, h.HMask = BitSet{rand.Uint64()}, BitSet{rand.Uint64()}
+		f.hashes = append(f.hashes, h)
+	}
+
+	loaded := roundTrip(t, f)
+	if loaded.MaskThreshold() != 4 {
+		t.Fatalf("mask threshold was %d, expected 4", loaded.MaskThreshold())
+	}
+
+	for i, h := range loaded.hashes {
+		if !h.VMask.Equal(f.hashes[i].VMask) || !h.HMask.Equal(f.hashes[i].HMask) {
+			t.Fatalf("hash %d has masks %s %s, expected %s %s", i, h.VMask, h.HMask, f.hashes[i].VMask, f.hashes[i].HMask)
+		}
+	}
+}
+
+// Diagonal hashes are stored as their own plane, which version 1 files have no room for.
+func TestFileDiagonal(t *testing.T) {
+	f := NewFile()
+	for i := 0; i < 20; i++ {
+		h := randomHash(1, 1, uint32(i))
+		h.DiagHash = BitSet{rand.Uint64()}
+		f.hashes = append(f.hashes, h)
+	}
+
+	loaded := roundTrip(t, f)
+	if !loaded.Options().Diagonal {
+		t.Error("file options don't include the diagonal")
+	}
+
+	for i, h := range loaded.hashes {
+		if !h.Equal(f.hashes[i]) {
+			t.Fatalf("hash %d has diagonal %s, expected %s", i, h.DiagHash, f.hashes[i].DiagHash)
+		}
+	}
+
+	v1 := NewFileWithVersion(fileVersion1)
+	v1.hashes = f.hashes
+	if err := v1.Write(filepath.Join(t.TempDir(), "v1")); err == nil {
+		t.Error("wrote diagonal hashes to a version 1 file")
+	}
+}
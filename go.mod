@@ -2,4 +2,7 @@ module github.com/turtletowerz/imghash
 
 go 1.18
 
-require github.com/pkg/errors v0.9.1
+require (
+	github.com/pkg/errors v0.9.1
+	golang.org/x/image v0.18.0
+)
@@ -3,22 +3,113 @@ package imghash
 import (
 	"image"
 	"image/color"
-	"math/bits"
+	"math"
+	"sort"
 
 	"github.com/pkg/errors"
 )
 
+// Hashers that only produce a single hash, such as the average hash, store it in VHash and leave HHash empty.
 type Hash struct {
-	VHash uint64
-	HHash uint64
+	VHash BitSet
+	HHash BitSet
 
 	// TODO: an ID? a Hash? what do we use to map these hashes to concrete output.
 	Index uint32
+
+	// The index of the source the hash came from in the file's sources.
+	Source uint32
+
+	// Bits of VHash and HHash that are too close to call, set when the two pixels compared are nearly equal.
+	// Both are empty unless the hash was created with a mask threshold, see Options.MaskThreshold.
+	VMask BitSet
+	HMask BitSet
+
+	// Horizontal difference hashes of the blue and red chroma planes, which the luma hashes are blind to.
+	// Both are empty unless the hash was created with Options.Colour set.
+	CbHash BitSet
+	CrHash BitSet
+
+	// Difference hashes of an overlapping grid of sub-regions, two words per tile, which still match when the image is
+	// cropped. Empty unless the hash was created with Options.Tiles set, see HashImageTiled.
+	Tiles BitSet
+
+	// The area of the source image the hash was taken from, only set for the sliding windows of a query hashed with
+	// Options.Windows. It isn't stored in files.
+	Region image.Rectangle
+
+	// Compares each pixel to the one diagonally below and to the right of it, a third direction alongside VHash and
+	// HHash. Empty unless the hash was created with Options.Diagonal set.
+	DiagHash BitSet
+
+	// Keypoints and descriptors that still match when most of the image has been cropped away, see MatchFeatures.
+	// Nil unless the hash was created from a still image with Options.Features set.
+	Features *Features
+
+	// How much detail the image had, from 0 for a completely flat frame such as a fade to black up to 255, see
+	// Options.Information. Files written before scores were recorded get the part of the score the bits alone give.
+	Information uint8
 }
 
-// Returns the hamming distance between the two vertical hashes + hamming distance between the two horizontal hashes
+// Controls whether comparing two hashes takes their colour into account.
+type ColourMode byte
+
+const (
+	ColourIgnore  ColourMode = iota // Only luma is compared, so a recoloured or grayscale copy matches the original
+	ColourRequire                   // The colour hash distance is added on, so recoloured copies are further apart
+)
+
+// Returns the hamming distance between the two vertical hashes + hamming distance between the two horizontal hashes,
+// plus the hamming distance between the two diagonal hashes if both of them have one.
 func (i Hash) Distance(o Hash) int {
-	return bits.OnesCount64(i.VHash^o.VHash) + bits.OnesCount64(i.HHash^o.HHash)
+	return i.VHash.Distance(o.VHash) + i.HHash.Distance(o.HHash) + i.diagonalDistance(&o)
+}
+
+// Identical to Distance, but ignores every bit that is unstable in either hash according to their masks.
+// Hashes without masks give the same distance as Distance. Diagonal hashes have no masks, so they count in full
+// whenever both hashes have one.
+func (i Hash) MaskedDistance(o Hash) int {
+	return i.VHash.MaskedDistance(o.VHash, i.VMask, o.VMask) + i.HHash.MaskedDistance(o.HHash, i.HMask, o.HMask) +
+		i.diagonalDistance(&o)
+}
+
+// Returns the hamming distance between the two diagonal hashes, or 0 if either hash doesn't have one. A missing
+// diagonal says nothing about the image, unlike a missing colour hash, which is what a grayscale image would give.
+func (i *Hash) diagonalDistance(o *Hash) int {
+	if len(i.DiagHash) == 0 || len(o.DiagHash) == 0 {
+		return 0
+	}
+	return i.DiagHash.Distance(o.DiagHash)
+}
+
+// Returns the hamming distance between the two chroma hashes, which is 0 if neither hash has colour.
+// A hash with colour compared against one without counts every set chroma bit, the same as a grayscale image would.
+func (i Hash) ColourDistance(o Hash) int {
+	return i.CbHash.Distance(o.CbHash) + i.CrHash.Distance(o.CrHash)
+}
+
+// Returns the distance between the two hashes, adding on their colour distance if the mode requires colour to agree.
+func (i Hash) DistanceWithColour(o Hash, mode ColourMode) int {
+	if mode == ColourRequire {
+		return i.Distance(o) + i.ColourDistance(o)
+	}
+	return i.Distance(o)
+}
+
+// Returns the number of unstable bits in the hash.
+func (i Hash) MaskCount() int {
+	return i.VMask.Count() + i.HMask.Count()
+}
+
+// Returns whether both hashes have identical bits, including their colour and diagonal, ignoring their index.
+func (i Hash) Equal(o Hash) bool {
+	return i.VHash.Equal(o.VHash) && i.HHash.Equal(o.HHash) && i.CbHash.Equal(o.CbHash) && i.CrHash.Equal(o.CrHash) &&
+		i.DiagHash.Equal(o.DiagHash)
+}
+
+// Returns pointers to each bitset in the hash, in the order they are stored in a file.
+func (i *Hash) planes() []*BitSet {
+	return []*BitSet{&i.VHash, &i.HHash, &i.VMask, &i.HMask, &i.CbHash, &i.CrHash, &i.Tiles, &i.DiagHash}
 }
 
 // From color.RGBToYCbCr in Go's standard library, but don't use RGBA() since RGBToYCbCr expects uint8s.
@@ -35,40 +126,472 @@ func rgbToY(r, g, b uint8) uint8 {
 }
 
 // http://www.hackerfactor.com/blog/?/archives/529-Kind-of-Like-That.html
-func differenceHash(img *image.NRGBA) (hdhash, vdhash uint64, err error) {
-	// Check to make sure the bounds are the right size for the hash.
+// Any image of at least 2x2 can be hashed, giving (dx-1)*(dy-1) bits in each direction. The usual 9x9 image
+// gives exactly 64 bits, which are laid out the same way a single uint64 hash would be.
+func differenceHash(img *image.NRGBA) (hdhash, vdhash BitSet, err error) {
+	hdhash, vdhash, _, _, err = maskedDifferenceHash(img, 0)
+	return
+}
+
+// Horizontal difference hashes of the Cb and Cr planes of an image, giving (dx-1)*dy bits each. Grayscale images have
+// flat chroma and so hash to all zeroes, while recolouring an image changes which way its chroma edges go.
+func chromaHash(img *image.NRGBA) (cbhash, crhash BitSet) {
+	dx, dy := img.Rect.Dx(), img.Rect.Dy()
+	cbhash, crhash = NewBitSet((dx-1)*dy), NewBitSet((dx-1)*dy)
+
+	var offset int
+	for y := 0; y < dy; y++ {
+		col := img.NRGBAAt(img.Rect.Min.X, img.Rect.Min.Y+y)
+		_, cb, cr := color.RGBToYCbCr(col.R, col.G, col.B)
+
+		for x := 1; x < dx; x++ {
+			col = img.NRGBAAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			_, ncb, ncr := color.RGBToYCbCr(col.R, col.G, col.B)
+
+			if cb < ncb {
+				cbhash.Set(offset)
+			}
+			if cr < ncr {
+				crhash.Set(offset)
+			}
+			cb, cr = ncb, ncr
+			offset++
+		}
+	}
+	return
+}
+
+// A difference hash along the diagonal, setting a bit wherever a pixel is darker than the one below and to the right
+// of it. It covers the same (dx-1)*(dy-1) pixels as the vertical and horizontal hashes, so a 9x9 image gives 64 bits.
+func diagonalHash(img *image.NRGBA) BitSet {
+	return diagonalHashLuma(luminance(img), img.Rect.Dx(), img.Rect.Dy())
+}
+
+// Identical to diagonalHash, but hashes the luma of a dx*dy image.
+func diagonalHashLuma(luma []uint8, dx, dy int) BitSet {
+	hash := NewBitSet((dx - 1) * (dy - 1))
+	for y := 0; y < dy-1; y++ {
+		for x := 0; x < dx-1; x++ {
+			if luma[y*dx+x] < luma[(y+1)*dx+x+1] {
+				hash.Set(y*(dx-1) + x)
+			}
+		}
+	}
+	return hash
+}
+
+// Identical to differenceHash, but also returns masks with a bit set wherever the two pixels compared differ by less
+// than threshold, since a difference of 1 is as good as a coin flip once the image is recompressed. A threshold of 0
+// leaves the masks empty.
+func maskedDifferenceHash(img *image.NRGBA, threshold uint8) (hdhash, vdhash, hmask, vmask BitSet, err error) {
+	// Check to make sure the bounds are large enough for the hash.
 	dx, dy := img.Rect.Dx(), img.Rect.Dy()
-	if dx != width || dy != height {
-		err = errors.Errorf("Invalid dimensions %dx%d, must be a 9x9 image", dx, dy)
+	if dx < 2 || dy < 2 {
+		err = errors.Errorf("Invalid dimensions %dx%d, must be at least a 2x2 image", dx, dy)
 		return
 	}
 
-	var col color.NRGBA
+	n := (dx - 1) * (dy - 1)
+	vdhash, hdhash = NewBitSet(n), NewBitSet(n)
+	if threshold > 0 {
+		vmask, hmask = NewBitSet(n), NewBitSet(n)
+	}
+
+	pix := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y):]
+	differenceHashPix(pix, img.Stride, dx, dy, make([]uint8, dx*dy), threshold, hdhash, vdhash, hmask, vmask)
+	return
+}
 
-	pixels := make([][]uint8, dy)
-	for y := range pixels {
-		pixels[y] = make([]uint8, dx)
-		for x := range pixels[y] {
-			col = img.NRGBAAt(x, y)
-			pixels[y][x] = rgbToY(col.R, col.G, col.B)
+// The core of maskedDifferenceHash, hashing dx*dy RGBA pixels laid out stride bytes per row into bitsets that are
+// already large enough, with luma as scratch space for at least dx*dy values. The masks are left alone unless threshold
+// is set. Nothing is allocated, so batches of frames can share every buffer.
+func differenceHashPix(pix []uint8, stride, dx, dy int, luma []uint8, threshold uint8, hdhash, vdhash, hmask, vmask BitSet) {
+	for y := 0; y < dy; y++ {
+		row, out := pix[y*stride:], luma[y*dx:]
+		for x := 0; x < dx; x++ {
+			out[x] = rgbToY(row[4*x], row[4*x+1], row[4*x+2])
 		}
 	}
+	differenceHashLuma(luma, dx, dy, threshold, hdhash, vdhash, hmask, vmask)
+}
 
+// Identical to differenceHashPix, but starts from the luma of the dx*dy pixels rather than their colours.
+func differenceHashLuma(luma []uint8, dx, dy int, threshold uint8, hdhash, vdhash, hmask, vmask BitSet) {
 	// Whether you do < or > for the comparison doesn't matter, it just has to be consistent.
-	var offset uint64 = 1
+	// Bits are gathered a word at a time, which is far quicker than setting them one by one.
+	var (
+		vw, hw, vmw, hmw uint64
+		bit, word        uint
+	)
 	for y := 0; y < dy-1; y++ {
 		for x := 0; x < dx-1; x++ {
+			p, below, right := luma[y*dx+x], luma[(y+1)*dx+x], luma[y*dx+x+1]
+
 			// Vertical hash.
-			if pixels[y][x] < pixels[y+1][x] {
-				vdhash |= offset
+			if p < below {
+				vw |= 1 << bit
 			}
 
 			// Horizontal hash.
-			if pixels[y][x] < pixels[y][x+1] {
-				hdhash |= offset
+			if p < right {
+				hw |= 1 << bit
+			}
+
+			if threshold > 0 {
+				if subAbs(p, below) < threshold {
+					vmw |= 1 << bit
+				}
+
+				if subAbs(p, right) < threshold {
+					hmw |= 1 << bit
+				}
+			}
+
+			if bit++; bit == 64 {
+				vdhash[word], hdhash[word] = vw, hw
+				if threshold > 0 {
+					vmask[word], hmask[word] = vmw, hmw
+				}
+				vw, hw, vmw, hmw, bit = 0, 0, 0, 0, 0
+				word++
+			}
+		}
+	}
+
+	if bit > 0 {
+		vdhash[word], hdhash[word] = vw, hw
+		if threshold > 0 {
+			vmask[word], hmask[word] = vmw, hmw
+		}
+	}
+}
+
+// Subtract two numbers and return 0 or a whole number.
+func subAbs(n1, n2 uint8) uint8 {
+	if n1 > n2 {
+		return n1 - n2
+	}
+	return n2 - n1
+}
+
+// Converts every pixel in the image to its luminance, returned in row-major order.
+func luminance(img *image.NRGBA) []uint8 {
+	dx, dy := img.Rect.Dx(), img.Rect.Dy()
+	pixels := make([]uint8, 0, dx*dy)
+
+	var col color.NRGBA
+	for y := 0; y < dy; y++ {
+		for x := 0; x < dx; x++ {
+			col = img.NRGBAAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			pixels = append(pixels, rgbToY(col.R, col.G, col.B))
+		}
+	}
+	return pixels
+}
+
+// Sets a bit for every pixel of an 8x8 image whose luminance is above the mean luminance of the whole image.
+func averageHash(img *image.NRGBA) (ahash uint64, err error) {
+	dx, dy := img.Rect.Dx(), img.Rect.Dy()
+	if dx != 8 || dy != 8 {
+		err = errors.Errorf("Invalid dimensions %dx%d, must be a 8x8 image", dx, dy)
+		return
+	}
+
+	return averageHashLuma(luminance(img)), nil
+}
+
+// Identical to averageHash, but hashes the luma of an 8x8 image.
+func averageHashLuma(pixels []uint8) (ahash uint64) {
+	var sum int
+	for _, p := range pixels {
+		sum += int(p)
+	}
+
+	// Compare against the sum rather than the mean so there's no rounding of the average.
+	for i, p := range pixels {
+		if int(p)*len(pixels) > sum {
+			ahash |= 1 << uint(i)
+		}
+	}
+
+	return
+}
+
+// Size of the image the perceptual hash is computed from, and of the low frequency block that is kept from it.
+const (
+	phashSize  = 32
+	phashBlock = 8
+)
+
+// Cosine table for an n-point DCT-II, indexed as [u*n+x].
+func dctTable(n int) []float64 {
+	table := make([]float64, n*n)
+	for u := 0; u < n; u++ {
+		for x := 0; x < n; x++ {
+			table[u*n+x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*n))
+		}
+	}
+	return table
+}
+
+var phashTable = dctTable(phashSize)
+
+// Unnormalised 2D DCT-II of a square n*n block, computed as a 1D DCT over the rows followed by the columns.
+// Only the first keep rows and columns of coefficients are computed and returned, since nothing else is used.
+// The missing normalisation factors don't matter since the hash only compares coefficients against each other.
+func dct2D(pixels []float64, n, keep int, table []float64) []float64 {
+	rows := make([]float64, n*keep)
+	for y := 0; y < n; y++ {
+		for u := 0; u < keep; u++ {
+			var sum float64
+			for x := 0; x < n; x++ {
+				sum += pixels[y*n+x] * table[u*n+x]
+			}
+			rows[y*keep+u] = sum
+		}
+	}
+
+	out := make([]float64, keep*keep)
+	for v := 0; v < keep; v++ {
+		for u := 0; u < keep; u++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				sum += rows[y*keep+u] * table[v*n+y]
+			}
+			out[v*keep+u] = sum
+		}
+	}
+	return out
+}
+
+// http://www.hackerfactor.com/blog/?/archives/432-Looks-Like-It.html
+// Keeps the 8x8 lowest frequency coefficients of the DCT of a 32x32 image, setting a bit for each one above their mean.
+// Like the reference pHash the block starts at (1, 1), so the DC term and the first row and column are left out of
+// both the mean and the hash, since they only carry the average brightness and would set nearly the same bits for
+// every image.
+func perceptualHash(img *image.NRGBA) (phash uint64, err error) {
+	dx, dy := img.Rect.Dx(), img.Rect.Dy()
+	if dx != phashSize || dy != phashSize {
+		err = errors.Errorf("Invalid dimensions %dx%d, must be a %dx%d image", dx, dy, phashSize, phashSize)
+		return
+	}
+	return perceptualHashLuma(luminance(img)), nil
+}
+
+// Identical to perceptualHash, but hashes the luma of a 32x32 image.
+func perceptualHashLuma(luma []uint8) (phash uint64) {
+	pixels := make([]float64, len(luma))
+	for i, p := range luma {
+		pixels[i] = float64(p)
+	}
+
+	const keep = phashBlock + 1
+	all := dct2D(pixels, phashSize, keep, phashTable)
+
+	coeffs := make([]float64, 0, phashBlock*phashBlock)
+	for v := 1; v < keep; v++ {
+		coeffs = append(coeffs, all[v*keep+1:(v+1)*keep]...)
+	}
+
+	var sum float64
+	for _, c := range coeffs {
+		sum += c
+	}
+	mean := sum / float64(len(coeffs))
+
+	for i, c := range coeffs {
+		if c > mean {
+			phash |= 1 << uint(i)
+		}
+	}
+
+	return
+}
+
+// Size of the image the wavelet hash is computed from, and the number of Haar levels needed to leave an 8x8 block of
+// the coarsest coefficients in its top-left corner.
+const (
+	whashSize   = 32
+	whashLevels = 3
+)
+
+// Runs a single level of the 2D Haar transform over the top-left n*n block of a stride*stride image in place.
+// Afterwards the top-left quadrant of the block holds the approximation (LL) and the others the horizontal,
+// vertical and diagonal details, so repeated calls with a halved n give a multi-level decomposition.
+func haar2D(pixels []float64, stride, n int) {
+	half := n / 2
+	tmp := make([]float64, n)
+
+	// Rows, then columns.
+	for y := 0; y < n; y++ {
+		row := pixels[y*stride:]
+		for x := 0; x < half; x++ {
+			a, b := row[2*x], row[2*x+1]
+			tmp[x], tmp[half+x] = (a+b)/math.Sqrt2, (a-b)/math.Sqrt2
+		}
+		copy(row[:n], tmp)
+	}
+
+	for x := 0; x < n; x++ {
+		for y := 0; y < half; y++ {
+			a, b := pixels[2*y*stride+x], pixels[(2*y+1)*stride+x]
+			tmp[y], tmp[half+y] = (a+b)/math.Sqrt2, (a-b)/math.Sqrt2
+		}
+		for y := 0; y < n; y++ {
+			pixels[y*stride+x] = tmp[y]
+		}
+	}
+}
+
+// Decomposes a 32x32 image with a three level Haar wavelet, leaving the 4x4 approximation and the 4x4 horizontal,
+// vertical and diagonal details of the coarsest level in the top-left 8x8 block, which are hashed in that layout. On its
+// own the approximation is only a block average, so its 16 bits are set where it is above its median, while the other
+// 48 are set where a detail is positive, which is the direction of the edges between neighbouring 8x8 blocks. Both only
+// depend on the coarsest structure of the image, which JPEG recompression leaves alone.
+func waveletHash(img *image.NRGBA) (whash uint64, err error) {
+	dx, dy := img.Rect.Dx(), img.Rect.Dy()
+	if dx != whashSize || dy != whashSize {
+		err = errors.Errorf("Invalid dimensions %dx%d, must be a %dx%d image", dx, dy, whashSize, whashSize)
+		return
+	}
+	return waveletHashLuma(luminance(img)), nil
+}
+
+// Identical to waveletHash, but hashes the luma of a 32x32 image.
+func waveletHashLuma(luma []uint8) (whash uint64) {
+	pixels := make([]float64, len(luma))
+	for i, p := range luma {
+		pixels[i] = float64(p)
+	}
+
+	n := whashSize
+	for level := 0; level < whashLevels; level++ {
+		haar2D(pixels, whashSize, n)
+		n /= 2
+	}
+
+	ll := make([]float64, 0, n*n)
+	for y := 0; y < n; y++ {
+		ll = append(ll, pixels[y*whashSize:y*whashSize+n]...)
+	}
+
+	sorted := append([]float64(nil), ll...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	for y := 0; y < 2*n; y++ {
+		for x := 0; x < 2*n; x++ {
+			threshold := 0.0
+			if x < n && y < n {
+				threshold = median
+			}
+
+			if pixels[y*whashSize+x] > threshold {
+				whash |= 1 << uint(y*2*n+x)
 			}
+		}
+	}
+
+	return
+}
+
+// Size of the image the radial variance hash is computed from, the number of projection angles across half a turn,
+// and the number of DCT coefficients of the projections that are kept.
+const (
+	rhashSize   = 64
+	rhashAngles = 180
+	rhashCoeffs = 64
+)
+
+var rhashTable = dctTable(rhashAngles)
+
+// Samples the pixel at a fractional position with bilinear interpolation, treating the image as n*n.
+func bilinearAt(pixels []float64, n int, x, y float64) float64 {
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	at := func(x, y int) float64 {
+		if x < 0 || y < 0 || x >= n || y >= n {
+			return 0
+		}
+		return pixels[y*n+x]
+	}
+
+	top := at(x0, y0)*(1-fx) + at(x0+1, y0)*fx
+	bottom := at(x0, y0+1)*(1-fx) + at(x0+1, y0+1)*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// http://www.phash.org/docs/pubs/thesis_zauner.pdf
+// Projects the image along lines through its centre at every angle of a half turn, like a Radon transform, taking the
+// variance of the pixels along each line. Rotating the image only shifts this curve along, so it is shifted back to a
+// common starting point before its DCT is taken, and a bit is set for each kept coefficient above their median. Only
+// the circle inscribed in the image is sampled, so the corners a rotation brings in or cuts off don't count.
+func radialHash(img *image.NRGBA) (rhash uint64, err error) {
+	dx, dy := img.Rect.Dx(), img.Rect.Dy()
+	if dx != rhashSize || dy != rhashSize {
+		err = errors.Errorf("Invalid dimensions %dx%d, must be a %dx%d image", dx, dy, rhashSize, rhashSize)
+		return
+	}
+	return radialHashLuma(luminance(img)), nil
+}
+
+// Identical to radialHash, but hashes the luma of a 64x64 image.
+func radialHashLuma(luma []uint8) (rhash uint64) {
+	pixels := make([]float64, len(luma))
+	for i, p := range luma {
+		pixels[i] = float64(p)
+	}
+
+	centre := float64(rhashSize-1) / 2
+	radius := rhashSize/2 - 1
+
+	projections := make([]float64, rhashAngles)
+	for a := range projections {
+		sin, cos := math.Sincos(float64(a) * math.Pi / rhashAngles)
+
+		var sum, sumsq float64
+		for r := -radius; r <= radius; r++ {
+			p := bilinearAt(pixels, rhashSize, centre+float64(r)*cos, centre+float64(r)*sin)
+			sum += p
+			sumsq += p * p
+		}
+
+		n := float64(2*radius + 1)
+		projections[a] = sumsq/n - (sum/n)*(sum/n)
+	}
+
+	// Rotating the image shifts the curve around, so it is shifted back to start at the phase of its fundamental
+	var re, im float64
+	for a, p := range projections {
+		sin, cos := math.Sincos(2 * math.Pi * float64(a) / rhashAngles)
+		re += p * cos
+		im += p * sin
+	}
+	shift := math.Atan2(im, re) * rhashAngles / (2 * math.Pi)
+
+	aligned := make([]float64, rhashAngles)
+	for a := range aligned {
+		pos := math.Mod(float64(a)+shift+rhashAngles, rhashAngles)
+		i := int(pos)
+		f := pos - float64(i)
+		aligned[a] = projections[i%rhashAngles]*(1-f) + projections[(i+1)%rhashAngles]*f
+	}
+
+	coeffs := make([]float64, rhashCoeffs)
+	for u := range coeffs {
+		for x, p := range aligned {
+			coeffs[u] += p * rhashTable[(u+1)*rhashAngles+x] // The DC term is skipped, it's only the overall variance
+		}
+	}
+
+	sorted := append([]float64(nil), coeffs...)
+	sort.Float64s(sorted)
+	median := (sorted[rhashCoeffs/2-1] + sorted[rhashCoeffs/2]) / 2
 
-			offset <<= 1
+	for i, c := range coeffs {
+		if c > median {
+			rhash |= 1 << uint(i)
 		}
 	}
 
@@ -1,21 +1,17 @@
 package imghash
 
 import (
+	"bytes"
 	"image"
 	"image/color"
+	"image/jpeg"
+	"math"
+	"math/bits"
 	"math/rand"
 	"testing"
 	"time"
 )
 
-// Subtract two numbers and return 0 or a whole number.
-func subAbs(n1, n2 uint8) uint8 {
-	if n1 > n2 {
-		return n1 - n2
-	}
-	return n2 - n1
-}
-
 // Test to make sure the current hash function falls within appropriate JPEG specification bounds.
 func TestHashJPEG(t *testing.T) {
 	for r := 0; r < 256; r += 7 {
@@ -95,10 +91,421 @@ func TestPixels(t *testing.T) {
 		}
 	}
 
-	vh1, hh1 := testold(img)
+	// The old method named its return values the opposite way around to differenceHash.
+	hh1, vh1 := testold(img)
 	hh2, vh2, err := differenceHash(img)
 
-	if vh1 != vh2 || hh1 != hh2 {
+	if len(vh2) != 1 || len(hh2) != 1 || vh1 != vh2[0] || hh1 != hh2[0] {
 		t.Fatalf("\nold hash: %d %d\nnew hash: %d %d\nerror: %s\n", vh1, hh1, vh2, hh2, err)
 	}
 }
+
+// Left half black and right half white should set exactly the bits of the right half.
+func TestAverageHash(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 4; x < 8; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+		}
+	}
+
+	ah, err := averageHash(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ah != 0xf0f0f0f0f0f0f0f0 {
+		t.Fatalf("unexpected average hash %016x", ah)
+	}
+}
+
+// The row-column DCT must match the direct 2D definition of the DCT-II.
+func TestDCT(t *testing.T) {
+	const n, keep = 8, 4
+	pixels := make([]float64, n*n)
+	for i := range pixels {
+		pixels[i] = float64(rand.Intn(256))
+	}
+
+	coeffs := dct2D(pixels, n, keep, dctTable(n))
+	for v := 0; v < keep; v++ {
+		for u := 0; u < keep; u++ {
+			var want float64
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					want += pixels[y*n+x] * math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*n)) * math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*n))
+				}
+			}
+
+			if got := coeffs[v*keep+u]; math.Abs(got-want) > 1e-6 {
+				t.Fatalf("coefficient (%d, %d) was %f, expected %f", u, v, got, want)
+			}
+		}
+	}
+}
+
+// A perceptual hash should be unaffected by a gamma and contrast change that keeps the ordering of pixels.
+func TestPerceptualHashContrast(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, phashSize, phashSize))
+	adjusted := image.NewNRGBA(img.Rect)
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			v := uint8((x*7 + y*3) % 200)
+			a := uint8(math.Pow(float64(v)/255, 0.8)*200 + 20)
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 0xff})
+			adjusted.SetNRGBA(x, y, color.NRGBA{R: a, G: a, B: a, A: 0xff})
+		}
+	}
+
+	h1, _ := perceptualHash(img)
+	h2, err := perceptualHash(adjusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := bits.OnesCount64(h1 ^ h2); d > 8 {
+		t.Fatalf("hashes differ by %d bits after a contrast change", d)
+	}
+}
+
+// The DC term is far larger than every other coefficient, so a hash that kept it would have the same bit set for almost
+// every image. No bit should be set in every one of a set of random images.
+func TestPerceptualHashBits(t *testing.T) {
+	always := ^uint64(0)
+	for i := 0; i < 32; i++ {
+		img := image.NewNRGBA(image.Rect(0, 0, phashSize, phashSize))
+		for p := range img.Pix {
+			img.Pix[p] = uint8(rand.Intn(256))
+		}
+
+		ph, err := perceptualHash(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		always &= ph
+	}
+
+	if always != 0 {
+		t.Fatalf("bits %016x were set in every hash", always)
+	}
+}
+
+// The top-left 8x8 block of a three level Haar decomposition of a 32x32 image is made up of the 8x8 block means and how
+// each block's halves compare, so every bit of the hash can be worked out from the pixels directly.
+func TestWaveletHash(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, whashSize, whashSize))
+	for y := 0; y < whashSize; y++ {
+		for x := 0; x < whashSize; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256)), A: 0xff})
+		}
+	}
+
+	wh, err := waveletHash(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sums of the top-left, top-right, bottom-left and bottom-right quarters of each 8x8 block
+	luma := luminance(img)
+	var quarters [16][4]int
+	for y := 0; y < whashSize; y++ {
+		for x := 0; x < whashSize; x++ {
+			quarters[(y/8)*4+x/8][(y%8/4)*2+x%8/4] += int(luma[y*whashSize+x])
+		}
+	}
+
+	means := make([]int, 16)
+	for b, q := range quarters {
+		means[b] = q[0] + q[1] + q[2] + q[3]
+	}
+
+	for b, q := range quarters {
+		bx, by := b%4, b/4
+		details := map[int]int{
+			by*8 + 4 + bx:     q[0] + q[2] - q[1] - q[3], // Left against right
+			(4+by)*8 + bx:     q[0] + q[1] - q[2] - q[3], // Top against bottom
+			(4+by)*8 + 4 + bx: q[0] + q[3] - q[1] - q[2], // Diagonals
+		}
+		for bit, d := range details {
+			if set := wh&(1<<uint(bit)) != 0; d != 0 && set != (d > 0) {
+				t.Fatalf("bit %d is %t for a detail of %d in block %d", bit, set, d, b)
+			}
+		}
+
+		for c, m := range means {
+			i, j := by*8+bx, (c/4)*8+c%4
+			if means[b] > m && wh&(1<<uint(j)) != 0 && wh&(1<<uint(i)) == 0 {
+				t.Fatalf("block %d is brighter than block %d but only the latter is set", b, c)
+			}
+		}
+	}
+}
+
+// Recompressing an image as a low quality JPEG must barely change its wavelet hash, while different images stay apart.
+func TestWaveletHashJPEG(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	opts := Options{Hasher: "whash", Filter: FilterBilinear}
+	for i := 0; i < 20; i++ {
+		img, other := blobImage(t, rng, 12, 256, 256), blobImage(t, rng, 12, 256, 256)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 20}); err != nil {
+			t.Fatal(err)
+		}
+		recompressed, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h1, err := HashImageWithOptions(img, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h2, _ := HashImageWithOptions(recompressed, opts)
+		h3, _ := HashImageWithOptions(other, opts)
+
+		if d := h1.Distance(h2); d > 4 {
+			t.Errorf("hashes differ by %d bits after recompression", d)
+		}
+		if d := h1.Distance(h3); d < 12 {
+			t.Errorf("different images are only %d bits apart", d)
+		}
+	}
+}
+
+// Larger difference hashes must be looked up by name and produce (w-1)*(h-1) bits in each direction.
+func TestDifferenceHashSize(t *testing.T) {
+	hasher, err := LookupHasher("dhash17x17")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, h := hasher.Size()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 15)
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 0xff})
+		}
+	}
+
+	hash, err := hasher.Hash(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hash.HHash) != 4 || hash.HHash.Count() != hasher.Bits()/2 || hash.VHash.Count() != 0 {
+		t.Fatalf("unexpected 17x17 hash V: %s, H: %s", hash.VHash, hash.HHash)
+	}
+
+	if _, err := LookupHasher("dhash1x17"); err == nil {
+		t.Fatal("expected an error looking up a 1x17 difference hash")
+	}
+}
+
+// Bits decided by nearly equal pixels must be masked, and ignored by MaskedDistance.
+func TestMaskedDifferenceHash(t *testing.T) {
+	hasher, err := LookupHasher(DefaultHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Columns step up by 1 in the left half and by 20 in the right, rows are all equal
+	w, h := hasher.Size()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(100 + x)
+			if x >= w/2 {
+				v = uint8(100 + w/2 + (x-w/2)*20)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 0xff})
+		}
+	}
+
+	hash, err := hasher.(MaskedHasher).HashMasked(img, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every vertical bit compares equal rows, and only the horizontal steps of 1 are too close to call
+	if hash.VMask.Count() != (w-1)*(h-1) || hash.HMask.Count() != (w/2)*(h-1) {
+		t.Fatalf("unexpected masks V: %s, H: %s", hash.VMask, hash.HMask)
+	}
+
+	// Flipping a masked bit mustn't change the masked distance, but flipping an unmasked one must
+	other := Hash{VHash: append(BitSet(nil), hash.VHash...), HHash: append(BitSet(nil), hash.HHash...)}
+	other.HHash[0] ^= 1
+	if d := hash.MaskedDistance(other); d != 0 {
+		t.Fatalf("masked distance was %d after flipping a masked bit", d)
+	}
+	other.HHash[0] ^= 1 << uint(w-2)
+	if d := hash.MaskedDistance(other); d != 1 {
+		t.Fatalf("masked distance was %d after flipping an unmasked bit, expected 1", d)
+	}
+
+	if _, err := hashScaled(img, averageHasher{}, Options{MaskThreshold: 5}); err == nil {
+		t.Fatal("expected an error masking a hasher that doesn't support masks")
+	}
+}
+
+// Returns the centre size*size pixels of an image rotated clockwise by deg degrees, so no empty corners are brought in.
+func rotateView(img *image.NRGBA, size int, deg float64) *image.NRGBA {
+	out := image.NewNRGBA(image.Rect(0, 0, size, size))
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	cx, cy := float64(img.Rect.Dx()-1)/2, float64(img.Rect.Dy()-1)/2
+	c := float64(size-1) / 2
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)-c, float64(y)-c
+			sx, sy := cx+dx*cos-dy*sin, cy+dx*sin+dy*cos
+			x0, y0 := int(sx), int(sy)
+			fx, fy := sx-float64(x0), sy-float64(y0)
+
+			for ch := 0; ch < 4; ch++ {
+				at := func(x, y int) float64 { return float64(img.Pix[img.PixOffset(x, y)+ch]) }
+				v := (at(x0, y0)*(1-fx)+at(x0+1, y0)*fx)*(1-fy) + (at(x0, y0+1)*(1-fx)+at(x0+1, y0+1)*fx)*fy
+				out.Pix[out.PixOffset(x, y)+ch] = uint8(v + 0.5)
+			}
+		}
+	}
+	return out
+}
+
+// The radial hash must stay close under rotations that break the difference hash, and still tell images apart.
+// Run with -v to see how each compares, as the fraction of bits that differ, averaged over random images.
+func TestRadialHashRotation(t *testing.T) {
+	const images = 20
+	angles := []float64{1, 5, 10, 20, 45}
+
+	mean := make(map[string][]float64)
+	for _, name := range []string{DefaultHasher, "rhash"} {
+		hasher, err := LookupHasher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			dists     = make([]float64, len(angles))
+			unrelated float64
+			hashes    []Hash
+			rotated   []Hash
+		)
+
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < images; i++ {
+			src := blobImage(t, rng, 12, 600, 600)
+			base, err := HashImageWithOptions(rotateView(src, 360, 0), Options{Hasher: name, Filter: FilterBilinear})
+			if err != nil {
+				t.Fatal(err)
+			}
+			base.Index = uint32(i)
+
+			for j, a := range angles {
+				h, err := HashImageWithOptions(rotateView(src, 360, a), Options{Hasher: name, Filter: FilterBilinear})
+				if err != nil {
+					t.Fatal(err)
+				}
+				dists[j] += float64(base.Distance(h)) / float64(hasher.Bits()*images)
+
+				if a == 10 {
+					rotated = append(rotated, h)
+				}
+			}
+
+			if i > 0 {
+				unrelated += float64(base.Distance(hashes[i-1])) / float64(hasher.Bits()*(images-1))
+			}
+			hashes = append(hashes, base)
+		}
+
+		t.Logf("%-6s rotated by %v: %.3f, unrelated: %.3f", name, angles, dists, unrelated)
+		mean[name] = append(dists, unrelated)
+
+		if name != "rhash" {
+			continue
+		}
+
+		// Every image rotated by 10 degrees must find its original first
+		tree, err := NewTreeWithHasher(append([]Hash(nil), hashes...), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range rotated {
+			if q := tree.NearestN(&rotated[i], 1); len(q) != 1 || q[0].Item.Index != uint32(i) {
+				t.Fatalf("image %d rotated by 10 degrees didn't find its original", i)
+			}
+		}
+	}
+
+	r, d := mean["rhash"], mean[DefaultHasher]
+	for j, a := range angles {
+		if a >= 5 && r[j] >= d[j] {
+			t.Fatalf("rhash differed by %.3f at %v degrees, more than dhash's %.3f", r[j], a, d[j])
+		}
+		if r[j] > 0.15 {
+			t.Fatalf("rhash differed by %.3f at %v degrees", r[j], a)
+		}
+	}
+	if r[len(angles)] < 0.35 {
+		t.Fatalf("unrelated rhashes only differed by %.3f", r[len(angles)])
+	}
+}
+
+// The diagonal hash compares each pixel to the one below and to the right of it, and counts towards the distance when
+// both hashes have one.
+func TestDiagonalHash(t *testing.T) {
+	// Brightness rises down and to the right everywhere except along the first row, which is brighter than anything
+	// below it, so only the first row's diagonal comparisons come out unset
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(10*x + 10*y)
+			if y == 0 {
+				v = uint8(250 - 10*x)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 0xff})
+		}
+	}
+
+	hash, err := HashImageWithOptions(img, Options{Filter: FilterBilinear, Diagonal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hash.DiagHash) != 1 || hash.DiagHash[0] != ^uint64(0xff) {
+		t.Fatalf("diagonal hash is %s, expected ffffffffffffff00", hash.DiagHash)
+	}
+
+	flipped := hash
+	flipped.DiagHash = BitSet{hash.DiagHash[0] ^ 0xf}
+	if d := hash.Distance(flipped); d != 4 {
+		t.Errorf("flipping 4 diagonal bits changed the distance by %d", d)
+	}
+	if d := hash.MaskedDistance(flipped); d != 4 {
+		t.Errorf("flipping 4 diagonal bits changed the masked distance by %d", d)
+	}
+	if d := (WeightedMetric{Vertical: 1, Horizontal: 1}).Distance(&hash, &flipped); d != 0 {
+		t.Errorf("a metric without diagonal weight gave a distance of %d", d)
+	}
+
+	// A hash without a diagonal says nothing about it, so its set bits aren't counted against the other
+	plain := hash
+	plain.DiagHash = nil
+	for name, m := range map[string]Metric{"sum": SumMetric{}, "masked": MaskedMetric{}, "max": MaxMetric{}, "weighted": WeightedMetric{1, 1, 1}} {
+		if d := m.Distance(&hash, &plain); d != 0 {
+			t.Errorf("dropping the diagonal gave a %s distance of %d", name, d)
+		}
+	}
+
+	with, without := NewFile(), NewFile()
+	with.hashes, without.hashes = []Hash{hash}, []Hash{plain}
+	if _, err := NewTreeFromFiles(with, without); err == nil {
+		t.Error("built a tree mixing hashes with and without diagonals")
+	}
+
+	if _, err := HashImageWithOptions(img, Options{Hasher: "ahash", Filter: FilterBilinear, Diagonal: true}); err == nil {
+		t.Error("hashed a diagonal with the average hasher")
+	}
+}
@@ -0,0 +1,292 @@
+package imghash
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The name of the hasher used when none is provided, and the one assumed for files written before hashers were recorded.
+const DefaultHasher = "dhash"
+
+// Hasher is implemented by every hashing algorithm that can be stored in a File or searched in a Tree.
+type Hasher interface {
+	// Name returns the unique name the hasher is registered and stored under.
+	Name() string
+
+	// Bits returns the number of bits in a single hash, used to bound the distance between two hashes.
+	Bits() int
+
+	// Size returns the dimensions an image must be scaled to before it is passed to Hash.
+	Size() (width, height int)
+
+	// Hash computes the hash of an image that has already been scaled to Size, see HashImage to hash an image of any size.
+	Hash(img image.Image) (Hash, error)
+}
+
+// MaskedHasher is implemented by hashers that can also mark which bits of a hash are unstable, filling in
+// Hash.VMask and Hash.HMask. Bits are unstable when the values they were decided by differ by less than threshold.
+type MaskedHasher interface {
+	Hasher
+
+	HashMasked(img image.Image, threshold uint8) (Hash, error)
+}
+
+// Implemented by the hashers here that only look at the luma of an image, so hashScaled can work it out once for the
+// hash, the diagonal and the information score. luma holds every pixel of an image of the hasher's Size, row by row.
+// Masks are only filled in by hashers that are also a MaskedHasher.
+type lumaHasher interface {
+	hashLumaPixels(luma []uint8, threshold uint8) Hash
+}
+
+// Hashes an image already scaled to the hasher's size, including masks and colour if the options ask for them.
+func hashScaled(img image.Image, hasher Hasher, opts Options) (hash Hash, err error) {
+	if _, ok := hasher.(MaskedHasher); opts.MaskThreshold > 0 && !ok {
+		return Hash{}, errors.Errorf("%s hashes don't support masks", hasher.Name())
+	}
+
+	nrgba := toNRGBA(img)
+	dx, dy := nrgba.Rect.Dx(), nrgba.Rect.Dy()
+
+	// Hashers that don't take luma directly work it out for themselves, so it is only needed again for the score
+	var luma []uint8
+	if l, ok := hasher.(lumaHasher); ok {
+		if w, h := hasher.Size(); dx != w || dy != h {
+			return Hash{}, errors.Errorf("Invalid dimensions %dx%d, must be a %dx%d image", dx, dy, w, h)
+		}
+		luma = luminance(nrgba)
+		hash = l.hashLumaPixels(luma, opts.MaskThreshold)
+	} else if opts.MaskThreshold == 0 {
+		hash, err = hasher.Hash(nrgba)
+	} else {
+		hash, err = hasher.(MaskedHasher).HashMasked(nrgba, opts.MaskThreshold)
+	}
+
+	if err != nil {
+		return Hash{}, err
+	} else if luma == nil {
+		luma = luminance(nrgba)
+	}
+
+	if opts.Colour {
+		hash.CbHash, hash.CrHash = chromaHash(nrgba)
+	}
+
+	if opts.Diagonal {
+		if _, ok := hasher.(differenceHasher); !ok {
+			return Hash{}, errors.Errorf("%s hashes don't have a diagonal direction", hasher.Name())
+		}
+		hash.DiagHash = diagonalHashLuma(luma, dx, dy)
+	}
+
+	hash.Information = informationScore(luma, &hash, hasher.Bits())
+	return hash, nil
+}
+
+// Returned if a hasher name is not present in the registry.
+type UnknownHasher struct{ name string }
+
+func (u UnknownHasher) Error() string { return "Unknown Hasher: " + u.name }
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = make(map[string]Hasher)
+)
+
+// Registers a hasher so it can be looked up by name, panicking if the name is invalid or already registered.
+func RegisterHasher(h Hasher) {
+	name := h.Name()
+	if name == "" || len(name) > 255 {
+		panic("imghash: hasher name must be between 1 and 255 bytes")
+	}
+
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+
+	if _, ok := hashers[name]; ok {
+		panic("imghash: hasher " + name + " registered twice")
+	}
+	hashers[name] = h
+}
+
+// Returns the hasher registered under name, or an error of type UnknownHasher if there is none.
+func LookupHasher(name string) (Hasher, error) {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+
+	if h, ok := hashers[name]; ok {
+		return h, nil
+	}
+
+	if h, ok := parseDifferenceHasher(name); ok {
+		return h, nil
+	}
+
+	if h, ok := parseImagehashHasher(name); ok {
+		return h, nil
+	}
+	return nil, UnknownHasher{name: name}
+}
+
+// Returns the names of all registered hashers in sorted order.
+func Hashers() []string {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The difference hash, storing one bit per vertical and horizontal neighbour comparison of a w*h image.
+type differenceHasher struct{ w, h int }
+
+// Returns a difference hasher for images scaled to width x height, giving (width-1)*(height-1) bits per direction.
+// The default 9x9 hasher is named "dhash", any other size is named "dhash<width>x<height>", such as "dhash17x17".
+// Every size can be looked up by name without registering it first.
+func NewDifferenceHasher(width, height int) (Hasher, error) {
+	if width < 2 || height < 2 {
+		return nil, errors.Errorf("difference hash size must be at least 2x2, not %dx%d", width, height)
+	}
+	return differenceHasher{width, height}, nil
+}
+
+func (d differenceHasher) Name() string {
+	if d.w == width && d.h == height {
+		return DefaultHasher
+	}
+	return fmt.Sprintf("%s%dx%d", DefaultHasher, d.w, d.h)
+}
+
+func (d differenceHasher) Bits() int        { return 2 * (d.w - 1) * (d.h - 1) }
+func (d differenceHasher) Size() (int, int) { return d.w, d.h }
+
+func (d differenceHasher) Hash(img image.Image) (Hash, error) {
+	return d.HashMasked(img, 0)
+}
+
+func (d differenceHasher) HashMasked(img image.Image, threshold uint8) (Hash, error) {
+	if dx, dy := img.Bounds().Dx(), img.Bounds().Dy(); dx != d.w || dy != d.h {
+		return Hash{}, errors.Errorf("Invalid dimensions %dx%d, must be a %dx%d image", dx, dy, d.w, d.h)
+	}
+	nrgba := toNRGBA(img)
+
+	hh, vh, hm, vm, err := maskedDifferenceHash(nrgba, threshold)
+	return Hash{VHash: vh, HHash: hh, VMask: vm, HMask: hm}, err
+}
+
+func (d differenceHasher) hashLumaPixels(luma []uint8, threshold uint8) Hash {
+	n := (d.w - 1) * (d.h - 1)
+	hash := Hash{VHash: NewBitSet(n), HHash: NewBitSet(n)}
+	if threshold > 0 {
+		hash.VMask, hash.HMask = NewBitSet(n), NewBitSet(n)
+	}
+
+	differenceHashLuma(luma, d.w, d.h, threshold, hash.HHash, hash.VHash, hash.HMask, hash.VMask)
+	return hash
+}
+
+// Parses the name of a difference hasher of any size, returning false if the name isn't one.
+func parseDifferenceHasher(name string) (Hasher, bool) {
+	var w, h int
+	if n, err := fmt.Sscanf(name, DefaultHasher+"%dx%d", &w, &h); err != nil || n != 2 {
+		return nil, false
+	}
+
+	d, err := NewDifferenceHasher(w, h)
+	if err != nil || d.Name() != name {
+		return nil, false
+	}
+	return d, true
+}
+
+// The 8x8 average hash, storing one bit per pixel depending on whether it is brighter than the mean.
+type averageHasher struct{}
+
+func (averageHasher) Name() string     { return "ahash" }
+func (averageHasher) Bits() int        { return 64 }
+func (averageHasher) Size() (int, int) { return 8, 8 }
+
+func (averageHasher) Hash(img image.Image) (Hash, error) {
+	nrgba := toNRGBA(img)
+
+	ah, err := averageHash(nrgba)
+	return Hash{VHash: BitSet{ah}}, err
+}
+
+func (averageHasher) hashLumaPixels(luma []uint8, _ uint8) Hash {
+	return Hash{VHash: BitSet{averageHashLuma(luma)}}
+}
+
+// The DCT based perceptual hash, storing one bit per low frequency coefficient of a 32x32 image.
+type perceptualHasher struct{}
+
+func (perceptualHasher) Name() string     { return "phash" }
+func (perceptualHasher) Bits() int        { return phashBlock * phashBlock }
+func (perceptualHasher) Size() (int, int) { return phashSize, phashSize }
+
+func (perceptualHasher) Hash(img image.Image) (Hash, error) {
+	nrgba := toNRGBA(img)
+
+	ph, err := perceptualHash(nrgba)
+	return Hash{VHash: BitSet{ph}}, err
+}
+
+func (perceptualHasher) hashLumaPixels(luma []uint8, _ uint8) Hash {
+	return Hash{VHash: BitSet{perceptualHashLuma(luma)}}
+}
+
+// The Haar wavelet hash, storing one bit per coefficient of the coarsest level of a multi-level decomposition.
+type waveletHasher struct{}
+
+func (waveletHasher) Name() string     { return "whash" }
+func (waveletHasher) Bits() int        { return 64 }
+func (waveletHasher) Size() (int, int) { return whashSize, whashSize }
+
+func (waveletHasher) Hash(img image.Image) (Hash, error) {
+	nrgba := toNRGBA(img)
+
+	wh, err := waveletHash(nrgba)
+	return Hash{VHash: BitSet{wh}}, err
+}
+
+func (waveletHasher) hashLumaPixels(luma []uint8, _ uint8) Hash {
+	return Hash{VHash: BitSet{waveletHashLuma(luma)}}
+}
+
+// The radial variance hash, storing one bit per low frequency DCT coefficient of the variance of Radon projections.
+// Unlike the others it tolerates small rotations of any angle, see radialHash.
+type radialHasher struct{}
+
+func (radialHasher) Name() string     { return "rhash" }
+func (radialHasher) Bits() int        { return rhashCoeffs }
+func (radialHasher) Size() (int, int) { return rhashSize, rhashSize }
+
+func (radialHasher) Hash(img image.Image) (Hash, error) {
+	nrgba := toNRGBA(img)
+
+	rh, err := radialHash(nrgba)
+	return Hash{VHash: BitSet{rh}}, err
+}
+
+func (radialHasher) hashLumaPixels(luma []uint8, _ uint8) Hash {
+	return Hash{VHash: BitSet{radialHashLuma(luma)}}
+}
+
+func init() {
+	RegisterHasher(differenceHasher{width, height})
+	RegisterHasher(averageHasher{})
+	RegisterHasher(perceptualHasher{})
+	RegisterHasher(waveletHasher{})
+	RegisterHasher(radialHasher{})
+
+	for _, a := range imagehashAlgorithms {
+		RegisterHasher(imagehashHasher{a, 8})
+	}
+}
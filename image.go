@@ -0,0 +1,246 @@
+package imghash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/pkg/errors"
+)
+
+// HashImage scales an image of any size with FilterBilinear and hashes it with the default hasher, entirely in memory.
+// The result is the same as the hash NewFromPath gives a still image with that filter. Files hashed with the default
+// FilterFFmpeg scale images slightly differently, so queries against them come close but aren't exact.
+func HashImage(img image.Image) (Hash, error) {
+	return HashImageWithOptions(img, Options{Filter: FilterBilinear})
+}
+
+// Identical to HashImage, but hashes using the provided options. Images in memory are never handed to ffmpeg, so
+// Options.Filter has to be one that scales in Go rather than the default FilterFFmpeg.
+// Returns an error of type UnknownHasher if no hasher is registered under the name in the options.
+func HashImageWithOptions(img image.Image, opts Options) (Hash, error) {
+	if opts.Hasher == "" {
+		opts.Hasher = DefaultHasher
+	}
+
+	hasher, err := LookupHasher(opts.Hasher)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	if err := opts.validateInMemory(); err != nil {
+		return Hash{}, err
+	}
+
+	hash, _, err := hashImage(img, hasher, opts)
+	return hash, err
+}
+
+// HashImageOriented is identical to HashImageWithOptions, but hashes all eight orientations of the image so it can
+// be matched against mirrored and rotated copies. Only hashers with a square size can be used, and tiles aren't hashed.
+// Like HashImageWithOptions, the options need a filter that scales in Go.
+func HashImageOriented(img image.Image, opts Options) (*OrientedHash, error) {
+	if opts.Hasher == "" {
+		opts.Hasher = DefaultHasher
+	}
+
+	hasher, err := LookupHasher(opts.Hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.validateInMemory(); err != nil {
+		return nil, err
+	}
+
+	scaled, _, err := scaleImage(img, hasher, opts)
+	if err != nil {
+		return nil, err
+	}
+	return orientedHash(scaled, hasher, opts)
+}
+
+// Returns an error if the options are invalid or ask for an image in memory to be scaled by ffmpeg, which would mean
+// writing it out for another process to read back.
+func (opts Options) validateInMemory() error {
+	if opts.Filter == FilterFFmpeg {
+		return errors.New("images in memory can't be scaled by ffmpeg, only with a filter that scales in Go")
+	}
+	return opts.validate()
+}
+
+// Hashes an image the same way NewFromPath would, also returning the area of the image that was
+// hashed if it was automatically cropped, relative to the image's bounds.
+func hashImage(img image.Image, hasher Hasher, opts Options) (Hash, image.Rectangle, error) {
+	img, crop := prepareImage(img, opts)
+
+	w, h := hasher.Size()
+	scaled, err := scaleForHash(img, w, h, opts)
+	if err != nil {
+		return Hash{}, crop, err
+	}
+
+	hash, err := hashScaled(scaled, hasher, opts)
+	if err != nil {
+		return hash, crop, err
+	}
+
+	// Hashers that scale images themselves replace the main planes, colour and tiles still come from the usual scaling.
+	// Masks and the information score describe the main planes, so they have to come from the same pixels.
+	if src, ok := hasher.(SourceHasher); ok && len(opts.Preprocess) == 0 {
+		exact, err := src.HashSource(img)
+		if err != nil {
+			return Hash{}, crop, errors.Wrap(err, "creating hash")
+		}
+		hash.VHash, hash.HHash = exact.VHash, exact.HHash
+		hash.VMask, hash.HMask = exact.VMask, exact.HMask
+		hash.Information = exact.Information
+	}
+
+	// Keypoints are positioned in the original image, even when it was cropped
+	if opts.Features > 0 {
+		if hash.Features, err = DetectFeatures(img, opts.Features); err != nil {
+			return Hash{}, crop, errors.Wrap(err, "detecting features")
+		}
+	}
+
+	if opts.Tiles == 0 {
+		return hash, crop, nil
+	}
+
+	c := tileCanvas(opts.Tiles)
+	canvas, err := scaleForHash(img, c, c, opts)
+	if err != nil {
+		return Hash{}, crop, err
+	}
+
+	hash.Tiles, err = tileHashes(canvas, opts.Tiles)
+	return hash, crop, err
+}
+
+// Prepares an image and scales it to the size the hasher expects, returning the area it was cropped to if any.
+func scaleImage(img image.Image, hasher Hasher, opts Options) (*image.NRGBA, image.Rectangle, error) {
+	img, crop := prepareImage(img, opts)
+
+	w, h := hasher.Size()
+	scaled, err := scaleForHash(img, w, h, opts)
+	return scaled, crop, err
+}
+
+// Composites and crops an image as the options ask for, returning the area it was cropped to if any.
+func prepareImage(img image.Image, opts Options) (image.Image, image.Rectangle) {
+	// Compositing has to happen at full resolution, otherwise the colour of transparent pixels bleeds into the rest
+	if opts.Background.Mode != BackgroundNone {
+		img = opts.Background.composite(toNRGBA(img))
+	}
+
+	var crop image.Rectangle
+	if opts.AutoCrop {
+		nrgba := toNRGBA(img)
+		crop = detectBorders(nrgba)
+		img = nrgba.SubImage(crop)
+	}
+	return img, crop
+}
+
+// Scales an image to w*h to be hashed, running the preprocessing chain in the options over it along the way.
+func scaleForHash(img image.Image, w, h int, opts Options) (*image.NRGBA, error) {
+	k := opts.Preprocess.scale()
+	scaled, err := resizeImage(img, w*k, h*k, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	scaled, err = opts.Preprocess.finish(scaled, w, h, opts.Filter)
+	return scaled, errors.Wrap(err, "preprocessing image")
+}
+
+// Scales an image to the given size, returning it as is if it is already that size.
+func resizeImage(img image.Image, w, h int, filter Filter) (*image.NRGBA, error) {
+	if b := img.Bounds(); b.Dx() == w && b.Dy() == h {
+		return toNRGBA(img), nil
+	}
+
+	scaled, err := Resize(img, w, h, filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "scaling image")
+	}
+	return scaled, nil
+}
+
+// Converts any image to an NRGBA image whose bounds start at the origin, returning it as is if it already is one.
+// The common decoded formats are converted directly, everything else goes through the much slower draw package.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if src, ok := img.(*image.NRGBA); ok && src.Rect.Min == (image.Point{}) {
+		return src
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	switch src := img.(type) {
+	case *image.NRGBA:
+		for y := 0; y < b.Dy(); y++ {
+			copy(dst.Pix[y*dst.Stride:(y+1)*dst.Stride], src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):])
+		}
+	case *image.YCbCr:
+		for y := 0; y < b.Dy(); y++ {
+			row := dst.Pix[y*dst.Stride:]
+			for x := 0; x < b.Dx(); x++ {
+				yi := src.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := src.COffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = r, g, bl, 0xff
+			}
+		}
+	case *image.Gray:
+		for y := 0; y < b.Dy(); y++ {
+			row, in := dst.Pix[y*dst.Stride:], src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < b.Dx(); x++ {
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = in[x], in[x], in[x], 0xff
+			}
+		}
+	case *image.RGBA:
+		for y := 0; y < b.Dy(); y++ {
+			row, in := dst.Pix[y*dst.Stride:], src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < 4*b.Dx(); x += 4 {
+				unpremultiply(row[x:x+4], in[x:x+4])
+			}
+		}
+	case *image.Paletted:
+		palette := make([][4]uint8, len(src.Palette))
+		for i, c := range src.Palette {
+			n := color.NRGBAModel.Convert(c).(color.NRGBA)
+			palette[i] = [4]uint8{n.R, n.G, n.B, n.A}
+		}
+
+		for y := 0; y < b.Dy(); y++ {
+			row, in := dst.Pix[y*dst.Stride:], src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < b.Dx(); x++ {
+				// Indices outside the palette are treated as transparent black, like the standard library does
+				if int(in[x]) < len(palette) {
+					copy(row[4*x:4*x+4], palette[in[x]][:])
+				}
+			}
+		}
+	default:
+		draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	}
+
+	return dst
+}
+
+// Converts a premultiplied RGBA pixel to a non-premultiplied one, rounding the same way color.NRGBAModel does.
+func unpremultiply(dst, src []uint8) {
+	switch a := uint32(src[3]) * 0x101; a {
+	case 0xffff:
+		copy(dst, src[:4])
+	case 0:
+		dst[0], dst[1], dst[2], dst[3] = 0, 0, 0, 0
+	default:
+		for c := 0; c < 3; c++ {
+			dst[c] = uint8((uint32(src[c]) * 0x101 * 0xffff / a) >> 8)
+		}
+		dst[3] = src[3]
+	}
+}
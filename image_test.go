@@ -0,0 +1,231 @@
+package imghash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+// Fills an image with random colours drawn from rng through the generic Set method.
+func randomImage(rng *rand.Rand, img draw.Image) draw.Image {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			img.Set(x, y, color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))})
+		}
+	}
+	return img
+}
+
+// Returns an opaque image of smooth blobs, made by scaling random colours drawn from rng on a cells by cells grid up to
+// w by h. This is the one random picture the tests build on, and like every other test image it draws from a source
+// the test seeds, so it is the same on every run. Fewer cells give larger blobs, which survive being shifted a few
+// pixels.
+func blobImage(t *testing.T, rng *rand.Rand, cells, w, h int) *image.NRGBA {
+	t.Helper()
+
+	small := image.NewNRGBA(image.Rect(0, 0, cells, cells))
+	for i := 0; i < len(small.Pix); i += 4 {
+		small.Pix[i], small.Pix[i+1], small.Pix[i+2], small.Pix[i+3] = uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff
+	}
+
+	img, err := Resize(small, w, h, FilterBilinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// The fast conversion paths must give exactly the same pixels as the draw package.
+func TestToNRGBA(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rect := image.Rect(3, 5, 40, 31)
+
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(rng.Intn(256))
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(rng.Intn(256)), uint8(rng.Intn(256))
+	}
+
+	images := map[string]image.Image{
+		"nrgba":    randomImage(rng, image.NewNRGBA(rect)),
+		"rgba":     randomImage(rng, image.NewRGBA(rect)),
+		"gray":     randomImage(rng, image.NewGray(rect)),
+		"paletted": randomImage(rng, image.NewPaletted(rect, palette.Plan9)),
+		"ycbcr":    ycbcr,
+		"cmyk":     randomImage(rng, image.NewCMYK(rect)),
+	}
+
+	for name, img := range images {
+		want := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		draw.Draw(want, want.Rect, img, rect.Min, draw.Src)
+
+		if got := toNRGBA(img); !bytes.Equal(got.Pix, want.Pix) || got.Rect != want.Rect {
+			t.Fatalf("%s: converted pixels differ from the draw package", name)
+		}
+	}
+
+	// An image that is already NRGBA at the origin is returned as is, without allocating a frame for nothing
+	nrgba := randomImage(rng, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+	if allocs := testing.AllocsPerRun(10, func() { toNRGBA(nrgba) }); allocs != 0 {
+		t.Errorf("converting an NRGBA image allocated %.0f times", allocs)
+	}
+}
+
+// Hashing an image in memory must give the same hash as scaling it and hashing it by hand.
+func TestHashImage(t *testing.T) {
+	img := randomImage(rand.New(rand.NewSource(1)), image.NewRGBA(image.Rect(0, 0, 120, 80)))
+
+	hash, err := HashImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scaled, err := Resize(img, width, height, FilterBilinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hh, vh, _ := differenceHash(scaled)
+	if !hash.Equal(Hash{VHash: vh, HHash: hh}) {
+		t.Fatalf("HashImage gave V: %s, H: %s, expected V: %s, H: %s", hash.VHash, hash.HHash, vh, hh)
+	}
+
+	if _, err := HashImageWithOptions(img, Options{Hasher: "nope", Filter: FilterBilinear}); err == nil {
+		t.Fatal("expected an error hashing with an unknown hasher")
+	}
+}
+
+// Grayscale copies must only differ from the original in colour, and only count when colour is required.
+func TestColourHash(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 90, 90))
+	gray := image.NewNRGBA(img.Rect)
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 90; x++ {
+			c := color.NRGBA{R: uint8(x * 2), G: uint8(y), B: uint8(255 - x*2), A: 0xff}
+			v := rgbToY(c.R, c.G, c.B)
+			img.SetNRGBA(x, y, c)
+			gray.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 0xff})
+		}
+	}
+
+	hash, err := HashImageWithOptions(img, Options{Filter: FilterBilinear, Colour: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grayHash, err := HashImageWithOptions(gray, Options{Filter: FilterBilinear, Colour: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Red rises and blue falls from left to right, so every Cr bit is set and no Cb bits are
+	if bits := (width - 1) * height; hash.CrHash.Count() != bits || hash.CbHash.Count() != 0 {
+		t.Fatalf("unexpected chroma hashes Cb: %s, Cr: %s", hash.CbHash, hash.CrHash)
+	}
+	if grayHash.CbHash.Count() != 0 || grayHash.CrHash.Count() != 0 {
+		t.Fatalf("grayscale image has chroma hashes Cb: %s, Cr: %s", grayHash.CbHash, grayHash.CrHash)
+	}
+
+	luma := hash.Distance(grayHash)
+	if d := hash.DistanceWithColour(grayHash, ColourIgnore); d != luma {
+		t.Fatalf("distance ignoring colour was %d, expected %d", d, luma)
+	}
+	if d := hash.DistanceWithColour(grayHash, ColourRequire); d != luma+hash.CrHash.Count() {
+		t.Fatalf("distance requiring colour was %d, expected %d", d, luma+hash.CrHash.Count())
+	}
+
+	tree := NewTree([]Hash{grayHash})
+	if err := tree.SetColourMode(ColourRequire); err != nil {
+		t.Fatal(err)
+	}
+	if q := tree.NearestDist(&hash, luma); len(q) != 0 {
+		t.Fatalf("found %d results requiring colour, expected none", len(q))
+	}
+	if err := tree.SetColourMode(ColourIgnore); err != nil {
+		t.Fatal(err)
+	}
+	if q := tree.NearestDist(&hash, luma); len(q) != 1 {
+		t.Fatalf("found %d results ignoring colour, expected 1", len(q))
+	}
+}
+
+// Transparent pixels must take the background colour regardless of the colour they hold, and opaque ones keep theirs.
+func TestBackground(t *testing.T) {
+	img := randomImage(rand.New(rand.NewSource(1)), image.NewNRGBA(image.Rect(0, 0, 16, 16))).(*image.NRGBA)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0
+	}
+	img.SetNRGBA(0, 0, color.NRGBA{10, 20, 30, 0xff})
+
+	solid := Background{Mode: BackgroundSolid, Color: color.NRGBA{R: 0xff, G: 0xff, B: 0xff}}
+	out := solid.composite(img)
+	if c := out.NRGBAAt(0, 0); c != (color.NRGBA{10, 20, 30, 0xff}) {
+		t.Fatalf("opaque pixel became %v", c)
+	}
+	if c := out.NRGBAAt(5, 9); c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("transparent pixel became %v", c)
+	}
+
+	checker := Background{Mode: BackgroundCheckerboard, Alt: color.NRGBA{R: 0xff, G: 0xff, B: 0xff}, Cells: 2}
+	out = checker.composite(img)
+	if c := out.NRGBAAt(12, 3); c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("top right cell was %v", c)
+	}
+	if c := out.NRGBAAt(12, 12); c != (color.NRGBA{0, 0, 0, 0xff}) {
+		t.Fatalf("bottom right cell was %v", c)
+	}
+
+	// Two images that only differ in their transparent pixels must hash the same
+	other := image.NewNRGBA(img.Rect)
+	copy(other.Pix, img.Pix)
+	for i := 4; i < len(other.Pix); i += 4 {
+		other.Pix[i] ^= 0xff
+	}
+
+	h1, _ := HashImageWithOptions(img, Options{Filter: FilterBilinear, Background: solid})
+	h2, err := HashImageWithOptions(other, Options{Filter: FilterBilinear, Background: solid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h1.Equal(h2) {
+		t.Fatal("transparent pixels changed the hash")
+	}
+}
+
+// Letterboxing and pillarboxing must be cropped off, and must not change the hash of the picture inside.
+func TestDetectBorders(t *testing.T) {
+	picture := randomImage(rand.New(rand.NewSource(1)), image.NewNRGBA(image.Rect(0, 0, 64, 36)))
+	for i := 3; i < len(picture.(*image.NRGBA).Pix); i += 4 {
+		picture.(*image.NRGBA).Pix[i] = 0xff
+	}
+	picture.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{0xff, 0xff, 0xff, 0xff}) // Keep the edges from looking like a bar
+
+	boxed := image.NewNRGBA(image.Rect(0, 0, 80, 60))
+	draw.Draw(boxed, boxed.Rect, image.Black, image.Point{}, draw.Src)
+	draw.Draw(boxed, image.Rect(8, 12, 72, 48), picture, image.Point{}, draw.Src)
+
+	if r := DetectBorders(boxed); r != image.Rect(8, 12, 72, 48) {
+		t.Fatalf("detected %v, expected %v", r, image.Rect(8, 12, 72, 48))
+	}
+
+	if r := DetectBorders(image.NewGray(image.Rect(2, 2, 10, 10))); r != image.Rect(2, 2, 10, 10) {
+		t.Fatalf("a black image should not be cropped, but was cropped to %v", r)
+	}
+
+	h1, _ := HashImage(picture)
+	h2, err := HashImageWithOptions(boxed, Options{Filter: FilterBilinear, AutoCrop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h1.Equal(h2) {
+		t.Fatalf("cropped hash %s %s differs from the original %s %s", h2.VHash, h2.HHash, h1.VHash, h1.HHash)
+	}
+}
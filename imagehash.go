@@ -0,0 +1,385 @@
+package imghash
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The prefix of every hasher that reproduces a hash from Python's imagehash library.
+const imagehashPrefix = "imagehash-"
+
+// The imagehash algorithms, in the order their names are matched, so the longer vertical dhash comes first.
+var imagehashAlgorithms = []string{"dhash-vertical", "dhash", "ahash", "phash"}
+
+// SourceHasher is implemented by hashers that have to scale images themselves, such as those matching another
+// library's resize exactly. HashImage and NewFromPath pass still images to HashSource at full resolution when no
+// preprocessing chain is set. NewFromPath does so even with FilterFFmpeg, scaling the rest of the hash with
+// FilterBilinear and recording that instead. Everything else, like video frames and windows, still goes through Hash.
+// The hash returned replaces the main planes along with their masks and Information, so it has to fill in the score
+// itself from the pixels it hashed.
+type SourceHasher interface {
+	Hasher
+
+	HashSource(img image.Image) (Hash, error)
+}
+
+// A port of Python's imagehash library that aims to give the same bits for the same pixels, with the hash stored in
+// VHash. TestImagehashFixture checks it against the hashes testdata/imagehash/expected.txt records for a fixture
+// image. imagehash flattens its boolean array row by row and prints the first element as the most significant bit, so
+// element i of an n bit hash is stored as bit n-1-i. That way BitSet.String gives imagehash's hex for hashes of up to
+// 64 bits, and FormatImagehash does for any size.
+type imagehashHasher struct {
+	algo string
+	size int
+}
+
+// Returns a hasher reproducing one of imagehash's ahash, dhash, dhash_vertical or phash functions, called with
+// hash_size set to size. The algorithm is named as imagehash does, except for "dhash-vertical". Hashers for the default
+// size of 8 are named "imagehash-<algorithm>", any other size is named "imagehash-<algorithm><size>", such as
+// "imagehash-phash16". Every size can be looked up by name without registering it first.
+func NewImagehashHasher(algorithm string, size int) (Hasher, error) {
+	if size < 2 {
+		return nil, errors.Errorf("imagehash size must be at least 2, not %d", size)
+	}
+
+	algorithm = strings.Replace(algorithm, "_", "-", 1)
+	for _, a := range imagehashAlgorithms {
+		if a == algorithm {
+			return imagehashHasher{a, size}, nil
+		}
+	}
+	return nil, errors.Errorf("unknown imagehash algorithm %q", algorithm)
+}
+
+func (i imagehashHasher) Name() string {
+	if i.size == 8 {
+		return imagehashPrefix + i.algo
+	}
+	return fmt.Sprintf("%s%s%d", imagehashPrefix, i.algo, i.size)
+}
+
+func (i imagehashHasher) Bits() int { return i.size * i.size }
+
+func (i imagehashHasher) Size() (int, int) {
+	switch i.algo {
+	case "dhash":
+		return i.size + 1, i.size
+	case "dhash-vertical":
+		return i.size, i.size + 1
+	case "phash":
+		return 4 * i.size, 4 * i.size
+	}
+	return i.size, i.size
+}
+
+// Hashes an image that was already scaled to Size by this package's own resize, which is only as close to imagehash
+// as the two resizes are. Video frames and sliding windows are hashed this way.
+func (i imagehashHasher) Hash(img image.Image) (Hash, error) {
+	w, h := i.Size()
+	if dx, dy := img.Bounds().Dx(), img.Bounds().Dy(); dx != w || dy != h {
+		return Hash{}, errors.Errorf("Invalid dimensions %dx%d, must be a %dx%d image", dx, dy, w, h)
+	}
+	return Hash{VHash: i.hashLuma(luminance(toNRGBA(img)))}, nil
+}
+
+func (i imagehashHasher) hashLumaPixels(luma []uint8, _ uint8) Hash {
+	return Hash{VHash: i.hashLuma(luma)}
+}
+
+// Hashes an image of any size the way imagehash does: converting it to Pillow's "L" mode, resizing it with Pillow's
+// LANCZOS filter and hashing the result. The hash should be bit-identical as long as both sides start from the same
+// 8 bit RGB pixels, which isn't guaranteed for JPEGs since Go's decoder and libjpeg can round differently.
+func (i imagehashHasher) HashSource(img image.Image) (Hash, error) {
+	nrgba := toNRGBA(img)
+	dx, dy := nrgba.Rect.Dx(), nrgba.Rect.Dy()
+	if dx == 0 || dy == 0 {
+		return Hash{}, errors.New("can't hash an empty image")
+	}
+
+	w, h := i.Size()
+	luma := pillowResize(luminance(nrgba), dx, dy, w, h)
+	hash := Hash{VHash: i.hashLuma(luma)}
+	hash.Information = informationScore(luma, &hash, i.Bits())
+	return hash, nil
+}
+
+// Hashes luma scaled to Size, following imagehash's functions line for line.
+func (i imagehashHasher) hashLuma(pix []uint8) BitSet {
+	n := i.size
+	bits := NewBitSet(n * n)
+	set := func(e int) { bits.Set(n*n - 1 - e) }
+
+	switch i.algo {
+	case "ahash":
+		var sum int
+		for _, p := range pix {
+			sum += int(p)
+		}
+
+		avg := float64(sum) / float64(len(pix))
+		for e, p := range pix {
+			if float64(p) > avg {
+				set(e)
+			}
+		}
+	case "dhash":
+		for y := 0; y < n; y++ {
+			row := pix[y*(n+1) : (y+1)*(n+1)]
+			for x := 0; x < n; x++ {
+				if row[x+1] > row[x] {
+					set(y*n + x)
+				}
+			}
+		}
+	case "dhash-vertical":
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				if pix[(y+1)*n+x] > pix[y*n+x] {
+					set(y*n + x)
+				}
+			}
+		}
+	case "phash":
+		size := 4 * n
+		table := phashTable
+		if size != phashSize {
+			table = dctTable(size)
+		}
+
+		pixels := make([]float64, len(pix))
+		for e, p := range pix {
+			pixels[e] = float64(p)
+		}
+
+		// The DCT is separable, so dct2D's rows then columns give the same coefficients as scipy's columns then rows,
+		// up to floating point rounding. That only matters for coefficients tied with the median, as in flat images.
+		coeffs := dct2D(pixels, size, n, table)
+		sorted := append([]float64(nil), coeffs...)
+		sort.Float64s(sorted)
+
+		med := sorted[len(sorted)/2]
+		if len(sorted)%2 == 0 {
+			med = (sorted[len(sorted)/2-1] + med) / 2
+		}
+
+		for e, c := range coeffs {
+			if c > med {
+				set(e)
+			}
+		}
+	}
+	return bits
+}
+
+// Parses the name of an imagehash hasher of any size, returning false if the name isn't one.
+func parseImagehashHasher(name string) (Hasher, bool) {
+	if !strings.HasPrefix(name, imagehashPrefix) {
+		return nil, false
+	}
+	rest := name[len(imagehashPrefix):]
+
+	for _, a := range imagehashAlgorithms {
+		if !strings.HasPrefix(rest, a) {
+			continue
+		}
+
+		size, err := strconv.Atoi(rest[len(a):])
+		if err != nil {
+			return nil, false
+		}
+
+		h, err := NewImagehashHasher(a, size)
+		if err != nil || h.Name() != name {
+			return nil, false
+		}
+		return h, true
+	}
+	return nil, false
+}
+
+// ParseImagehash parses a hex string printed by imagehash, such as str(imagehash.dhash(img)), into a hash with the same
+// bits the matching imagehash hasher gives. Like imagehash's hex_to_hash the hash must be square, and its size is
+// worked out from the length of the string.
+func ParseImagehash(s string) (Hash, error) {
+	n := int(math.Sqrt(float64(len(s) * 4)))
+	if n < 2 {
+		return Hash{}, errors.Errorf("imagehash hex %q is too short", s)
+	}
+
+	bits := NewBitSet(n * n)
+	for i := range s {
+		v, err := strconv.ParseUint(s[len(s)-1-i:len(s)-i], 16, 4)
+		if err != nil {
+			return Hash{}, errors.Errorf("invalid imagehash hex %q", s)
+		}
+
+		for j := 0; j < 4; j++ {
+			if v&(1<<uint(j)) == 0 {
+				continue
+			}
+
+			if b := 4*i + j; b < n*n {
+				bits.Set(b)
+			} else {
+				return Hash{}, errors.Errorf("imagehash hex %q has bits set past the %d bits of a %dx%d hash", s, n*n, n, n)
+			}
+		}
+	}
+	return Hash{VHash: bits}, nil
+}
+
+// FormatImagehash formats a hash from an imagehash hasher the way imagehash prints it, as the hex of a number whose
+// most significant bit is the first element of the hash, zero padded to a whole number of nibbles. Only VHash is used.
+func FormatImagehash(h Hash, hashSize int) string {
+	n := hashSize * hashSize
+	nibbles := (n + 3) / 4
+
+	var sb strings.Builder
+	sb.Grow(nibbles)
+	for i := nibbles - 1; i >= 0; i-- {
+		var v int
+		for j := 3; j >= 0; j-- {
+			v <<= 1
+			if b := 4*i + j; b < n && h.VHash.Get(b) {
+				v |= 1
+			}
+		}
+		sb.WriteByte("0123456789abcdef"[v])
+	}
+	return sb.String()
+}
+
+// Pillow's resample.c, which stores coefficients and sums in fixed point with this many fractional bits.
+const pillowPrecision = 32 - 8 - 2
+
+// Pillow's LANCZOS filter, a sinc windowed by a sinc three times as wide.
+func pillowLanczos(x float64) float64 {
+	sinc := func(x float64) float64 {
+		if x == 0 {
+			return 1
+		}
+		x *= math.Pi
+		return math.Sin(x) / x
+	}
+
+	if -3 <= x && x < 3 {
+		return sinc(x) * sinc(x/3)
+	}
+	return 0
+}
+
+// Ports Pillow's precompute_coeffs and normalize_coeffs_8bpc, returning the first input pixel and the number of
+// input pixels each output pixel is summed from, along with its fixed point weights in rows of ksize.
+func pillowCoeffs(in, out int) (bounds []int, kk []int32, ksize int) {
+	scale := float64(in) / float64(out)
+	filterscale := math.Max(scale, 1)
+
+	support := 3 * filterscale
+	ksize = int(math.Ceil(support))*2 + 1
+
+	bounds = make([]int, 2*out)
+	kk = make([]int32, out*ksize)
+	k := make([]float64, ksize)
+	for xx := 0; xx < out; xx++ {
+		center := (float64(xx) + 0.5) * scale
+		ss := 1 / filterscale
+
+		// Conversions truncate towards zero in both C and Go, so these round the same way Pillow does
+		xmin := int(center - support + 0.5)
+		if xmin < 0 {
+			xmin = 0
+		}
+		xmax := int(center + support + 0.5)
+		if xmax > in {
+			xmax = in
+		}
+		xmax -= xmin
+
+		var ww float64
+		for x := 0; x < xmax; x++ {
+			k[x] = pillowLanczos((float64(x+xmin) - center + 0.5) * ss)
+			ww += k[x]
+		}
+
+		for x := 0; x < xmax; x++ {
+			if ww != 0 {
+				k[x] /= ww
+			}
+
+			if k[x] < 0 {
+				kk[xx*ksize+x] = int32(-0.5 + k[x]*(1<<pillowPrecision))
+			} else {
+				kk[xx*ksize+x] = int32(0.5 + k[x]*(1<<pillowPrecision))
+			}
+		}
+		bounds[2*xx], bounds[2*xx+1] = xmin, xmax
+	}
+	return
+}
+
+// Pillow's clip8, rounding a fixed point sum down to a byte.
+func pillowClip8(v int32) uint8 {
+	if v >= 1<<pillowPrecision<<8 {
+		return 255
+	} else if v <= 0 {
+		return 0
+	}
+	return uint8(v >> pillowPrecision)
+}
+
+// Resizes a single channel image the way Pillow's Image.resize does for "L" images with the LANCZOS filter, with a
+// horizontal pass over only the rows the vertical pass reads, followed by the vertical pass. Each pass is skipped if
+// that side doesn't change size.
+func pillowResize(pix []uint8, w, h, dw, dh int) []uint8 {
+	hbounds, hk, hsize := pillowCoeffs(w, dw)
+	vbounds, vk, vsize := pillowCoeffs(h, dh)
+
+	if w != dw {
+		first := vbounds[0]
+		last := vbounds[2*dh-2] + vbounds[2*dh-1]
+
+		tmp := make([]uint8, dw*(last-first))
+		for y := 0; y < last-first; y++ {
+			row := pix[(y+first)*w : (y+first+1)*w]
+			for xx := 0; xx < dw; xx++ {
+				xmin, xmax := hbounds[2*xx], hbounds[2*xx+1]
+				k := hk[xx*hsize : xx*hsize+xmax]
+
+				ss := int32(1 << (pillowPrecision - 1))
+				for x, c := range k {
+					ss += int32(row[x+xmin]) * c
+				}
+				tmp[y*dw+xx] = pillowClip8(ss)
+			}
+		}
+
+		for i := 0; i < dh; i++ {
+			vbounds[2*i] -= first
+		}
+		pix, w = tmp, dw
+	}
+
+	if h != dh {
+		out := make([]uint8, w*dh)
+		for yy := 0; yy < dh; yy++ {
+			ymin, ymax := vbounds[2*yy], vbounds[2*yy+1]
+			k := vk[yy*vsize : yy*vsize+ymax]
+
+			for x := 0; x < w; x++ {
+				ss := int32(1 << (pillowPrecision - 1))
+				for y, c := range k {
+					ss += int32(pix[(y+ymin)*w+x]) * c
+				}
+				out[yy*w+x] = pillowClip8(ss)
+			}
+		}
+		pix = out
+	}
+	return pix
+}
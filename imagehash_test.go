@@ -0,0 +1,216 @@
+package imghash
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a grayscale image whose pixels are given by fn.
+func grayImage(w, h int, fn func(x, y int) uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray(x, y, color.Gray{fn(x, y)})
+		}
+	}
+	return img
+}
+
+func TestImagehashHex(t *testing.T) {
+	// The first is the average hash from imagehash's README, the third a hash_size of 5 which doesn't fill its top nibble
+	for _, s := range []string{"ffd7918181c9ffff", "0000000000000001", "1a2b3c4", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"} {
+		hash, err := ParseImagehash(s)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", s, err)
+		}
+
+		if got := FormatImagehash(hash, int(math.Sqrt(float64(len(s)*4)))); got != s {
+			t.Errorf("formatting %s gave %s", s, got)
+		}
+	}
+
+	if hash, _ := ParseImagehash("ffd7918181c9ffff"); hash.VHash.String() != "ffd7918181c9ffff" {
+		t.Errorf("64 bit hash printed as %s", hash.VHash.String())
+	}
+
+	for _, s := range []string{"", "ffd7918181c9fffg", "fffffff"} {
+		if _, err := ParseImagehash(s); err == nil {
+			t.Errorf("parsed invalid hex %q", s)
+		}
+	}
+}
+
+// Images that are already the hasher's size aren't resized by Pillow, so the bits can be worked out by hand.
+func TestImagehashBits(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		// Every row gets brighter to the right except the first, which is the most significant byte
+		{"imagehash-dhash", grayImage(9, 8, func(x, y int) uint8 {
+			if y == 0 {
+				return uint8(200 - 10*x)
+			}
+			return uint8(10*x + y)
+		}), "00ffffffffffffff"},
+		{"imagehash-dhash-vertical", grayImage(8, 9, func(x, y int) uint8 { return uint8(10*y + 20*(x&1)) }), "ffffffffffffffff"},
+		{"imagehash-ahash", grayImage(8, 8, func(x, y int) uint8 {
+			if y < 4 {
+				return 200
+			}
+			return 50
+		}), "ffffffff00000000"},
+		// Pillow downscales this one, but the top half stays above the mean
+		{"imagehash-ahash", grayImage(64, 48, func(x, y int) uint8 {
+			if y < 24 {
+				return 180
+			}
+			return 20
+		}), "ffffffff00000000"},
+	}
+
+	for _, tc := range tests {
+		hash, err := HashImageWithOptions(tc.img, Options{Hasher: tc.name, Filter: FilterBilinear})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if got := FormatImagehash(hash, 8); got != tc.want {
+			t.Errorf("%s gave %s, want %s", tc.name, got, tc.want)
+		}
+
+		parsed, _ := ParseImagehash(tc.want)
+		if hash.Distance(parsed) != 0 {
+			t.Errorf("%s doesn't match its parsed hex", tc.name)
+		}
+	}
+}
+
+// expected.txt holds the hex of each hash of the fixture, written by testdata/imagehash/reference.py, which transcribes
+// imagehash and Pillow's resize with only the standard library. generate.py writes the same file with imagehash itself.
+func TestImagehashFixture(t *testing.T) {
+	dir := filepath.Join("testdata", "imagehash")
+	in, err := os.Open(filepath.Join(dir, "fixture.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	img, err := png.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The score has to come from the pixels Pillow's resize gave the hash, not this package's resize
+	hash, err := HashImageWithOptions(img, Options{Hasher: "imagehash-ahash", Filter: FilterBilinear})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := img.Bounds()
+	luma := pillowResize(luminance(toNRGBA(img)), b.Dx(), b.Dy(), 8, 8)
+	if want := informationScore(luma, &hash, 64); hash.Information != want {
+		t.Errorf("information score was %d, expected %d from the source pixels", hash.Information, want)
+	}
+
+	expected, err := os.Open(filepath.Join(dir, "expected.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+
+	lines := bufio.NewScanner(expected)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) != 2 {
+			t.Fatalf("invalid line %q in expected.txt", lines.Text())
+		}
+
+		hasher, err := LookupHasher(fields[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := HashImageWithOptions(img, Options{Hasher: fields[0], Filter: FilterBilinear})
+		if err != nil {
+			t.Fatalf("%s: %v", fields[0], err)
+		}
+
+		if got := FormatImagehash(hash, int(math.Sqrt(float64(hasher.Bits())))); got != fields[1] {
+			t.Errorf("%s gave %s, imagehash gave %s", fields[0], got, fields[1])
+		}
+	}
+	if err := lines.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPillowResize(t *testing.T) {
+	// Both pixels get a weight of exactly one half, and Pillow rounds the sum up
+	if got := pillowResize([]uint8{0, 255}, 2, 1, 1, 1); len(got) != 1 || got[0] != 128 {
+		t.Errorf("halving got %v, want [128]", got)
+	}
+
+	flat := make([]uint8, 37*23)
+	for i := range flat {
+		flat[i] = 93
+	}
+	for _, p := range pillowResize(flat, 37, 23, 8, 9) {
+		if p != 93 {
+			t.Fatalf("flat image resized to %d instead of 93", p)
+		}
+	}
+
+	// Every fixed point kernel should sum to one, give or take the rounding of each weight
+	for _, size := range [][2]int{{1000, 9}, {33, 32}, {7, 32}} {
+		bounds, kk, ksize := pillowCoeffs(size[0], size[1])
+		for xx := 0; xx < size[1]; xx++ {
+			var sum int32
+			for _, k := range kk[xx*ksize : xx*ksize+bounds[2*xx+1]] {
+				sum += k
+			}
+			if d := sum - 1<<pillowPrecision; d < -int32(ksize) || d > int32(ksize) {
+				t.Errorf("%d to %d: kernel %d sums to %d", size[0], size[1], xx, sum)
+			}
+		}
+	}
+}
+
+func TestImagehashHasherNames(t *testing.T) {
+	for _, name := range []string{"imagehash-phash", "imagehash-dhash-vertical", "imagehash-phash16", "imagehash-dhash-vertical5"} {
+		h, err := LookupHasher(name)
+		if err != nil || h.Name() != name {
+			t.Errorf("looking up %s gave %v, %v", name, h, err)
+		}
+	}
+
+	for _, name := range []string{"imagehash-phash8", "imagehash-phash1", "imagehash-whash", "imagehash-ahash-3"} {
+		if _, err := LookupHasher(name); err == nil {
+			t.Errorf("looked up invalid hasher %s", name)
+		}
+	}
+
+	// Larger hashes span several words, and still print the way imagehash does
+	h, _ := LookupHasher("imagehash-phash16")
+	img := randomImage(rand.New(rand.NewSource(1)), image.NewNRGBA(image.Rect(0, 0, 97, 71)))
+	hash, err := h.(SourceHasher).HashSource(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := FormatImagehash(hash, 16)
+	parsed, err := ParseImagehash(s)
+	if err != nil || !parsed.VHash.Equal(hash.VHash) {
+		t.Errorf("hex %s didn't round trip: %v", s, err)
+	}
+}
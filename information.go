@@ -0,0 +1,140 @@
+package imghash
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// The information score below which frames are treated as low information when Options.MinInformation is left at 0.
+// Frames at this score have a luma standard deviation of 10 at the hasher's size, or only one in six or so bits of a
+// plane set differently to the rest.
+const DefaultMinInformation = 80
+
+// What is done with frames whose information score is below the minimum, see Options.Information.
+type InformationMode byte
+
+const (
+	// Every frame is kept and treated the same, though its score is still recorded in Hash.Information.
+	InformationIgnore InformationMode = iota
+
+	// Low information frames are left out of the file entirely.
+	InformationDrop
+
+	// Low information frames are kept, and the minimum is stored in the file so File.LowInformation can list them.
+	InformationFlag
+
+	// Low information frames are kept and flagged, and trees built from the file rank them below other results, see
+	// Tree.SetMinInformation.
+	InformationDownWeight
+)
+
+// Fades to black, white flashes and flat title cards hash to nearly all zeroes, which is a few bits away from every
+// other flat frame. Each hash gets a score from 0 for a completely flat frame to 255, which is the lower of eight times the
+// standard deviation of the luma of the scaled image and how evenly the bits of each plane are split between zeroes and
+// ones. The first catches frames that are flat but noisy, whose bits are random, and the second frames that are mostly
+// flat with a little detail, such as a card with a line of text, as well as plain gradients.
+func informationScore(luma []uint8, h *Hash, bits int) uint8 {
+	var sum, sumsq float64
+	for _, p := range luma {
+		sum += float64(p)
+		sumsq += float64(p) * float64(p)
+	}
+
+	n := float64(len(luma))
+	score := 8 * math.Sqrt(math.Max(sumsq/n-(sum/n)*(sum/n), 0))
+	if b := bitInformation(h, bits); b < score {
+		score = b
+	}
+	return uint8(math.Min(math.Round(score), 255))
+}
+
+// The bit balance half of informationScore, which is all that can be recovered from a hash on its own. Each plane is
+// scored by the share of its bits in the minority, doubled so an even split scores 255, and the lowest plane counts.
+func bitInformation(h *Hash, bits int) float64 {
+	n := bits
+	if len(h.HHash) > 0 {
+		n /= 2
+	}
+	if n <= 0 {
+		return 0
+	}
+
+	score := planeBalance(h.VHash, n)
+	if len(h.HHash) > 0 {
+		score = math.Min(score, planeBalance(h.HHash, n))
+	}
+	return score
+}
+
+// Scores how evenly the n bits of a plane are split between zeroes and ones, from 0 to 255.
+func planeBalance(b BitSet, n int) float64 {
+	minority := b.Count()
+	if n-minority < minority {
+		minority = n - minority
+	}
+	return 255 * 2 * float64(minority) / float64(n)
+}
+
+// Returns an error if the mode isn't one of the known information modes.
+func (m InformationMode) validate() error {
+	if m > InformationDownWeight {
+		return errors.Errorf("unknown information mode %d", m)
+	}
+	return nil
+}
+
+// Returns the minimum score frames need to not be low information, filling in the default if it was left at 0.
+func minInformation(mode InformationMode, min uint8) uint8 {
+	if mode != InformationIgnore && min == 0 {
+		return DefaultMinInformation
+	}
+	return min
+}
+
+// Drops every hash scoring below min, keeping the rest in order.
+func dropLowInformation(hashes []Hash, min uint8) []Hash {
+	kept := hashes[:0]
+	for _, h := range hashes {
+		if h.Information >= min {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// Sets the minimum information score results need to keep their distance, or disables the penalty if min is 0. Results
+// scoring below it, or found with a query scoring below it, have up to half the bits of a hash added to their distance
+// in proportion to how far short they fall, so a completely flat frame is as far away as an unrelated image. Queries
+// without a score are scored by their bits. Trees built from files created with InformationDownWeight start with the
+// file's minimum.
+func (t *Tree) SetMinInformation(min uint8) {
+	t.minInformation = min
+}
+
+// Returns the minimum set by SetMinInformation, or 0 if low information results aren't penalised.
+func (t *Tree) MinInformation() uint8 {
+	return t.minInformation
+}
+
+// Returns the information score of a query. Queries that were never scored, such as hashes parsed from another
+// library's output, are scored by their bits alone rather than treated as completely flat.
+func queryInformation(e *Hash, bits int) uint8 {
+	if e.Information > 0 {
+		return e.Information
+	}
+	return uint8(math.Min(math.Round(bitInformation(e, bits)), 255))
+}
+
+// Returns the distance added to a result for the lower of its and the query's information scores.
+func (s *search) informationPenalty(item *Hash) int {
+	score := item.Information
+	if s.queryInformation < score {
+		score = s.queryInformation
+	}
+
+	if score >= s.minInformation {
+		return 0
+	}
+	return int(s.minInformation-score) * s.bits / (2 * int(s.minInformation))
+}
@@ -0,0 +1,197 @@
+package imghash
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a w*h image of a single grey level, with every pixel nudged by up to noise levels either way by rng.
+func flatImage(rng *rand.Rand, w, h int, level uint8, noise int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		v := int(level)
+		if noise > 0 {
+			v += rng.Intn(2*noise+1) - noise
+		}
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(v), uint8(v), uint8(v), 0xff
+	}
+	return img
+}
+
+// Fades, flashes, title cards and gradients must score below the default minimum, and real detail well above it.
+func TestInformationScore(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	card := flatImage(rng, 640, 360, 0, 0)
+	draw.Draw(card, image.Rect(200, 160, 440, 190), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	gradient := image.NewNRGBA(image.Rect(0, 0, 640, 360))
+	for y := 0; y < 360; y++ {
+		for x := 0; x < 640; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / 640), uint8(x * 255 / 640), uint8(x * 255 / 640), 0xff})
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		low  bool
+	}{
+		{"black", flatImage(rng, 640, 360, 0, 0), true},
+		{"noisy fade", flatImage(rng, 640, 360, 12, 3), true},
+		{"white flash", flatImage(rng, 640, 360, 255, 0), true},
+		{"title card", card, true},
+		{"gradient", gradient, true},
+		{"blobs", blobImage(t, rng, 12, 640, 360), false},
+		{"corners", cornerImage(t, rng, 640, 360), false},
+	}
+
+	for _, tc := range tests {
+		h, err := HashImage(tc.img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if low := h.Information < DefaultMinInformation; low != tc.low {
+			t.Errorf("%s scored %d", tc.name, h.Information)
+		}
+	}
+
+	// Hashers that split their bits at the median still score flat frames by their luma
+	for _, hasher := range []string{"ahash", "phash", "whash"} {
+		flat, err := HashImageWithOptions(flatImage(rng, 640, 360, 12, 3), Options{Hasher: hasher, Filter: FilterBilinear})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		detail, err := HashImageWithOptions(cornerImage(t, rng, 640, 360), Options{Hasher: hasher, Filter: FilterBilinear})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flat.Information >= DefaultMinInformation || detail.Information < DefaultMinInformation {
+			t.Errorf("%s scored a fade %d and detail %d", hasher, flat.Information, detail.Information)
+		}
+	}
+}
+
+// Low information frames are dropped, flagged or pushed down the results depending on the mode.
+func TestInformationModes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dir := t.TempDir()
+	// Every flat image hashes the same, so the title card keeps both low information hashes from being deduplicated
+	card := flatImage(rng, 320, 240, 0, 0)
+	draw.Draw(card, image.Rect(100, 110, 220, 125), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	images := []image.Image{cornerImage(t, rng, 320, 240), flatImage(rng, 320, 240, 250, 2), card, cornerImage(t, rng, 320, 240)}
+	for i, img := range images {
+		out, err := os.Create(filepath.Join(dir, fmt.Sprintf("%d.png", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(out, img); err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+	}
+
+	if _, err := NewFromPathWithOptions(dir, Options{Filter: FilterBilinear, Information: InformationDownWeight + 1}); err == nil {
+		t.Error("an unknown information mode was accepted")
+	}
+
+	dropped, err := NewFromPathWithOptions(dir, Options{Filter: FilterBilinear, Information: InformationDrop})
+	if err != nil {
+		t.Fatal(err)
+	} else if dropped.Length() != 2 {
+		t.Errorf("dropping low information images left %d of 4", dropped.Length())
+	}
+
+	f, err := NewFromPathWithOptions(dir, Options{Filter: FilterBilinear, Information: InformationDownWeight})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := roundTrip(t, f)
+	if loaded.InformationMode() != InformationDownWeight || loaded.MinInformation() != DefaultMinInformation {
+		t.Errorf("file recorded mode %d with a minimum of %d", loaded.InformationMode(), loaded.MinInformation())
+	}
+	for i := range f.hashes {
+		if loaded.hashes[i].Information != f.hashes[i].Information {
+			t.Errorf("hash %d scored %d, want %d", i, loaded.hashes[i].Information, f.hashes[i].Information)
+		}
+	}
+	if low := loaded.LowInformation(); len(low) != 2 {
+		t.Errorf("flagged %v as low information, want 2 hashes", low)
+	}
+
+	// A flat query is as close to the flat images as ever, but they're no longer close enough to be found
+	query, err := HashImage(flatImage(rng, 640, 480, 5, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := NewTree(append([]Hash(nil), loaded.hashes...))
+	if q := plain.NearestDist(&query, 24); len(q) != 2 {
+		t.Fatalf("a flat query found %d hashes without down-weighting, want 2", len(q))
+	}
+
+	tree, err := NewTreeFromFiles(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.MinInformation() != DefaultMinInformation {
+		t.Errorf("tree started with a minimum of %d", tree.MinInformation())
+	}
+	if q := tree.NearestDist(&query, 24); len(q) != 0 {
+		t.Errorf("a flat query found %d hashes with down-weighting", len(q))
+	}
+
+	// Queries that were never scored are scored by their bits, so a detailed one isn't penalised as if it were flat
+	// while a flat one still is
+	for _, h := range loaded.hashes {
+		if h.Information < DefaultMinInformation {
+			continue
+		}
+
+		h.Information = 0
+		if q := tree.NearestDist(&h, 0); len(q) != 1 {
+			t.Errorf("an unscored query of a detailed image found %d hashes at distance 0", len(q))
+		}
+	}
+
+	unscored := query
+	unscored.Information = 0
+	if q := tree.NearestDist(&unscored, 24); len(q) != 0 {
+		t.Errorf("an unscored flat query found %d hashes with down-weighting", len(q))
+	}
+
+	// Files without scores get them back from the bits of their hashes
+	old := NewFile()
+	old.hashes = append([]Hash(nil), f.hashes...)
+	for i := range old.hashes {
+		old.hashes[i].Information = 0
+	}
+	for i, h := range roundTrip(t, old).hashes {
+		if low := h.Information < DefaultMinInformation; low != (f.hashes[i].Information < DefaultMinInformation) {
+			t.Errorf("hash %d scored %d from its bits, but %d when hashed", i, h.Information, f.hashes[i].Information)
+		}
+	}
+
+	v1 := NewFileWithVersion(fileVersion1)
+	v1.hashes = f.hashes[:1]
+	v1.information = InformationFlag
+	if err := v1.Write(filepath.Join(t.TempDir(), "v1")); err == nil {
+		t.Error("wrote an information mode to a version 1 file")
+	}
+}
@@ -0,0 +1,79 @@
+package imghash
+
+import "github.com/pkg/errors"
+
+// Metric measures how far apart two hashes are. Trees prune their searches with the triangle inequality, so any metric
+// used to build one must obey it, which every metric here does apart from MaskedMetric, which trees handle specially.
+type Metric interface {
+	Distance(a, b *Hash) int
+}
+
+// Sums the hamming distances of the vertical, horizontal and diagonal hashes, exactly as Hash.Distance does. Like every
+// metric here, diagonals only count when both hashes have one.
+type SumMetric struct{}
+
+func (SumMetric) Distance(a, b *Hash) int { return a.Distance(*b) }
+
+// Sums the hamming distances of the vertical, horizontal and diagonal hashes after multiplying them by their weights.
+// Letterboxed content is better served by weighing the horizontal hash above the vertical one, since bars that come and
+// go change far more vertical comparisons than horizontal ones. A zero Diagonal weight gives the distance hashes had
+// before they had diagonals, for measuring what the diagonal adds. Weights can't be negative, and trees and
+// CompareWithMetric refuse a metric with one.
+type WeightedMetric struct {
+	Vertical, Horizontal, Diagonal int
+}
+
+func (w WeightedMetric) Distance(a, b *Hash) int {
+	return w.Vertical*a.VHash.Distance(b.VHash) + w.Horizontal*a.HHash.Distance(b.HHash) + w.Diagonal*a.diagonalDistance(b)
+}
+
+// Returns an error if m can't be used, which is only a WeightedMetric with a negative weight. A negative weight makes
+// some distances negative and breaks the triangle inequality, so searches would prune hashes they should find.
+func checkMetric(m Metric) error {
+	if m == nil {
+		return errors.New("no metric was given")
+	} else if w, ok := m.(WeightedMetric); ok && (w.Vertical < 0 || w.Horizontal < 0 || w.Diagonal < 0) {
+		return errors.Errorf("weights can't be negative, got %+v", w)
+	}
+	return nil
+}
+
+// Takes the largest of the vertical, horizontal and diagonal hamming distances, so two hashes are only close if every
+// direction agrees.
+type MaxMetric struct{}
+
+func (MaxMetric) Distance(a, b *Hash) int {
+	d := a.VHash.Distance(b.VHash)
+	if h := a.HHash.Distance(b.HHash); h > d {
+		d = h
+	}
+	if g := a.diagonalDistance(b); g > d {
+		d = g
+	}
+	return d
+}
+
+// Only compares the vertical hashes, which is also the only hash of single plane hashers like the average hash.
+type VerticalMetric struct{}
+
+func (VerticalMetric) Distance(a, b *Hash) int { return a.VHash.Distance(b.VHash) }
+
+// Only compares the horizontal hashes.
+type HorizontalMetric struct{}
+
+func (HorizontalMetric) Distance(a, b *Hash) int { return a.HHash.Distance(b.HHash) }
+
+// Sums the hamming distances like SumMetric, but ignores bits that are unstable in either hash, see Hash.MaskedDistance.
+// It's what trees use by default, and is identical to SumMetric for hashes without masks. Masked distances break the
+// triangle inequality, so trees built with it are arranged by the unmasked distance and search further to make up for it.
+type MaskedMetric struct{}
+
+func (MaskedMetric) Distance(a, b *Hash) int { return a.MaskedDistance(*b) }
+
+// Returns the metric a tree is arranged and pruned by when searching with m, which must obey the triangle inequality.
+func boundMetric(m Metric) Metric {
+	if _, ok := m.(MaskedMetric); ok {
+		return SumMetric{}
+	}
+	return m
+}
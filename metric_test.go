@@ -0,0 +1,120 @@
+package imghash
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	a := Hash{VHash: BitSet{0b1111}, HHash: BitSet{0b1}}
+	b := Hash{VHash: BitSet{0}, HHash: BitSet{0}, VMask: BitSet{0b11}}
+
+	tests := []struct {
+		metric Metric
+		want   int
+	}{
+		{SumMetric{}, 5},
+		{WeightedMetric{Vertical: 1, Horizontal: 3}, 7},
+		{MaxMetric{}, 4},
+		{VerticalMetric{}, 4},
+		{HorizontalMetric{}, 1},
+		{MaskedMetric{}, 3},
+	}
+
+	for _, tc := range tests {
+		if got := tc.metric.Distance(&a, &b); got != tc.want {
+			t.Errorf("%T gave %d, want %d", tc.metric, got, tc.want)
+		}
+	}
+
+	// A negative weight breaks the triangle inequality the tree prunes with
+	if _, err := NewTreeWithMetric(nil, DefaultHasher, WeightedMetric{Vertical: 1, Horizontal: -1}); err == nil {
+		t.Error("built a tree with a negative weight")
+	}
+	if _, err := NewTreeWithMetric(nil, DefaultHasher, nil); err == nil {
+		t.Error("built a tree without a metric")
+	}
+}
+
+// Searching a tree built with any metric must find exactly what checking every hash would.
+func TestTreeMetrics(t *testing.T) {
+	var hashes []Hash
+	for i := 0; i < 300; i++ {
+		h := randomHash(1, 1, uint32(i))
+		if i%3 == 0 {
+			h.VMask, h.HMask = BitSet{rand.Uint64() & rand.Uint64() & rand.Uint64()}, BitSet{0}
+		}
+		hashes = append(hashes, h)
+	}
+
+	metrics := []Metric{SumMetric{}, WeightedMetric{Vertical: 1, Horizontal: 4}, MaxMetric{}, VerticalMetric{}, HorizontalMetric{}, MaskedMetric{}}
+	for _, m := range metrics {
+		tree, err := NewTreeWithMetric(append([]Hash(nil), hashes...), DefaultHasher, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 20; i++ {
+			query := noisyHash(hashes[rand.Intn(len(hashes))], 3, 0)
+			d := m.Distance(&query, &hashes[rand.Intn(len(hashes))])
+
+			var want []uint32
+			for j := range hashes {
+				if m.Distance(&query, &hashes[j]) <= d {
+					want = append(want, hashes[j].Index)
+				}
+			}
+
+			var got []uint32
+			for _, item := range tree.NearestDist(&query, d) {
+				if item.Dist != m.Distance(&query, item.Item) {
+					t.Fatalf("%T: result has distance %d, want %d", m, item.Dist, m.Distance(&query, item.Item))
+				}
+				got = append(got, item.Item.Index)
+			}
+
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if len(got) != len(want) {
+				t.Fatalf("%T: found %d hashes within %d, want %d", m, len(got), d, len(want))
+			}
+			for j := range got {
+				if got[j] != want[j] {
+					t.Fatalf("%T: found %v, want %v", m, got, want)
+				}
+			}
+		}
+	}
+}
+
+// Letterboxing mostly changes the vertical hash, so only the horizontal one should decide duplicates.
+func TestDeduplicateWithMetric(t *testing.T) {
+	h := randomHash(1, 1, 1)
+	boxed := randomHash(1, 0, 2)
+	boxed.HHash = append(BitSet(nil), h.HHash...)
+
+	f := NewFile()
+	f.hashes = []Hash{h, boxed, randomHash(1, 1, 3)}
+
+	other := NewFile()
+	other.hashes = []Hash{boxed, f.hashes[2], h}
+	if err := CompareWithMetric(f, other, HorizontalMetric{}, 0); err != nil {
+		t.Errorf("comparing by horizontal hashes: %v", err)
+	}
+
+	f.Deduplicate()
+	if f.Length() != 3 {
+		t.Fatalf("exact deduplication left %d hashes, want 3", f.Length())
+	}
+
+	f.DeduplicateWithMetric(HorizontalMetric{}, 0)
+	if f.Length() != 2 || f.hashes[0].Index != 1 || f.hashes[1].Index != 3 {
+		t.Errorf("deduplicating by horizontal hashes left %+v", f.hashes)
+	}
+
+	other.hashes = other.hashes[:2]
+	if err := CompareWithMetric(f, other, VerticalMetric{}, 0); err == nil {
+		t.Error("files with different vertical hashes compared equal")
+	}
+}
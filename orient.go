@@ -0,0 +1,127 @@
+package imghash
+
+import (
+	"image"
+
+	"github.com/pkg/errors"
+)
+
+// One of the eight ways an image can be mirrored and rotated by multiples of 90 degrees.
+type Orientation byte
+
+const (
+	OrientIdentity   Orientation = iota
+	OrientRotate90               // Rotated 90 degrees clockwise
+	OrientRotate180              // Rotated 180 degrees
+	OrientRotate270              // Rotated 270 degrees clockwise
+	OrientFlipH                  // Mirrored left to right
+	OrientFlipV                  // Mirrored top to bottom
+	OrientTranspose              // Mirrored along the diagonal from the top-left corner
+	OrientTransverse             // Mirrored along the diagonal from the top-right corner
+
+	orientations = 8
+)
+
+func (o Orientation) String() string {
+	switch o {
+	case OrientIdentity:
+		return "identity"
+	case OrientRotate90:
+		return "rotate90"
+	case OrientRotate180:
+		return "rotate180"
+	case OrientRotate270:
+		return "rotate270"
+	case OrientFlipH:
+		return "fliph"
+	case OrientFlipV:
+		return "flipv"
+	case OrientTranspose:
+		return "transpose"
+	case OrientTransverse:
+		return "transverse"
+	}
+	return "unknown"
+}
+
+// Returns whether the orientation swaps the width and height of an image.
+func (o Orientation) swaps() bool {
+	switch o {
+	case OrientRotate90, OrientRotate270, OrientTranspose, OrientTransverse:
+		return true
+	}
+	return false
+}
+
+// Returns a copy of the image in the given orientation.
+func orientImage(img *image.NRGBA, o Orientation) *image.NRGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	dw, dh := w, h
+	if o.swaps() {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// The source pixel that ends up at (x, y)
+			var sx, sy int
+			switch o {
+			case OrientIdentity:
+				sx, sy = x, y
+			case OrientRotate90:
+				sx, sy = y, h-1-x
+			case OrientRotate180:
+				sx, sy = w-1-x, h-1-y
+			case OrientRotate270:
+				sx, sy = w-1-y, x
+			case OrientFlipH:
+				sx, sy = w-1-x, y
+			case OrientFlipV:
+				sx, sy = x, h-1-y
+			case OrientTranspose:
+				sx, sy = y, x
+			case OrientTransverse:
+				sx, sy = w-1-y, h-1-x
+			}
+
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(img.Rect.Min.X+sx, img.Rect.Min.Y+sy):])
+		}
+	}
+	return dst
+}
+
+// A hash of every orientation of an image, indexed by Orientation.
+type OrientedHash [orientations]Hash
+
+// Returns the smallest distance between any orientation of the hash and o, along with the orientation it was found in.
+// The orientation is the one the hashed image would have to be put in to look like the image o was created from.
+func (v *OrientedHash) Distance(o Hash) (int, Orientation) {
+	best, orient := v[0].Distance(o), OrientIdentity
+	for i := 1; i < orientations; i++ {
+		if d := v[i].Distance(o); d < best {
+			best, orient = d, Orientation(i)
+		}
+	}
+	return best, orient
+}
+
+// Hashes every orientation of an image that has already been scaled to the hasher's size. Each orientation is
+// derived from the scaled grid rather than the original, so it only costs as much as hashing the grid again.
+// Hashers with a size that isn't square can't be rotated by 90 degrees, and return an error.
+func orientedHash(img *image.NRGBA, hasher Hasher, opts Options) (*OrientedHash, error) {
+	if w, h := hasher.Size(); w != h {
+		return nil, errors.Errorf("%s hashes are %dx%d, only square hashes can be rotated", hasher.Name(), w, h)
+	}
+
+	var v OrientedHash
+	for i := range v {
+		hash, err := hashScaled(orientImage(img, Orientation(i)), hasher, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "hashing %s orientation", Orientation(i))
+		}
+		v[i] = hash
+	}
+	return &v, nil
+}
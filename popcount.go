@@ -0,0 +1,189 @@
+package imghash
+
+import (
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// The words of many bitsets of the same length stored a column at a time, word w of bitset i being cols[w*stride+i],
+// so the distance from one query to every bitset can be worked out a handful of bitsets at a time with vector
+// instructions. Each column has room for stride bitsets before it has to be moved.
+type columns struct {
+	words, n, stride int
+	cols             []uint64
+}
+
+func newColumns(words, capacity int) *columns {
+	if capacity < 4 {
+		capacity = 4
+	}
+	return &columns{words: words, stride: capacity, cols: make([]uint64, words*capacity)}
+}
+
+// Appends the bitset made up of the given words, which must be exactly c.words long.
+func (c *columns) add(words ...BitSet) {
+	if c.n == c.stride {
+		grown := make([]uint64, 2*c.words*c.stride)
+		for w := 0; w < c.words; w++ {
+			copy(grown[2*w*c.stride:], c.cols[w*c.stride:w*c.stride+c.n])
+		}
+		c.cols, c.stride = grown, 2*c.stride
+	}
+
+	w := 0
+	for _, b := range words {
+		for _, word := range b {
+			c.cols[w*c.stride+c.n] = word
+			w++
+		}
+	}
+	c.n++
+}
+
+// Returns the hamming distance from the query, which must be c.words long, to every bitset in order, reusing dist if
+// it's large enough.
+func (c *columns) distances(query []uint64, dist []int32) []int32 {
+	if cap(dist) < c.n {
+		dist = make([]int32, c.n)
+	}
+	dist = dist[:c.n]
+	if c.n > 0 {
+		popcountColumns(c.cols, c.stride, c.words, query, dist)
+	}
+	return dist
+}
+
+// Works out the distances with bits.OnesCount64 a word at a time, which every platform can run. A column is done at
+// a time rather than a bitset, which keeps every load sequential.
+func popcountColumnsGeneric(cols []uint64, stride, words int, query []uint64, dist []int32) {
+	for i := range dist {
+		dist[i] = 0
+	}
+
+	for w := 0; w < words; w++ {
+		col, q := cols[w*stride:w*stride+len(dist)], query[w]
+		for i, word := range col {
+			dist[i] += int32(bits.OnesCount64(word ^ q))
+		}
+	}
+}
+
+// HashList holds the vertical, horizontal and diagonal hashes of many hashes a word at a time across all of them rather
+// than a hash at a time, so Distances can compare a query against every one in a single pass. On amd64 CPUs with AVX2
+// four hashes are compared at once, which makes brute force searches of millions of hashes far quicker than calling
+// Hash.Distance on each.
+type HashList struct {
+	cols   *columns
+	colour bool
+
+	// The number of words in each plane the list compares, which every hash in it must match
+	layout [5]int
+
+	// Reused between searches so they don't allocate
+	dist  []int32
+	query []uint64
+}
+
+// Creates a list of the hashes, which must all have the same number of words in each plane.
+func NewHashList(hashes []Hash) (*HashList, error) {
+	if len(hashes) == 0 {
+		return &HashList{cols: newColumns(0, 0)}, nil
+	}
+
+	l := newHashList(&hashes[0], len(hashes), false)
+	for i := range hashes {
+		if !l.add(&hashes[i]) {
+			return nil, errors.Errorf("hash %d has a different layout to the first", i)
+		}
+	}
+	return l, nil
+}
+
+// Creates an empty list with room for capacity hashes laid out like first. With colour the chroma hashes are compared
+// too, so a distance of 0 means two hashes are Equal.
+func newHashList(first *Hash, capacity int, colour bool) *HashList {
+	l := &HashList{colour: colour}
+	l.layout = l.layoutOf(first)
+
+	var words int
+	for _, n := range l.layout {
+		words += n
+	}
+	l.cols = newColumns(words, capacity)
+	l.query = make([]uint64, 0, words)
+	return l
+}
+
+// Returns the planes of h the list compares.
+func (l *HashList) planes(h *Hash) []BitSet {
+	if l.colour {
+		return []BitSet{h.VHash, h.HHash, h.DiagHash, h.CbHash, h.CrHash}
+	}
+	return []BitSet{h.VHash, h.HHash, h.DiagHash}
+}
+
+// Returns the number of words in each plane of h the list compares.
+func (l *HashList) layoutOf(h *Hash) (layout [5]int) {
+	for p, plane := range l.planes(h) {
+		layout[p] = len(plane)
+	}
+	return
+}
+
+// Appends h, returning false if it doesn't have the list's layout.
+func (l *HashList) add(h *Hash) bool {
+	if l.layoutOf(h) != l.layout {
+		return false
+	}
+	l.cols.add(l.planes(h)...)
+	return true
+}
+
+// Returns the number of hashes in the list.
+func (l *HashList) Len() int {
+	return l.cols.n
+}
+
+// Returns the distance from the query to every hash in the list in order, the same as Hash.Distance gives, reusing
+// dist if it's large enough. Returns an error if the query has a different layout to the hashes in the list.
+func (l *HashList) Distances(query *Hash, dist []int32) ([]int32, error) {
+	if l.Len() == 0 {
+		return dist[:0], nil
+	} else if l.layoutOf(query) != l.layout {
+		return nil, errors.New("query has a different layout to the hashes in the list")
+	}
+
+	l.query = l.query[:0]
+	for _, p := range l.planes(query) {
+		l.query = append(l.query, p...)
+	}
+	return l.cols.distances(l.query, dist), nil
+}
+
+// Returns the position of every hash in the list within maxDist of the query, in order.
+func (l *HashList) Within(query *Hash, maxDist int) ([]int, error) {
+	var err error
+	if l.dist, err = l.Distances(query, l.dist); err != nil {
+		return nil, err
+	}
+
+	var found []int
+	for i, d := range l.dist {
+		if int(d) <= maxDist {
+			found = append(found, i)
+		}
+	}
+	return found, nil
+}
+
+// Returns whether any hash in the list is within maxDist of the query, which must have the list's layout.
+func (l *HashList) any(query *Hash, maxDist int) bool {
+	l.dist, _ = l.Distances(query, l.dist)
+	for _, d := range l.dist {
+		if int(d) <= maxDist {
+			return true
+		}
+	}
+	return false
+}
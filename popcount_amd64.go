@@ -0,0 +1,48 @@
+//go:build !purego
+
+package imghash
+
+// Whether the CPU and OS support AVX2, checked the same way the runtime does since golang.org/x/sys isn't a dependency.
+var hasAVX2 = detectAVX2()
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+func xgetbv() (eax, edx uint32)
+
+// Compares the query against n hashes of the columns four at a time with AVX2, so n must be a multiple of four.
+//
+//go:noescape
+func popcountColumnsAVX2(cols *uint64, stride, words int, query *uint64, dist *int32, n int)
+
+func detectAVX2() bool {
+	if max, _, _, _ := cpuid(0, 0); max < 7 {
+		return false
+	}
+
+	// The OS has to save the upper halves of the YMM registers as well as the CPU supporting the instructions
+	const osxsave, avx = 1 << 27, 1 << 28
+	if _, _, ecx, _ := cpuid(1, 0); ecx&osxsave == 0 || ecx&avx == 0 {
+		return false
+	}
+	if eax, _ := xgetbv(); eax&6 != 6 {
+		return false
+	}
+
+	_, ebx, _, _ := cpuid(7, 0)
+	return ebx&(1<<5) != 0
+}
+
+func popcountColumns(cols []uint64, stride, words int, query []uint64, dist []int32) {
+	n := len(dist)
+	if hasAVX2 && n >= 4 && words > 0 {
+		popcountColumnsAVX2(&cols[0], stride, words, &query[0], &dist[0], n&^3)
+		if n&3 == 0 {
+			return
+		}
+
+		// The last few hashes are handled by the generic version on columns starting after the ones already done
+		done := n &^ 3
+		popcountColumnsGeneric(cols[done:], stride, words, query, dist[done:])
+		return
+	}
+	popcountColumnsGeneric(cols, stride, words, query, dist)
+}
@@ -0,0 +1,93 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// The number of set bits in every nibble from 0 to 15, repeated for both lanes.
+DATA nibbleCounts<>+0x00(SB)/8, $0x0302020102010100
+DATA nibbleCounts<>+0x08(SB)/8, $0x0403030203020201
+DATA nibbleCounts<>+0x10(SB)/8, $0x0302020102010100
+DATA nibbleCounts<>+0x18(SB)/8, $0x0403030203020201
+GLOBL nibbleCounts<>(SB), RODATA|NOPTR, $32
+
+DATA lowNibbles<>+0x00(SB)/8, $0x0f0f0f0f0f0f0f0f
+DATA lowNibbles<>+0x08(SB)/8, $0x0f0f0f0f0f0f0f0f
+DATA lowNibbles<>+0x10(SB)/8, $0x0f0f0f0f0f0f0f0f
+DATA lowNibbles<>+0x18(SB)/8, $0x0f0f0f0f0f0f0f0f
+GLOBL lowNibbles<>(SB), RODATA|NOPTR, $32
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
+
+// func popcountColumnsAVX2(cols *uint64, stride, words int, query *uint64, dist *int32, n int)
+//
+// Each block loads word w of four hashes side by side, XORs it with word w of the query broadcast to every lane, and
+// counts the bits of every byte by looking its two nibbles up in nibbleCounts. VPSADBW sums the bytes of each lane, so
+// after every word the four lanes hold the distances of the four hashes, which are packed down to int32s.
+TEXT ·popcountColumnsAVX2(SB), NOSPLIT, $0-48
+	MOVQ cols+0(FP), SI
+	MOVQ stride+8(FP), BX
+	SHLQ $3, BX
+	MOVQ words+16(FP), CX
+	MOVQ query+24(FP), DX
+	MOVQ dist+32(FP), DI
+	MOVQ n+40(FP), R8
+	SHRQ $2, R8
+	JZ   done
+	TESTQ CX, CX
+	JZ   done
+
+	VMOVDQU nibbleCounts<>(SB), Y14
+	VMOVDQU lowNibbles<>(SB), Y15
+	VPXOR   Y0, Y0, Y0
+
+block:
+	VPXOR Y5, Y5, Y5
+	MOVQ  SI, R9
+	MOVQ  DX, R10
+	MOVQ  CX, R11
+
+word:
+	VPBROADCASTQ (R10), Y1
+	VPXOR        (R9), Y1, Y2
+	VPAND        Y15, Y2, Y3
+	VPSRLW       $4, Y2, Y4
+	VPAND        Y15, Y4, Y4
+	VPSHUFB      Y3, Y14, Y3
+	VPSHUFB      Y4, Y14, Y4
+	VPADDB       Y3, Y4, Y3
+	VPSADBW      Y0, Y3, Y3
+	VPADDQ       Y3, Y5, Y5
+	ADDQ         BX, R9
+	ADDQ         $8, R10
+	DECQ         R11
+	JNZ          word
+
+	// Keeps the low half of each lane, dword 0 and 2 of each 128 bits, then qword 0 and 2 of the whole register
+	VPSHUFD $0x08, Y5, Y5
+	VPERMQ  $0x08, Y5, Y5
+	VMOVDQU X5, (DI)
+
+	ADDQ $32, SI
+	ADDQ $16, DI
+	DECQ R8
+	JNZ  block
+
+done:
+	VZEROUPPER
+	RET
@@ -0,0 +1,10 @@
+//go:build !amd64 || purego
+
+package imghash
+
+// Only amd64 has a vector version.
+const hasAVX2 = false
+
+func popcountColumns(cols []uint64, stride, words int, query []uint64, dist []int32) {
+	popcountColumnsGeneric(cols, stride, words, query, dist)
+}
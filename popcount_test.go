@@ -0,0 +1,164 @@
+package imghash
+
+import (
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// Every count of hashes, including those that don't fill a block of four, must get the same distances as counting a
+// hash at a time.
+func TestPopcountColumns(t *testing.T) {
+	if !hasAVX2 {
+		t.Log("AVX2 isn't supported, only the generic version is tested")
+	}
+
+	for words := 1; words <= 5; words++ {
+		for n := 0; n <= 13; n++ {
+			stride := n + rand.Intn(4)
+			cols := make([]uint64, words*stride+1)
+			for i := range cols {
+				cols[i] = rand.Uint64()
+			}
+
+			query := make([]uint64, words)
+			for w := range query {
+				query[w] = rand.Uint64()
+			}
+
+			want := make([]int32, n)
+			for i := range want {
+				for w := 0; w < words; w++ {
+					want[i] += int32(bits.OnesCount64(cols[w*stride+i] ^ query[w]))
+				}
+			}
+
+			got, generic := make([]int32, n), make([]int32, n)
+			for i := range got {
+				got[i] = -1 // Stale distances must be overwritten
+			}
+			popcountColumns(cols, stride, words, query, got)
+			popcountColumnsGeneric(cols, stride, words, query, generic)
+
+			for i := range want {
+				if got[i] != want[i] || generic[i] != want[i] {
+					t.Fatalf("%d words, hash %d of %d: got %d and %d, want %d", words, i, n, got[i], generic[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+// A list gives the same distances as Hash.Distance, and only takes hashes with its layout.
+func TestHashList(t *testing.T) {
+	var hashes []Hash
+	for i := 0; i < 103; i++ {
+		h := randomHash(2, 2, uint32(i))
+		h.DiagHash = BitSet{rand.Uint64(), rand.Uint64()}
+		hashes = append(hashes, h)
+	}
+
+	list, err := NewHashList(hashes)
+	if err != nil {
+		t.Fatal(err)
+	} else if list.Len() != len(hashes) {
+		t.Fatalf("list holds %d hashes, want %d", list.Len(), len(hashes))
+	}
+
+	query := noisyHash(hashes[40], 3, 0)
+	query.DiagHash = hashes[40].DiagHash
+	dist, err := list.Distances(&query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range hashes {
+		if want := query.Distance(hashes[i]); int(dist[i]) != want {
+			t.Fatalf("hash %d is %d away, want %d", i, dist[i], want)
+		}
+	}
+
+	if found, err := list.Within(&query, 6); err != nil || len(found) != 1 || found[0] != 40 {
+		t.Errorf("found %v within 6 of a copy of hash 40 (%v)", found, err)
+	}
+
+	if _, err := list.Distances(&hashes[0], nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := list.Distances(&Hash{VHash: BitSet{0}, HHash: BitSet{0}}, nil); err == nil {
+		t.Error("a query with a different layout was compared")
+	}
+	if _, err := NewHashList(append(hashes[:2:2], randomHash(1, 1, 0))); err == nil {
+		t.Error("hashes with different layouts were put in one list")
+	}
+}
+
+// Deduplicating through a list still keeps hashes that only differ in colour, and files that mix layouts still work.
+func TestDeduplicateList(t *testing.T) {
+	h := randomHash(1, 1, 1)
+	h.CbHash, h.CrHash = BitSet{1}, BitSet{2}
+
+	recoloured := h
+	recoloured.Index, recoloured.CrHash = 2, BitSet{3}
+
+	f := NewFile()
+	f.hashes = []Hash{h, recoloured, h, randomHash(1, 1, 4)}
+	f.hashes[3].CbHash, f.hashes[3].CrHash = BitSet{0}, BitSet{0}
+	f.Deduplicate()
+	if f.Length() != 3 || f.hashes[1].Index != 2 {
+		t.Errorf("deduplication left %+v", f.hashes)
+	}
+
+	f.DeduplicateWithMetric(SumMetric{}, 0)
+	if f.Length() != 2 {
+		t.Errorf("deduplicating by luma left %d hashes, want 2", f.Length())
+	}
+
+	mixed := NewFile()
+	mixed.hashes = []Hash{randomHash(1, 1, 1), randomHash(2, 2, 2), randomHash(1, 1, 3)}
+	mixed.hashes = append(mixed.hashes, mixed.hashes[1])
+	mixed.Deduplicate()
+	if mixed.Length() != 3 {
+		t.Errorf("deduplicating mixed layouts left %d hashes, want 3", mixed.Length())
+	}
+}
+
+// Compares one query against 100,000 hashes a hash at a time.
+func BenchmarkHashDistance(b *testing.B) {
+	hashes := make([]Hash, 100000)
+	for i := range hashes {
+		hashes[i] = randomHash(1, 1, uint32(i))
+	}
+	query := randomHash(1, 1, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range hashes {
+			if query.Distance(hashes[j]) == 0 {
+				b.Fatal("unexpected match")
+			}
+		}
+	}
+}
+
+// Compares one query against 100,000 hashes with a HashList.
+func BenchmarkHashListDistances(b *testing.B) {
+	hashes := make([]Hash, 100000)
+	for i := range hashes {
+		hashes[i] = randomHash(1, 1, uint32(i))
+	}
+	query := randomHash(1, 1, 0)
+
+	list, err := NewHashList(hashes)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var dist []int32
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if dist, err = list.Distances(&query, dist); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package imghash
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// The kind of change a preprocessing step makes to an image.
+type StepKind byte
+
+const (
+	// Converts the image to grey with the formula in Step.Luma.
+	StepLuma StepKind = iota + 1
+
+	// Blurs the image with a gaussian of standard deviation Step.Sigma.
+	StepBlur
+
+	// Spreads the brightness of the image out so every level is used about as often.
+	StepEqualise
+
+	// Stretches the brightness of the image linearly so the darkest pixel is black and the brightest white.
+	StepNormalise
+
+	// Cuts Step.Crop off each side of the image.
+	StepCrop
+)
+
+// The formula a StepLuma step turns colours into grey with.
+type Luma byte
+
+const (
+	LumaBT601  Luma = iota // The same weights the hashers use, from the JPEG specification
+	LumaBT709              // The weights of HD video, which count green for more and blue for less
+	LumaLinear             // BT.709 weights applied to linear light rather than gamma encoded values, then encoded again
+)
+
+// One step of a Preprocess chain. Only the fields its kind uses need to be set.
+type Step struct {
+	Kind StepKind
+
+	// The formula used by StepLuma.
+	Luma Luma
+
+	// The standard deviation of a StepBlur, in pixels of the image the chain runs on.
+	Sigma float64
+
+	// The fraction of the width or height StepCrop cuts off the left, top, right and bottom, in that order.
+	Crop [4]float64
+}
+
+// Preprocess is a chain of steps run over every image in order after it is decoded and before it is hashed. Since it
+// changes every hash, it is recorded in the file so queries can be hashed the same way.
+//
+// The chain runs on the image scaled to preprocessScale times the size being hashed, whatever the source resolution,
+// so a blur has the same effect on a large photo as on a small thumbnail of it. The result is then scaled down to size
+// with Options.Filter, the same as images without a chain.
+type Preprocess []Step
+
+// How many times larger than the hasher's size images are when the preprocessing chain runs on them.
+const preprocessScale = 8
+
+// Returns how many times larger than the hasher's size an image has to be scaled to before it is passed to finish.
+func (p Preprocess) scale() int {
+	if len(p) == 0 {
+		return 1
+	}
+	return preprocessScale
+}
+
+// Returns an error if any step is invalid.
+func (p Preprocess) validate() error {
+	if len(p) > math.MaxUint8 {
+		return errors.Errorf("preprocessing can't have more than %d steps", math.MaxUint8)
+	}
+
+	for i, s := range p {
+		switch s.Kind {
+		case StepLuma:
+			if s.Luma > LumaLinear {
+				return errors.Errorf("step %d has an unknown luma formula %d", i, s.Luma)
+			}
+		case StepBlur:
+			if !(s.Sigma > 0 && s.Sigma <= 64) {
+				return errors.Errorf("step %d blurs by %g, must be greater than 0 and at most 64", i, s.Sigma)
+			}
+		case StepCrop:
+			for _, c := range s.Crop {
+				if !(c >= 0 && c < 1) {
+					return errors.Errorf("step %d crops by %v, each side must be at least 0 and less than 1", i, s.Crop)
+				}
+			}
+			if s.Crop[0]+s.Crop[2] >= 1 || s.Crop[1]+s.Crop[3] >= 1 {
+				return errors.Errorf("step %d crops by %v, which leaves nothing", i, s.Crop)
+			}
+		case StepEqualise, StepNormalise:
+		default:
+			return errors.Errorf("step %d is of unknown kind %d", i, s.Kind)
+		}
+	}
+	return nil
+}
+
+// Runs every step over an image already scaled by p.scale(), then scales the result down to w*h with the filter.
+// The image is returned as is if there are no steps.
+func (p Preprocess) finish(img *image.NRGBA, w, h int, filter Filter) (*image.NRGBA, error) {
+	if len(p) == 0 {
+		return img, nil
+	}
+
+	// Every step writes to a copy so the image passed in, which may be shared, is left untouched
+	img = cloneNRGBA(img)
+	for _, s := range p {
+		switch s.Kind {
+		case StepLuma:
+			lumaStep(img, s.Luma)
+		case StepBlur:
+			img = blurStep(img, s.Sigma)
+		case StepEqualise:
+			equaliseStep(img)
+		case StepNormalise:
+			normaliseStep(img)
+		case StepCrop:
+			dx, dy := float64(img.Rect.Dx()), float64(img.Rect.Dy())
+			r := image.Rect(
+				int(math.Round(s.Crop[0]*dx)), int(math.Round(s.Crop[1]*dy)),
+				int(math.Round((1-s.Crop[2])*dx)), int(math.Round((1-s.Crop[3])*dy)),
+			)
+			if r.Empty() {
+				return nil, errors.Errorf("cropping %v off a %dx%d image leaves nothing", s.Crop, img.Rect.Dx(), img.Rect.Dy())
+			}
+			img = toNRGBA(img.SubImage(r.Add(img.Rect.Min)))
+		}
+	}
+
+	return resizeImage(img, w, h, filter)
+}
+
+// Returns a copy of the image with its bounds starting at the origin.
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, img.Rect.Dx(), img.Rect.Dy()))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		copy(dst.Pix[y*dst.Stride:(y+1)*dst.Stride], img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):])
+	}
+	return dst
+}
+
+// Tables converting between 8 bit sRGB values and linear light, the latter scaled to 0-65535.
+var (
+	srgbToLinear [256]float64
+	linearToSRGB [65536]uint8
+)
+
+func init() {
+	for i := range srgbToLinear {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			c /= 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		srgbToLinear[i] = c * 65535
+	}
+
+	for i := range linearToSRGB {
+		c := float64(i) / 65535
+		if c <= 0.0031308 {
+			c *= 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		linearToSRGB[i] = uint8(math.Round(c * 255))
+	}
+}
+
+// Replaces every pixel with its grey level under the formula, keeping its alpha.
+func lumaStep(img *image.NRGBA, formula Luma) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b := img.Pix[i], img.Pix[i+1], img.Pix[i+2]
+
+		var y uint8
+		switch formula {
+		case LumaBT601:
+			y = rgbToY(r, g, b)
+		case LumaBT709:
+			y = uint8((13933*int32(r) + 46871*int32(g) + 4732*int32(b) + 1<<15) >> 16)
+		case LumaLinear:
+			l := 0.2126*srgbToLinear[r] + 0.7152*srgbToLinear[g] + 0.0722*srgbToLinear[b]
+			y = linearToSRGB[int(math.Min(math.Round(l), 65535))]
+		}
+
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = y, y, y
+	}
+}
+
+// Returns a copy of the image blurred by a gaussian, run over the rows and then the columns. Pixels past the edges
+// are taken to be copies of the nearest edge pixel, so the edges don't darken.
+func blurStep(img *image.NRGBA, sigma float64) *image.NRGBA {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+
+	var sum float64
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		} else if v >= max {
+			return max - 1
+		}
+		return v
+	}
+
+	// Runs the kernel along one direction of src, where step moves to the next pixel along it
+	pass := func(src *image.NRGBA, horizontal bool) *image.NRGBA {
+		dst := image.NewNRGBA(src.Rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var acc [4]float64
+				for k, weight := range kernel {
+					sx, sy := x, y
+					if horizontal {
+						sx = clamp(x+k-radius, w)
+					} else {
+						sy = clamp(y+k-radius, h)
+					}
+
+					p := src.Pix[src.PixOffset(sx, sy):]
+					for c := range acc {
+						acc[c] += float64(p[c]) * weight
+					}
+				}
+
+				p := dst.Pix[dst.PixOffset(x, y):]
+				for c := range acc {
+					p[c] = uint8(math.Min(math.Round(acc[c]), 255))
+				}
+			}
+		}
+		return dst
+	}
+
+	return pass(pass(img, true), false)
+}
+
+// Remaps the brightness of every pixel through table, keeping its colour, by way of YCbCr.
+func mapLuma(img *image.NRGBA, table *[256]uint8) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		y, cb, cr := color.RGBToYCbCr(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = color.YCbCrToRGB(table[y], cb, cr)
+	}
+}
+
+// Returns how many pixels of the image have each brightness.
+func lumaHistogram(img *image.NRGBA) (hist [256]int) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		y, _, _ := color.RGBToYCbCr(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		hist[y]++
+	}
+	return
+}
+
+// Maps each brightness to the fraction of pixels at or below it, stretched so the darkest level in use becomes black.
+func equaliseStep(img *image.NRGBA) {
+	hist := lumaHistogram(img)
+
+	var cdf [256]int
+	total, lowest := 0, -1
+	for i, n := range hist {
+		total += n
+		cdf[i] = total
+		if lowest < 0 && n > 0 {
+			lowest = cdf[i]
+		}
+	}
+
+	// A single brightness has nothing to spread out
+	if total == lowest {
+		return
+	}
+
+	var table [256]uint8
+	for i := range table {
+		if cdf[i] > lowest {
+			table[i] = uint8(math.Round(float64(cdf[i]-lowest) * 255 / float64(total-lowest)))
+		}
+	}
+	mapLuma(img, &table)
+}
+
+// Stretches the range of brightness in the image out to 0-255.
+func normaliseStep(img *image.NRGBA) {
+	hist := lumaHistogram(img)
+
+	lo, hi := 0, 255
+	for lo < 255 && hist[lo] == 0 {
+		lo++
+	}
+	for hi > 0 && hist[hi] == 0 {
+		hi--
+	}
+
+	if hi <= lo {
+		return
+	}
+
+	var table [256]uint8
+	for i := range table {
+		table[i] = uint8(math.Round(math.Max(0, math.Min(255, float64(i-lo)*255/float64(hi-lo)))))
+	}
+	mapLuma(img, &table)
+}
+
+// Encodes the chain as the number of steps, followed by the kind of each step and whatever it needs. Floats are
+// stored as the bits of a float32.
+func (p Preprocess) marshal() []byte {
+	buf := []byte{byte(len(p))}
+	putFloat := func(f float64) { buf = putUint32(buf, math.Float32bits(float32(f))) }
+
+	for _, s := range p {
+		buf = append(buf, byte(s.Kind))
+		switch s.Kind {
+		case StepLuma:
+			buf = append(buf, byte(s.Luma))
+		case StepBlur:
+			putFloat(s.Sigma)
+		case StepCrop:
+			for _, c := range s.Crop {
+				putFloat(c)
+			}
+		}
+	}
+	return buf
+}
+
+func (p *Preprocess) unmarshal(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("preprocessing section is empty")
+	}
+
+	n := int(data[0])
+	data = data[1:]
+
+	// Returns the next n bytes of data, or nil if there aren't enough
+	next := func(n int) []byte {
+		if len(data) < n {
+			return nil
+		}
+		b := data[:n]
+		data = data[n:]
+		return b
+	}
+	getFloat := func() (float64, bool) {
+		b := next(4)
+		if b == nil {
+			return 0, false
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), true
+	}
+
+	steps := make(Preprocess, n)
+	for i := range steps {
+		kind := next(1)
+		if kind == nil {
+			return errors.Errorf("preprocessing section ends before step %d", i)
+		}
+
+		s := &steps[i]
+		s.Kind = StepKind(kind[0])
+
+		ok := true
+		switch s.Kind {
+		case StepLuma:
+			if b := next(1); b != nil {
+				s.Luma = Luma(b[0])
+			} else {
+				ok = false
+			}
+		case StepBlur:
+			s.Sigma, ok = getFloat()
+		case StepCrop:
+			for c := range s.Crop {
+				if s.Crop[c], ok = getFloat(); !ok {
+					break
+				}
+			}
+		case StepEqualise, StepNormalise:
+		default:
+			return errors.Errorf("preprocessing step %d is of unknown kind %d", i, s.Kind)
+		}
+
+		if !ok {
+			return errors.Errorf("preprocessing section ends in the middle of step %d", i)
+		}
+	}
+
+	if len(data) != 0 {
+		return errors.Errorf("preprocessing section has %d bytes left over", len(data))
+	}
+
+	*p = steps
+	return nil
+}
+
+// Returns whether both chains have the same steps, as far as they are recorded in a file.
+func (p Preprocess) equal(o Preprocess) bool {
+	return string(p.marshal()) == string(o.marshal())
+}
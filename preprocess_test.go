@@ -0,0 +1,138 @@
+package imghash
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// Returns a w*h image filled with a single colour.
+func solidImage(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// Each step must change the image the way it says it does.
+func TestPreprocessSteps(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	for formula, want := range map[Luma]uint8{LumaBT601: 76, LumaBT709: 54, LumaLinear: 127} {
+		img := solidImage(2, 2, red)
+		lumaStep(img, formula)
+		if p := img.Pix[:4]; p[0] != want || p[1] != want || p[2] != want || p[3] != 0xff {
+			t.Fatalf("luma formula %d turned red into %v, expected %d", formula, p, want)
+		}
+	}
+
+	// Two close levels are spread out to black and white by both equalising and normalising
+	for name, step := range map[string]func(*image.NRGBA){"equalise": equaliseStep, "normalise": normaliseStep} {
+		img := solidImage(4, 1, color.NRGBA{100, 100, 100, 0xff})
+		copy(img.Pix[8:], []uint8{110, 110, 110, 0xff, 110, 110, 110, 0xff})
+		step(img)
+		if img.Pix[0] != 0 || img.Pix[8] != 255 {
+			t.Fatalf("%s gave levels %d and %d, expected 0 and 255", name, img.Pix[0], img.Pix[8])
+		}
+	}
+
+	// Blurring a flat image changes nothing, and spreads a single dot out evenly without losing any of it
+	flat := blurStep(solidImage(5, 5, color.NRGBA{40, 80, 120, 0xff}), 1.5)
+	for i := 0; i < len(flat.Pix); i += 4 {
+		if flat.Pix[i] != 40 || flat.Pix[i+1] != 80 || flat.Pix[i+2] != 120 {
+			t.Fatalf("blurring a flat image changed pixel %d to %v", i/4, flat.Pix[i:i+4])
+		}
+	}
+
+	dot := solidImage(9, 9, color.NRGBA{A: 0xff})
+	dot.SetNRGBA(4, 4, color.NRGBA{255, 255, 255, 0xff})
+	dot = blurStep(dot, 1)
+	if l, r, c := dot.NRGBAAt(3, 4).R, dot.NRGBAAt(5, 4).R, dot.NRGBAAt(4, 4).R; l != r || l == 0 || c <= l {
+		t.Fatalf("blurred dot had %d, %d, %d across its middle", l, c, r)
+	}
+
+	// Cropping a quarter off the left keeps the right three quarters, scaled back up to size
+	half := solidImage(8, 8, color.NRGBA{A: 0xff})
+	for y := 0; y < 8; y++ {
+		half.SetNRGBA(0, y, color.NRGBA{255, 255, 255, 0xff})
+		half.SetNRGBA(1, y, color.NRGBA{255, 255, 255, 0xff})
+	}
+	cropped, err := Preprocess{{Kind: StepCrop, Crop: [4]float64{0.25, 0, 0, 0}}}.finish(half, 4, 4, FilterBilinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(cropped.Pix); i += 4 {
+		if cropped.Pix[i] != 0 {
+			t.Fatalf("cropped image still has white at pixel %d", i/4)
+		}
+	}
+
+	// The chain scales its result down with the caller's filter, not always bilinear
+	noise := blobImage(t, rand.New(rand.NewSource(1)), 12, 64, 64)
+	blur := Preprocess{{Kind: StepBlur, Sigma: 1}}
+	for _, f := range []Filter{FilterBilinear, FilterArea, FilterLanczos} {
+		got, err := blur.finish(noise, 8, 8, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := Resize(blurStep(noise, 1), 8, 8, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Pix) != string(want.Pix) {
+			t.Fatalf("preprocessing with the %s filter scaled differently to resizing with it", f)
+		}
+	}
+}
+
+// Preprocessing must change the hash, be recorded in the file and stop trees mixing chains.
+func TestPreprocessFile(t *testing.T) {
+	chain := Preprocess{
+		{Kind: StepCrop, Crop: [4]float64{0.1, 0, 0.1, 0.05}},
+		{Kind: StepLuma, Luma: LumaLinear},
+		{Kind: StepBlur, Sigma: 2},
+		{Kind: StepEqualise},
+		{Kind: StepNormalise},
+	}
+
+	img := blobImage(t, rand.New(rand.NewSource(1)), 12, 200, 150)
+	plain, err := HashImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := HashImageWithOptions(img, Options{Filter: FilterBilinear, Preprocess: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Equal(processed) {
+		t.Fatal("preprocessing didn't change the hash")
+	}
+
+	f := NewFile()
+	f.filter = FilterBilinear
+	f.preprocess = chain
+	f.hashes = []Hash{processed}
+
+	loaded := roundTrip(t, f)
+	if !loaded.Preprocess().equal(chain) || loaded.Preprocess()[2].Sigma != 2 {
+		t.Fatalf("preprocessing was %v, expected %v", loaded.Preprocess(), chain)
+	}
+
+	// Hashing a query with the file's options must give exactly the hash that was stored
+	query, err := HashImageWithOptions(img, loaded.Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !query.Equal(loaded.hashes[0]) {
+		t.Fatal("query hashed with the file's options doesn't match")
+	}
+
+	if _, err := NewTreeFromFiles(loaded, NewFile()); err == nil {
+		t.Fatal("expected an error mixing preprocessed and plain files in a tree")
+	}
+
+	if _, err := HashImageWithOptions(img, Options{Filter: FilterBilinear, Preprocess: Preprocess{{Kind: StepBlur}}}); err == nil {
+		t.Fatal("expected an error blurring by 0")
+	}
+}
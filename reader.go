@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"io/fs"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 
 	"github.com/pkg/errors"
+	_ "golang.org/x/image/webp"
 )
 
 var (
@@ -44,75 +49,184 @@ func inSlice[T comparable](arr []T, elem T) bool {
 	return false
 }
 
-func ffmpegRunner(name string, video bool) (*[]Hash, error) {
-	filter := fmt.Sprintf("scale=%dx%d:flags=bilinear,format=rgba", width, height)
+// The number of frames read from ffmpeg and hashed at once.
+const batchFrames = 1024
+
+// Hashes every frame of a video, or a single image, with an ffmpeg process. The returned rectangle is
+// the area every frame was cropped to, which is empty unless opts.AutoCrop is set.
+func ffmpegRunner(name string, video bool, hasher Hasher, opts Options) (*[]Hash, image.Rectangle, error) {
+	var crop image.Rectangle
+	if opts.Features > 0 {
+		return nil, crop, errors.Errorf("features can't be detected in %q, only in images Go can decode", name)
+	}
+	if opts.AutoCrop {
+		var err error
+		if crop, err = cropdetect(name, opts); err != nil {
+			return nil, crop, errors.Wrap(err, "detecting borders")
+		}
+	}
+
+	// With tiles every frame is scaled twice, and the two are stacked on top of each other so they come out together.
+	// Preprocessing happens in Go, on frames scaled larger than they are hashed at.
+	batch := newBatchHasher(hasher, opts)
+	sw, sh := batch.sw, batch.sh
+	fw, fh := batch.FrameSize()
+	filter := fmt.Sprintf("scale=%dx%d:flags=bilinear,format=rgba", sw, sh)
+	if opts.Tiles > 0 {
+		c := tileCanvas(opts.Tiles) * opts.Preprocess.scale()
+		filter = fmt.Sprintf("split[a][b];[a]scale=%dx%d:flags=bilinear,pad=%d:%d[a];[b]scale=%dx%d:flags=bilinear,pad=%d:%d[b];[a][b]vstack,format=rgba",
+			sw, sh, fw, sh, c, c, fw, c)
+	}
+
+	if c := cropFilter(crop); c != "" {
+		filter = c + "," + filter
+	}
+
+	if bg := opts.Background.ffmpegFilter(); bg != "" {
+		filter = bg + "," + filter
+	}
+
 	if video {
 		filter = "fps=12," + filter
 	}
 
-	var (
-		buf    bytes.Buffer
-		errbuf bytes.Buffer
-	)
+	var errbuf bytes.Buffer
 
 	cmd := exec.Command("ffmpeg", "-hide_banner", "-i", name, "-vf", filter, "-f", "rawvideo", "pipe:1")
-	cmd.Stdout = &buf
 	cmd.Stderr = &errbuf
 
-	if err := cmd.Run(); err != nil {
-		return nil, errors.Wrapf(err, "running command (stderr: %s)", errbuf.String())
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, crop, errors.Wrap(err, "opening ffmpeg output")
 	}
 
-	img := image.NewNRGBA(image.Rect(0, 0, width, height))
-
-	if buf.Len()%len(img.Pix) != 0 {
-		return nil, errors.Errorf("buffer length must be a multiple of image size (%d), but was %d", len(img.Pix), buf.Len())
+	if err := cmd.Start(); err != nil {
+		return nil, crop, errors.Wrap(err, "starting ffmpeg")
 	}
 
-	hashes := make([]Hash, buf.Len()/len(img.Pix)) // The number of images from FFmpeg's buffer
+	// Frames are read and hashed a chunk at a time through the same buffer, so memory use doesn't grow with the video
+	var hashes []Hash
+	buf := make([]byte, batchFrames*4*fw*fh)
+	for {
+		n, readErr := io.ReadFull(stdout, buf)
+		if n > 0 {
+			// Nothing reads the rest of the output once hashing fails, so ffmpeg is killed rather than waited on, as it
+			// would otherwise block forever writing to a full pipe
+			if hashes, err = batch.HashFrames(hashes, buf[:n]); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return nil, crop, errors.Wrap(err, "hashing frames")
+			}
+		}
 
-	var idx uint32
-	for buf.Len() > 0 {
-		idx++
-		if _, err := buf.Read(img.Pix); err != nil {
-			return nil, err
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, crop, errors.Wrap(readErr, "reading frames")
 		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, crop, errors.Wrapf(err, "running command (stderr: %s)", errbuf.String())
+	}
+
+	return &hashes, crop, nil
+}
+
+// Hashes a still image, returning the filter it was actually scaled with. Images are decoded and scaled in Go, which is
+// far cheaper than starting an ffmpeg process, unless the filter is FilterFFmpeg or they're in a format Go can't decode.
+// Hashers that scale images themselves are always given the decoded image, and the rest of the hash is scaled with
+// FilterBilinear in place of ffmpeg.
+func imageRunner(name string, hasher Hasher, opts Options) (*[]Hash, image.Rectangle, Filter, error) {
+	if _, ok := hasher.(SourceHasher); ok && len(opts.Preprocess) == 0 && opts.Filter == FilterFFmpeg {
+		opts.Filter = FilterBilinear
+	} else if opts.Filter == FilterFFmpeg {
+		hashes, crop, err := ffmpegRunner(name, false, hasher, opts)
+		return hashes, crop, FilterFFmpeg, err
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, image.Rectangle{}, opts.Filter, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err == image.ErrFormat && !opts.Windows {
+		hashes, crop, err := ffmpegRunner(name, false, hasher, opts)
+		return hashes, crop, FilterFFmpeg, err
+	} else if err != nil {
+		return nil, image.Rectangle{}, opts.Filter, errors.Wrap(err, "decoding image")
+	}
 
-		hh, vh, err := differenceHash(img)
+	if opts.Windows {
+		hashes, crop, err := windowHashes(img, hasher, opts)
 		if err != nil {
-			return nil, errors.Wrapf(err, "creating hash for frame %d", idx)
+			return nil, crop, opts.Filter, errors.Wrap(err, "creating window hashes")
 		}
+		return &hashes, crop, opts.Filter, nil
+	}
 
-		h := &hashes[idx-1]
-		h.VHash = vh
-		h.HHash = hh
-		h.Index = idx
+	hash, crop, err := hashImage(img, hasher, opts)
+	if err != nil {
+		return nil, crop, opts.Filter, errors.Wrap(err, "creating hash")
 	}
 
-	return &hashes, nil
+	hash.Index = 1 // Matches the index of the single frame ffmpeg would have produced
+	return &[]Hash{hash}, crop, opts.Filter, nil
 }
 
-// Walks through a directory and all subdirectories, handling each image and video it finds into a single file
-func fromdirectory(dir string) (*[]Hash, error) {
-	var hashes []Hash
+// Walks through a directory and all subdirectories, handling each image and video it finds into a single file. A file
+// records a single filter, so every source has to be scaled with the same one, which is returned.
+func fromdirectory(dir string, hasher Hasher, opts Options) (*[]Hash, []Source, Filter, error) {
+	var (
+		hashes  []Hash
+		sources []Source
+		scaled  = opts.Filter
+	)
 
 	err := fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return err
 		}
 
-		if vid := inSlice(videoExtensions, path); vid || inSlice(imageExtensions, path) {
-			h, err := ffmpegRunner(path, vid)
-			if err != nil {
-				return err // TODO: maybe more descriptive?
-			}
+		var (
+			h      *[]Hash
+			crop   image.Rectangle
+			filter Filter
+		)
 
-			hashes = append(hashes, *h...)
+		if ext := filepath.Ext(path); inSlice(videoExtensions, ext) {
+			h, crop, err = ffmpegRunner(filepath.Join(dir, path), true, hasher, opts)
+			filter = FilterFFmpeg
+		} else if inSlice(imageExtensions, ext) {
+			h, crop, filter, err = imageRunner(filepath.Join(dir, path), hasher, opts)
+		} else {
+			return nil
 		}
+
+		if err != nil {
+			return err // TODO: maybe more descriptive?
+		}
+
+		if len(sources) > 0 && filter != scaled {
+			return errors.Errorf("%q was scaled with the %s filter and %q with the %s filter, which can't be mixed in one file",
+				sources[0].Path, scaled, path, filter)
+		}
+		scaled = filter
+
+		for i := range *h {
+			(*h)[i].Source = uint32(len(sources))
+		}
+
+		hashes = append(hashes, *h...)
+		sources = append(sources, Source{Path: filepath.ToSlash(path), Crop: crop})
 		return nil
 	})
 
-	return &hashes, err
+	return &hashes, sources, scaled, err
 }
 
 // NewFromPath returns a new file object with a different configuration based on the path provided:
@@ -121,41 +235,198 @@ func fromdirectory(dir string) (*[]Hash, error) {
 // If the path provided is a directory, the returned file will have hashes of every image/video within the directory, including recursive directories
 // Otherwise, the function will return an error of type InvalidExtension
 func NewFromPath(path string) (*File, error) {
+	return NewFromPathWithHasher(path, DefaultHasher)
+}
+
+// Identical to NewFromPath, but hashes with the registered hasher of the given name instead of the default.
+// Returns an error of type UnknownHasher if no hasher is registered under that name.
+func NewFromPathWithHasher(path string, name string) (*File, error) {
+	return NewFromPathWithOptions(path, Options{Hasher: name})
+}
+
+// Options control how NewFromPathWithOptions hashes a path. The zero value hashes the same way as NewFromPath.
+type Options struct {
+	// The name of the registered hasher to use, or DefaultHasher if empty.
+	Hasher string
+
+	// The filter used to scale still images, which is FilterFFmpeg by default so hashes match older files. Videos, and
+	// images Go can't decode, are always scaled by ffmpeg, and files record the filter their hashes were actually scaled
+	// with. A directory whose sources would be scaled with different filters, such as videos alongside images scaled
+	// in Go, returns an error.
+	Filter Filter
+
+	// The background transparent images and videos are composited over before they are scaled.
+	Background Background
+
+	// Whether black bars around the picture are detected and cropped off before hashing. Videos are
+	// cropped to the largest area found across every frame, which is stored in the file's sources.
+	AutoCrop bool
+
+	// Marks every bit of a hash decided by two values that differ by less than this as unstable, storing them
+	// in Hash.VMask and Hash.HMask so they can be ignored by MaskedDistance. Zero disables masks, and only
+	// hashers that implement MaskedHasher support them.
+	MaskThreshold uint8
+
+	// Whether Hash.CbHash and Hash.CrHash are filled in, so comparisons can tell recoloured copies apart.
+	Colour bool
+
+	// Whether Hash.DiagHash is filled in, adding a diagonal direction to the distance between hashes. Only difference
+	// hashers support it.
+	Diagonal bool
+
+	// The size of the grid of overlapping tiles hashed into Hash.Tiles alongside the whole image, so cropped copies
+	// can be found with HashImageTiled. Zero disables tiles, otherwise it must be between 2 and 16. Larger grids place
+	// crops more precisely but take far longer to search.
+	Tiles int
+
+	// Whether a still image is hashed as overlapping windows at several scales rather than as a whole, so a query such
+	// as a collage can be searched for the images embedded in it with Tree.NearestWindows. Each hash records the
+	// window it came from in Hash.Region. Only single images that Go can decode can be hashed this way, with a filter
+	// that scales in Go.
+	Windows bool
+
+	// The fractions of the image's width and height that windows are cut at, or DefaultWindowScales if empty.
+	WindowScales []float64
+
+	// Steps run over every image and frame in Go before it is hashed, which are stored in the file.
+	Preprocess Preprocess
+
+	// The most keypoints detected in each still image and stored in Hash.Features, so heavily cropped copies can be
+	// found with Tree.NearestFeatures. Zero disables features. They are only detected in images Go can decode, so
+	// hashing a video, an image in a format Go can't decode or anything with the default FilterFFmpeg returns an error
+	// rather than leaving some hashes without features, and they can't be combined with windows.
+	Features int
+
+	// The number of consecutive frames each temporal signature in File.Clips covers, so clips of videos can be looked up
+	// with NewTreeFromClips. Zero disables clips, otherwise it must be between 4 and 65535. DefaultClipFrames covers
+	// five seconds. Clips are computed before duplicate frames are dropped, and can't be combined with windows.
+	ClipFrames int
+
+	// What is done with frames whose Hash.Information score is below MinInformation, such as fades to black, white
+	// flashes and flat title cards, which are only a few bits away from each other. Every hash is scored either way.
+	Information InformationMode
+
+	// The score frames need to not be low information, or DefaultMinInformation if zero.
+	MinInformation uint8
+}
+
+// Returns an error if any of the options are invalid.
+func (opts Options) validate() error {
+	if err := checkTiles(opts.Tiles); err != nil {
+		return err
+	}
+
+	if opts.Features < 0 || opts.Features > math.MaxUint16 {
+		return errors.Errorf("features must be between 0 and %d, not %d", math.MaxUint16, opts.Features)
+	} else if opts.Features > 0 && opts.Windows {
+		return errors.New("features can't be detected in windows")
+	} else if opts.Features > 0 && opts.Filter == FilterFFmpeg {
+		return errors.New("features can't be detected in images scaled by ffmpeg")
+	} else if opts.Windows && opts.Filter == FilterFFmpeg {
+		return errors.New("windows can't be scaled by ffmpeg")
+	}
+
+	if err := checkClipFrames(opts.ClipFrames); err != nil {
+		return err
+	} else if opts.ClipFrames > 0 && opts.Windows {
+		return errors.New("clips can't be computed from windows")
+	}
+
+	if err := opts.Information.validate(); err != nil {
+		return err
+	}
+	return errors.Wrap(opts.Preprocess.validate(), "invalid preprocessing")
+}
+
+// Identical to NewFromPath, but hashes using the provided options.
+// Returns an error of type UnknownHasher if no hasher is registered under the name in the options.
+func NewFromPathWithOptions(path string, opts Options) (*File, error) {
+	if opts.Hasher == "" {
+		opts.Hasher = DefaultHasher
+	}
+
+	hasher, err := LookupHasher(opts.Hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
-	var hashes *[]Hash
+	var (
+		hashes  *[]Hash
+		sources []Source
+		crop    image.Rectangle
+		filter  Filter
+	)
+
+	if opts.Windows && (info.IsDir() || !inSlice(imageExtensions, filepath.Ext(info.Name()))) {
+		return nil, errors.New("windows can only be hashed from a single image")
+	}
+
 	if info.IsDir() {
-		hashes, err = fromdirectory(path)
+		hashes, sources, filter, err = fromdirectory(path, hasher, opts)
 		if err != nil {
 			return nil, errors.Wrap(err, "hashing directory")
 		}
 	} else if ext := filepath.Ext(info.Name()); inSlice(imageExtensions, ext) {
-		hashes, err = ffmpegRunner(path, false)
+		hashes, crop, filter, err = imageRunner(path, hasher, opts)
 		if err != nil {
 			return nil, errors.Wrap(err, "hashing image")
 		}
 
 		// This shouldn't be possible
-		if len(*hashes) != 1 {
+		if len(*hashes) != 1 && !opts.Windows {
 			return nil, errors.Errorf("%d hashes created instead of 1", len(*hashes))
 		}
 	} else if inSlice(videoExtensions, ext) {
-		hashes, err = ffmpegRunner(path, true)
+		hashes, crop, err = ffmpegRunner(path, true, hasher, opts)
 		if err != nil {
 			return nil, errors.Wrap(err, "hashing video")
 		}
+		filter = FilterFFmpeg
 	} else {
 		//return nil, errors.Errorf("Invalid extension on file %q", info.Name())
 		return nil, InvalidExtension{ext: info.Name()}
 	}
 
-	file := NewFile()
+	if !info.IsDir() {
+		sources = []Source{{Path: info.Name(), Crop: crop}}
+	}
+
+	file := NewFileWithHasher(hasher.Name())
+	file.filter = filter
+	file.background = opts.Background
+	file.sources = sources
+	file.maskThreshold = opts.MaskThreshold
+	file.tiles = opts.Tiles
+	file.preprocess = opts.Preprocess
+	file.features = opts.Features
+	file.clipFrames = opts.ClipFrames
+	file.information = opts.Information
+	file.minInformation = minInformation(opts.Information, opts.MinInformation)
 	file.hashes = *hashes
 	file.path = path
-	file.Deduplicate()
+
+	// Clips are voted on over every frame, so they have to be computed before frames are dropped
+	if file.clips, err = clipsBySource(file.hashes, opts.ClipFrames); err != nil {
+		return nil, errors.Wrap(err, "computing clips")
+	}
+
+	if opts.Information == InformationDrop {
+		file.hashes = dropLowInformation(file.hashes, file.minInformation)
+	}
+
+	// Windows with the same hash in different places are different regions of the query, so they are all kept
+	if !opts.Windows {
+		file.Deduplicate()
+	}
 
 	return file, nil
 }
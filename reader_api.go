@@ -47,6 +47,16 @@ func AvErrorStr(averr int) error {
 }
 
 func NewFromVideo2(name string) (*File, error) {
+	return NewFromVideo2WithHasher(name, DefaultHasher)
+}
+
+func NewFromVideo2WithHasher(name string, hasherName string) (*File, error) {
+	hasher, err := LookupHasher(hasherName)
+	if err != nil {
+		return nil, err
+	}
+	width, height := hasher.Size()
+
 	nm := C.CString(name)
 	defer C.free(unsafe.Pointer(nm))
 
@@ -161,7 +171,7 @@ func NewFromVideo2(name string) (*File, error) {
 	img.Stride = 4 * width
 	img.Rect = image.Rect(0, 0, width, height)
 
-	file := new(File)
+	file := NewFileWithHasher(hasher.Name())
 
 	for {
 		if ret = C.av_read_frame(inputCtx, packet); ret < 0 {
@@ -208,16 +218,13 @@ func NewFromVideo2(name string) (*File, error) {
 				//log.Println(frame.pts, decCtx.frame_number, encCtx.frame_number, outpacket.size)
 				img.Pix = C.GoBytes(unsafe.Pointer(outpacket.data), outpacket.size)
 
-				hh, vh, err := differenceHash(&img)
+				hash, err := hasher.Hash(&img)
 				if err != nil {
 					return nil, errors.Wrap(err, "creating hash")
 				}
 
-				file.hashes = append(file.hashes, Hash{
-					VHash: vh,
-					HHash: hh,
-					Index: uint32(encCtx.frame_number),
-				})
+				hash.Index = uint32(encCtx.frame_number)
+				file.hashes = append(file.hashes, hash)
 
 				C.av_packet_unref(outpacket)
 			}
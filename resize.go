@@ -0,0 +1,397 @@
+package imghash
+
+import (
+	"image"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// The filter used to scale an image down to the size a hasher expects.
+type Filter byte
+
+const (
+	// Scales images with an ffmpeg process running "scale=WxH:flags=bilinear", which is what every file was hashed
+	// with before images were scaled in Go, including every version 1 file, so it is the default. Images already in
+	// memory are never handed to ffmpeg, so HashImageWithOptions and the other in memory functions refuse it.
+	FilterFFmpeg Filter = iota
+
+	// Uses the same filter coefficients and fixed point rounding as swscale's bilinear filter, scaling the decoded RGB
+	// pixels in Go. ffmpeg scales JPEGs and videos in YUV with the chroma at half resolution and only converts to RGB
+	// afterwards, so the hashes are close to FilterFFmpeg's but not the same, and files record the two separately.
+	FilterBilinear
+
+	// Averages every source pixel that falls within each destination pixel.
+	FilterArea
+
+	// A three lobe Lanczos filter, which keeps edges sharper than the others at the cost of some ringing.
+	FilterLanczos
+)
+
+func (f Filter) String() string {
+	switch f {
+	case FilterFFmpeg:
+		return "ffmpeg"
+	case FilterBilinear:
+		return "bilinear"
+	case FilterArea:
+		return "area"
+	case FilterLanczos:
+		return "lanczos"
+	}
+	return "unknown"
+}
+
+// Precision of the horizontal and vertical filter coefficients, the same as swscale uses for 8 bit output.
+const (
+	horizontalOne = 1 << 14
+	verticalOne   = 1 << 12
+)
+
+// The coefficients needed to scale one dimension of an image, where destination pixel i is the sum
+// of coeffs[i*size+j] * src[pos[i]+j] for every j < size.
+type scaleFilter struct {
+	pos    []int
+	size   int
+	coeffs []int32
+}
+
+// Builds the filter swscale uses for SWS_BILINEAR, following initFilter in libswscale/utils.c. When downscaling it is
+// a tent whose radius is one destination pixel rather than a plain two tap interpolation, so every source pixel counts.
+func bilinearFilter(srcW, dstW int, one int64) scaleFilter {
+	xInc := (int64(srcW)<<16 + int64(dstW>>1)) / int64(dstW)
+
+	// Unscaled, which ffmpeg copies straight through
+	if srcW == dstW {
+		f := scaleFilter{pos: make([]int, dstW), size: 1, coeffs: make([]int32, dstW)}
+		for i := range f.pos {
+			f.pos[i], f.coeffs[i] = i, int32(one)
+		}
+		return f
+	}
+
+	const sizeFactor = 2
+
+	var size int
+	if xInc <= 1<<16 {
+		size = 1 + sizeFactor
+	} else {
+		size = 1 + (sizeFactor*srcW+dstW-1)/dstW
+	}
+
+	if size > srcW-2 {
+		size = srcW - 2
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	logScale := 0
+	for n := srcW / dstW; n > 1; n >>= 1 {
+		logScale++
+	}
+	if logScale > 8 {
+		logScale = 8
+	}
+	fone := int64(1) << (54 - logScale)
+
+	pos := make([]int, dstW)
+	filter := make([]int64, dstW*size)
+
+	// Luma samples are centred, which is a position of 128 in swscale's 1/256th of a pixel units
+	const center = 128
+	xDstInSrc := (center*xInc)>>7 - (center*0x10000)>>7
+	for i := 0; i < dstW; i++ {
+		xx := int((xDstInSrc - int64(size-2)<<16) / (1 << 17))
+		pos[i] = xx
+
+		for j := 0; j < size; j++ {
+			d := int64(xx)<<17 - xDstInSrc
+			if d < 0 {
+				d = -d
+			}
+			d <<= 13
+
+			if xInc > 1<<16 {
+				d = d * int64(dstW) / int64(srcW)
+			}
+
+			coeff := int64(1<<30) - d
+			if coeff < 0 {
+				coeff = 0
+			}
+			filter[i*size+j] = coeff * (fone >> 30)
+			xx++
+		}
+		xDstInSrc += 2 * xInc
+	}
+
+	return finishFilter(srcW, dstW, size, pos, filter, fone, one)
+}
+
+// Builds a filter from a continuous kernel with the given support radius, widening it when downscaling so that every
+// source pixel contributes. The kernel is sampled at pixel centres and quantised the same way as the bilinear filter.
+func kernelFilter(srcW, dstW int, one int64, support float64, kernel func(float64) float64) scaleFilter {
+	scale := float64(srcW) / float64(dstW)
+	if scale < 1 {
+		scale = 1
+	}
+
+	radius := support * scale
+	size := int(math.Ceil(2*radius)) + 2
+
+	const fone = int64(1) << 40
+
+	pos := make([]int, dstW)
+	filter := make([]int64, dstW*size)
+	for i := 0; i < dstW; i++ {
+		center := (float64(i)+0.5)*float64(srcW)/float64(dstW) - 0.5
+		pos[i] = int(math.Floor(center - radius))
+
+		for j := 0; j < size; j++ {
+			filter[i*size+j] = int64(kernel((float64(pos[i]+j)-center)/scale) * float64(fone))
+		}
+	}
+
+	return finishFilter(srcW, dstW, size, pos, filter, fone, one)
+}
+
+// Trims near zero coefficients, folds any that fall outside the image onto its edge pixels and normalises
+// each destination pixel's coefficients to sum to one, diffusing the rounding error as swscale does.
+func finishFilter(srcW, dstW, size int, pos []int, filter []int64, fone, one int64) scaleFilter {
+	const cutoff = 0.002 // SWS_MAX_REDUCE_CUTOFF
+
+	// Shift out near zero coefficients on the left, and count how many can be dropped on the right
+	minSize := 0
+	for i := dstW - 1; i >= 0; i-- {
+		row := filter[i*size : (i+1)*size]
+
+		var acc int64
+		for j := 0; j < size; j++ {
+			acc += abs64(row[0])
+			if float64(acc) > cutoff*float64(fone) {
+				break
+			}
+
+			// The positions must stay in increasing order
+			if i < dstW-1 && pos[i] >= pos[i+1] {
+				break
+			}
+
+			copy(row, row[1:])
+			row[size-1] = 0
+			pos[i]++
+		}
+
+		acc = 0
+		n := size
+		for j := size - 1; j > 0; j-- {
+			acc += abs64(row[j])
+			if float64(acc) > cutoff*float64(fone) {
+				break
+			}
+			n--
+		}
+
+		if n > minSize {
+			minSize = n
+		}
+	}
+
+	if minSize < 1 {
+		minSize = 1
+	}
+
+	trimmed := make([]int64, dstW*minSize)
+	for i := 0; i < dstW; i++ {
+		copy(trimmed[i*minSize:(i+1)*minSize], filter[i*size:])
+	}
+	filter, size = trimmed, minSize
+
+	for i := 0; i < dstW; i++ {
+		row := filter[i*size : (i+1)*size]
+
+		if pos[i] < 0 {
+			for j := 1; j < size; j++ {
+				left := j + pos[i]
+				if left < 0 {
+					left = 0
+				}
+
+				row[left] += row[j]
+				row[j] = 0
+			}
+			pos[i] = 0
+		}
+
+		if pos[i]+size > srcW {
+			shift := pos[i]
+			if size-srcW < 0 {
+				shift += size - srcW
+			}
+
+			var acc int64
+			for j := size - 1; j >= 0; j-- {
+				if pos[i]+j >= srcW {
+					acc += row[j]
+					row[j] = 0
+				}
+			}
+
+			for j := size - 1; j >= 0; j-- {
+				if j < shift {
+					row[j] = 0
+				} else {
+					row[j] = row[j-shift]
+				}
+			}
+
+			pos[i] -= shift
+			row[srcW-1-pos[i]] += acc
+		}
+	}
+
+	f := scaleFilter{pos: pos, size: size, coeffs: make([]int32, len(filter))}
+	for i := 0; i < dstW; i++ {
+		row := filter[i*size : (i+1)*size]
+
+		var sum int64
+		for _, c := range row {
+			sum += c
+		}
+
+		sum = (sum + one/2) / one
+		if sum == 0 {
+			sum = 1
+		}
+
+		var err int64
+		for j, c := range row {
+			v := c + err
+			intV := roundedDiv(v, sum)
+			f.coeffs[i*size+j] = int32(intV)
+			err = v - intV*sum
+		}
+	}
+
+	return f
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Division rounding half away from zero, the same as FFmpeg's ROUNDED_DIV.
+func roundedDiv(a, b int64) int64 {
+	if a >= 0 {
+		return (a + b>>1) / b
+	}
+	return (a - b>>1) / b
+}
+
+func lanczos(x float64) float64 {
+	const a = 3
+
+	x = math.Abs(x)
+	if x == 0 {
+		return 1
+	} else if x >= a {
+		return 0
+	}
+
+	px := math.Pi * x
+	return a * math.Sin(px) * math.Sin(px/a) / (px * px)
+}
+
+// Returns a kernel giving how much of a source pixel, which is width destination pixels wide, overlaps
+// the destination pixel it is x away from. Summed over every source pixel this is the area average.
+func area(width float64) func(float64) float64 {
+	return func(x float64) float64 {
+		overlap := math.Min(x+width/2, 0.5) - math.Max(x-width/2, -0.5)
+		if overlap <= 0 {
+			return 0
+		}
+		return overlap / width
+	}
+}
+
+// Returns the filter used to scale srcW pixels to dstW pixels with the given coefficient precision. Frames ffmpeg has
+// already scaled are only finished off in Go, such as by a preprocessing chain, which uses the same filter it did.
+func (f Filter) build(srcW, dstW int, one int64) (scaleFilter, error) {
+	switch f {
+	case FilterBilinear, FilterFFmpeg:
+		return bilinearFilter(srcW, dstW, one), nil
+	case FilterArea:
+		width := math.Min(float64(dstW)/float64(srcW), 1)
+		return kernelFilter(srcW, dstW, one, 0.5+width/2, area(width)), nil
+	case FilterLanczos:
+		return kernelFilter(srcW, dstW, one, 3, lanczos), nil
+	}
+	return scaleFilter{}, errors.Errorf("unknown filter %d", f)
+}
+
+// Scales an image to w x h with the given filter. Every channel, including alpha, is scaled separately with a 15 bit
+// intermediate and the result rounded the same way swscale's 8 bit output is.
+func Resize(img image.Image, w, h int, filter Filter) (*image.NRGBA, error) {
+	src := toNRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if w <= 0 || h <= 0 || sw == 0 || sh == 0 {
+		return nil, errors.Errorf("cannot scale a %dx%d image to %dx%d", sw, sh, w, h)
+	}
+
+	hf, err := filter.build(sw, w, horizontalOne)
+	if err != nil {
+		return nil, err
+	}
+
+	vf, err := filter.build(sh, h, verticalOne)
+	if err != nil {
+		return nil, err
+	}
+
+	// Horizontal pass into 15 bit intermediates, like hScale8To15
+	tmp := make([]int32, 4*w*sh)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < w; x++ {
+			coeffs := hf.coeffs[x*hf.size : (x+1)*hf.size]
+			for c := 0; c < 4; c++ {
+				var val int32
+				for j, coeff := range coeffs {
+					val += int32(row[4*(hf.pos[x]+j)+c]) * coeff
+				}
+
+				val >>= 7
+				if val > 1<<15-1 {
+					val = 1<<15 - 1
+				}
+				tmp[4*(y*w+x)+c] = val
+			}
+		}
+	}
+
+	// Vertical pass with rounding and clipping back to 8 bits, like yuv2planeX_8
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		coeffs := vf.coeffs[y*vf.size : (y+1)*vf.size]
+		for x := 0; x < 4*w; x++ {
+			val := int32(64 << 12)
+			for j, coeff := range coeffs {
+				val += tmp[(vf.pos[y]+j)*4*w+x] * coeff
+			}
+
+			val >>= 19
+			if val < 0 {
+				val = 0
+			} else if val > 0xff {
+				val = 0xff
+			}
+			dst.Pix[y*dst.Stride+x] = uint8(val)
+		}
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,61 @@
+package imghash
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Halving with swscale's bilinear filter is the well known [1 3 3 1] / 8 kernel, with the edges folded in.
+func TestBilinearFilterHalf(t *testing.T) {
+	f := bilinearFilter(18, 9, horizontalOne)
+
+	for i := 0; i < 9; i++ {
+		var sum int32
+		for _, c := range f.coeffs[i*f.size : (i+1)*f.size] {
+			sum += c
+		}
+
+		if sum != horizontalOne {
+			t.Fatalf("coefficients of pixel %d sum to %d", i, sum)
+		}
+	}
+
+	want := []int32{2048, 6144, 6144, 2048}
+	for i := 1; i < 8; i++ {
+		if f.pos[i] != 2*i-1 {
+			t.Fatalf("pixel %d starts at %d, expected %d", i, f.pos[i], 2*i-1)
+		}
+
+		for j, c := range want {
+			if got := f.coeffs[i*f.size+j]; got != c {
+				t.Fatalf("pixel %d coefficient %d was %d, expected %d", i, j, got, c)
+			}
+		}
+	}
+}
+
+// Every filter must keep a flat image flat, and leave an image that is already the right size untouched.
+func TestResizeFlat(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:], []uint8{200, 100, 50, 255})
+	}
+
+	for _, filter := range []Filter{FilterBilinear, FilterArea, FilterLanczos} {
+		for _, size := range []image.Point{{9, 9}, {32, 32}, {37, 23}, {64, 40}} {
+			dst, err := Resize(src, size.X, size.Y, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					if c := dst.NRGBAAt(x, y); c != (color.NRGBA{200, 100, 50, 255}) {
+						t.Fatalf("%s to %v: pixel (%d, %d) was %v", filter, size, x, y, c)
+					}
+				}
+			}
+		}
+	}
+}
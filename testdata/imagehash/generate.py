@@ -0,0 +1,20 @@
+#!/usr/bin/env python3
+# Writes expected.txt, the hashes Python's imagehash gives fixture.png, which TestImagehashFixture compares the
+# imagehash hashers against. Needs imagehash and Pillow installed, run from this directory. reference.py writes the
+# same hashes without them.
+import imagehash
+from PIL import Image
+
+img = Image.open("fixture.png")
+hashes = [
+    ("imagehash-ahash", imagehash.average_hash(img)),
+    ("imagehash-dhash", imagehash.dhash(img)),
+    ("imagehash-dhash-vertical", imagehash.dhash_vertical(img)),
+    ("imagehash-phash", imagehash.phash(img)),
+    ("imagehash-phash16", imagehash.phash(img, hash_size=16)),
+]
+
+with open("expected.txt", "w") as out:
+    out.write("# imagehash %s, Pillow %s\n" % (imagehash.__version__, Image.__version__))
+    for name, h in hashes:
+        out.write("%s %s\n" % (name, h))
@@ -0,0 +1,209 @@
+#!/usr/bin/env python3
+# Writes expected.txt like generate.py does, but with only the standard library, for machines without imagehash and
+# Pillow. Every step is transcribed from their sources rather than from the Go port: Pillow's RGB to L conversion
+# (rgb2l in Convert.c), its LANCZOS resize (precompute_coeffs, normalize_coeffs_8bpc and the 8 bit passes in
+# Resample.c), and imagehash's average_hash, dhash, dhash_vertical and phash, with scipy.fftpack.dct written out as a
+# plain sum. Running generate.py where imagehash is installed should give the same file apart from its first line.
+import math
+import struct
+import zlib
+
+
+def read_png(name):
+    with open(name, "rb") as f:
+        data = f.read()
+    assert data[:8] == b"\x89PNG\r\n\x1a\n"
+
+    pos, idat = 8, b""
+    while pos < len(data):
+        length, kind = struct.unpack(">I4s", data[pos:pos + 8])
+        body = data[pos + 8:pos + 8 + length]
+        if kind == b"IHDR":
+            width, height, depth, colour, _, _, interlace = struct.unpack(">IIBBBBB", body)
+            assert depth == 8 and colour in (0, 2, 6) and interlace == 0
+        elif kind == b"IDAT":
+            idat += body
+        pos += 12 + length
+
+    channels = {0: 1, 2: 3, 6: 4}[colour]
+    raw = zlib.decompress(idat)
+    stride = width * channels
+    rows, prev = [], bytearray(stride)
+    for y in range(height):
+        kind = raw[y * (stride + 1)]
+        line = bytearray(raw[y * (stride + 1) + 1:(y + 1) * (stride + 1)])
+        for i in range(stride):
+            a = line[i - channels] if i >= channels else 0
+            b = prev[i]
+            c = prev[i - channels] if i >= channels else 0
+            if kind == 1:
+                line[i] = (line[i] + a) & 0xff
+            elif kind == 2:
+                line[i] = (line[i] + b) & 0xff
+            elif kind == 3:
+                line[i] = (line[i] + (a + b) // 2) & 0xff
+            elif kind == 4:
+                p = a + b - c
+                pa, pb, pc = abs(p - a), abs(p - b), abs(p - c)
+                pred = a if pa <= pb and pa <= pc else b if pb <= pc else c
+                line[i] = (line[i] + pred) & 0xff
+        rows.append(line)
+        prev = line
+
+    # Image.convert("L"), which ignores alpha
+    luma = []
+    for line in rows:
+        if channels == 1:
+            luma.append(list(line))
+        else:
+            luma.append([(line[i] * 19595 + line[i + 1] * 38470 + line[i + 2] * 7471 + 0x8000) >> 16
+                         for i in range(0, stride, channels)])
+    return luma, width, height
+
+
+PRECISION_BITS = 32 - 8 - 2
+
+
+def sinc(x):
+    if x == 0.0:
+        return 1.0
+    x = x * math.pi
+    return math.sin(x) / x
+
+
+def lanczos(x):
+    if -3.0 <= x < 3.0:
+        return sinc(x) * sinc(x / 3)
+    return 0.0
+
+
+def coeffs(in_size, out_size):
+    scale = filterscale = in_size / out_size
+    if filterscale < 1.0:
+        filterscale = 1.0
+    support = 3.0 * filterscale
+    ksize = int(math.ceil(support)) * 2 + 1
+
+    bounds, kk = [], []
+    for xx in range(out_size):
+        center = (xx + 0.5) * scale
+        ss = 1.0 / filterscale
+        xmin = max(int(center - support + 0.5), 0)
+        xmax = min(int(center + support + 0.5), in_size) - xmin
+
+        k = [lanczos((x + xmin - center + 0.5) * ss) for x in range(xmax)]
+        ww = sum(k)
+        if ww != 0.0:
+            k = [w / ww for w in k]
+
+        # normalize_coeffs_8bpc, where C's int conversion truncates towards zero
+        k = [int(-0.5 + w * (1 << PRECISION_BITS)) if w < 0 else int(0.5 + w * (1 << PRECISION_BITS)) for w in k]
+        bounds.append((xmin, xmax))
+        kk.append(k)
+    return bounds, kk
+
+
+def clip8(v):
+    if v >= 1 << 8 << PRECISION_BITS:
+        return 255
+    if v <= 0:
+        return 0
+    return v >> PRECISION_BITS
+
+
+def resize(luma, width, height, w, h):
+    if (width, height) == (w, h):
+        return [list(row) for row in luma]
+
+    hbounds, hk = coeffs(width, w)
+    vbounds, vk = coeffs(height, h)
+
+    # The horizontal pass only covers the rows the vertical pass reads, which shifts its bounds
+    if w != width:
+        first = vbounds[0][0]
+        last = vbounds[-1][0] + vbounds[-1][1]
+        temp = []
+        for y in range(first, last):
+            row = luma[y]
+            out = []
+            for (xmin, xmax), k in zip(hbounds, hk):
+                ss = 1 << (PRECISION_BITS - 1)
+                for x in range(xmax):
+                    ss += row[x + xmin] * k[x]
+                out.append(clip8(ss))
+            temp.append(out)
+        luma = temp
+        vbounds = [(ymin - first, ymax) for ymin, ymax in vbounds]
+        width = w
+
+    if h == height:
+        return luma
+
+    out = []
+    for (ymin, ymax), k in zip(vbounds, vk):
+        row = []
+        for x in range(width):
+            ss = 1 << (PRECISION_BITS - 1)
+            for y in range(ymax):
+                ss += luma[y + ymin][x] * k[y]
+            row.append(clip8(ss))
+        out.append(row)
+    return out
+
+
+def to_hex(bits):
+    return "{:0>{width}x}".format(int("".join("1" if b else "0" for b in bits), 2), width=(len(bits) + 3) // 4)
+
+
+def average_hash(img, size=8):
+    pixels = resize(*img, size, size)
+    flat = [p for row in pixels for p in row]
+    avg = sum(flat) / len(flat)
+    return to_hex([p > avg for p in flat])
+
+
+def dhash(img, size=8):
+    pixels = resize(*img, size + 1, size)
+    return to_hex([row[x + 1] > row[x] for row in pixels for x in range(size)])
+
+
+def dhash_vertical(img, size=8):
+    pixels = resize(*img, size, size + 1)
+    return to_hex([pixels[y + 1][x] > pixels[y][x] for y in range(size) for x in range(size)])
+
+
+def dct(values):
+    n = len(values)
+    return [2 * sum(v * math.cos(math.pi * k * (2 * i + 1) / (2 * n)) for i, v in enumerate(values)) for k in range(n)]
+
+
+def phash(img, size=8, highfreq=4):
+    n = size * highfreq
+    pixels = resize(*img, n, n)
+
+    # scipy.fftpack.dct along axis 0, then along axis 1
+    cols = [dct([pixels[y][x] for y in range(n)]) for x in range(n)]
+    coeffs2d = [dct([cols[x][y] for x in range(n)]) for y in range(n)]
+
+    low = [coeffs2d[y][x] for y in range(size) for x in range(size)]
+    ordered = sorted(low)
+    med = (ordered[len(low) // 2 - 1] + ordered[len(low) // 2]) / 2
+
+    # A coefficient this close to the median could fall either side of it with a different DCT, so it is refused
+    assert min(abs(v - med) for v in low) > 1e-6
+    return to_hex([v > med for v in low])
+
+
+img = read_png("fixture.png")
+hashes = [
+    ("imagehash-ahash", average_hash(img)),
+    ("imagehash-dhash", dhash(img)),
+    ("imagehash-dhash-vertical", dhash_vertical(img)),
+    ("imagehash-phash", phash(img)),
+    ("imagehash-phash16", phash(img, size=16)),
+]
+
+with open("expected.txt", "w") as out:
+    out.write("# reference.py, a standard library transcription of imagehash and Pillow's LANCZOS resize\n")
+    for name, h in hashes:
+        out.write("%s %s\n" % (name, h))
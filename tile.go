@@ -0,0 +1,394 @@
+package imghash
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// The width and height every tile is scaled to before it is given a regular difference hash.
+	tileSize = 9
+
+	// The largest grid of tiles Options.Tiles allows, past this each tile is too small to be useful.
+	maxTiles = 16
+)
+
+// Returns an error if n isn't a valid number of tiles for Options.Tiles.
+func checkTiles(n int) error {
+	if n == 1 || n < 0 || n > maxTiles {
+		return errors.Errorf("tiles must be 0 or between 2 and %d, not %d", maxTiles, n)
+	}
+	return nil
+}
+
+// Returns the width and height an image is scaled to before an n by n grid of tiles is cut from it. The canvas is split
+// into n+1 steps of tileSize pixels along each side, and every tile covers two steps, so neighbouring tiles overlap by half.
+func tileCanvas(n int) int {
+	return tileSize * (n + 1)
+}
+
+// Hashes each tile of an image already scaled to tileCanvas(n), giving two words per tile in row-major order, the
+// vertical hash followed by the horizontal one.
+func tileHashes(canvas *image.NRGBA, n int) (BitSet, error) {
+	tiles := make(BitSet, 2*n*n)
+	for ty := 0; ty < n; ty++ {
+		for tx := 0; tx < n; tx++ {
+			r := image.Rect(tx*tileSize, ty*tileSize, (tx+2)*tileSize, (ty+2)*tileSize)
+			scaled, err := Resize(canvas.SubImage(r.Add(canvas.Rect.Min)), tileSize, tileSize, FilterBilinear)
+			if err != nil {
+				return nil, errors.Wrapf(err, "scaling tile %d,%d", tx, ty)
+			}
+
+			hh, vh, err := differenceHash(scaled)
+			if err != nil {
+				return nil, errors.Wrapf(err, "hashing tile %d,%d", tx, ty)
+			}
+
+			k := 2 * (ty*n + tx)
+			tiles[k], tiles[k+1] = vh[0], hh[0]
+		}
+	}
+	return tiles, nil
+}
+
+// Returns the size of the grid of tiles in a hash, or 0 if it has none.
+func (i Hash) tileGrid() int {
+	n := 0
+	for 2*n*n < len(i.Tiles) {
+		n++
+	}
+	return n
+}
+
+// TileMatch describes how well the tiles of a query line up with a hash, see TileQuery.MatchTiles.
+type TileMatch struct {
+	// The number of tiles in the query that matched a tile of the hash where the query was found.
+	Count int
+
+	// Where the query's top-left corner lies within the image the hash was created from, and how much of that image the
+	// query covers, all as fractions of its width and height. A query cropped from the bottom right quarter of an image
+	// is found at 0.5, 0.5 with a width and height of 0.5.
+	X, Y, Width, Height float64
+
+	// The total distance of the tiles that matched.
+	Distance int
+}
+
+const (
+	// Tile queries try every width and height between half and all of the image they were cropped from, in steps of
+	// this many canvas pixels, which keeps the tiles at the far side of the query within a pixel of where they belong.
+	tileScaleStep = 3
+
+	// The grid's phase is tried in steps of this many canvas pixels out of the tileSize between two tiles.
+	tilePhaseStep = 3
+
+	// At most this many tiles are hashed along each side of each grid, spread evenly across it, since every grid is
+	// tried with every other and larger grids would otherwise take far too long to hash and match.
+	tileSpread = 4
+)
+
+// TileQuery holds the tiles of an image hashed on every grid that could line up with the grid of an image it was cropped
+// from, see HashImageTiled. Each grid assumes a different width or height for the crop and a different phase between
+// the edge of the crop and the first line of the grid.
+type TileQuery struct {
+	n      int
+	axes   []tileAxis
+	probes []tileProbe
+}
+
+// One way a query's grid can line up with the original's along one side, where the query spans steps steps of the
+// original's grid and its first tile starts phase steps in from its edge.
+type tileAxis struct {
+	steps, phase float64
+}
+
+// A tile of a query hashed on one of its grids, where x and y index the tileAxis along each side and kx and ky are the
+// tile's position on that grid.
+type tileProbe struct {
+	x, y   int
+	kx, ky int
+	hash   [2]uint64
+}
+
+// The tile an axis hypothesis cuts along one side of the canvas, with the weight each canvas pixel from first on has in
+// each of the tileSize samples of the tile.
+type tileSpan struct {
+	axis    int
+	k       int
+	first   [tileSize]int
+	weights [tileSize][]float64
+}
+
+// Returns the weights of the canvas pixels from first on for a sample centred at centre, in pixels of the crop scaled by
+// ratio onto the canvas. Halving a tile to tileSize with FilterBilinear is a tent two pixels either side of each sample,
+// so that is what's used here, stretched by the ratio and folded in at the edges of the canvas.
+func tileWeights(centre, ratio float64, c int) (first int, weights []float64) {
+	lo, hi := int(math.Floor((centre-2)*ratio)), int(math.Ceil((centre+2)*ratio))
+	clamp := func(p int) int {
+		if p < 0 {
+			return 0
+		} else if p >= c {
+			return c - 1
+		}
+		return p
+	}
+
+	first = clamp(lo)
+	weights = make([]float64, clamp(hi)-first+1)
+
+	var sum float64
+	for p := lo; p <= hi; p++ {
+		if w := 2 - math.Abs((float64(p)+0.5)/ratio-centre); w > 0 {
+			weights[clamp(p)-first] += w
+			sum += w
+		}
+	}
+	for i := range weights {
+		weights[i] /= sum
+	}
+	return
+}
+
+// Returns every way the grid can line up along a side of the canvas, and the tiles each one cuts from it.
+func tileSpans(n int) ([]tileAxis, []tileSpan) {
+	c := tileCanvas(n)
+	min := (c + 1) / 2
+	if min < 2*tileSize {
+		min = 2 * tileSize
+	}
+
+	var (
+		axes  []tileAxis
+		spans []tileSpan
+	)
+	for w := c; w >= min; w -= tileScaleStep {
+		ratio := float64(c) / float64(w)
+		for phase := 0; phase < tileSize; phase += tilePhaseStep {
+			axis := len(axes)
+			axes = append(axes, tileAxis{steps: float64(w) / tileSize, phase: float64(phase) / tileSize})
+
+			count := (w-phase)/tileSize - 1
+			for i := 0; i < count && i < tileSpread; i++ {
+				k := i
+				if count > tileSpread {
+					k = i * (count - 1) / (tileSpread - 1)
+				}
+
+				span := tileSpan{axis: axis, k: k}
+				for j := range span.weights {
+					// Each sample covers 2 pixels of the crop scaled to w, which is ratio times as many on the canvas
+					span.first[j], span.weights[j] = tileWeights(float64(phase+k*tileSize+2*j+1), ratio, c)
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+	return axes, spans
+}
+
+// HashImageTiled hashes the tiles of a query on every grid it could line up with if it was cropped from an image hashed
+// with the same options, so it can be found with TileQuery.MatchTiles or Tree.NearestTiles. Options.Tiles must be the
+// grid size of the hashes it will be matched against, such as File.Options gives. Crops that keep at least half of each
+// side of the original are covered, whatever their position, and the original itself is too. Like HashImageWithOptions,
+// the options need a filter that scales in Go.
+func HashImageTiled(img image.Image, opts Options) (*TileQuery, error) {
+	if err := opts.validateInMemory(); err != nil {
+		return nil, err
+	} else if opts.Tiles == 0 {
+		return nil, errors.New("tile queries need the size of the grid they will be matched against")
+	}
+
+	img, _ = prepareImage(img, opts)
+	c := tileCanvas(opts.Tiles)
+	canvas, err := scaleForHash(img, c, c, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	luma := luminance(canvas)
+	axes, spans := tileSpans(opts.Tiles)
+	q := &TileQuery{n: opts.Tiles, axes: axes}
+
+	// Every tile is separable, so the columns of each horizontal span are worked out once for every row of the canvas
+	cols := make([][]float64, len(spans))
+	for i, sx := range spans {
+		cols[i] = make([]float64, c*tileSize)
+		for y := 0; y < c; y++ {
+			row := luma[y*c:]
+			for j, weights := range sx.weights {
+				var v float64
+				for p, w := range weights {
+					v += w * float64(row[sx.first[j]+p])
+				}
+				cols[i][y*tileSize+j] = v
+			}
+		}
+	}
+
+	var tile [tileSize * tileSize]float64
+	for _, sy := range spans {
+		for i, sx := range spans {
+			for r, weights := range sy.weights {
+				for j := 0; j < tileSize; j++ {
+					var v float64
+					for p, w := range weights {
+						v += w * cols[i][(sy.first[r]+p)*tileSize+j]
+					}
+					tile[r*tileSize+j] = v
+				}
+			}
+			q.probes = append(q.probes, tileProbe{x: sx.axis, y: sy.axis, kx: sx.k, ky: sy.k, hash: tileBits(&tile)})
+		}
+	}
+	return q, nil
+}
+
+// Hashes a tile the same way differenceHash hashes a tileSize*tileSize image, the vertical hash followed by the
+// horizontal one.
+func tileBits(tile *[tileSize * tileSize]float64) (hash [2]uint64) {
+	var bit uint
+	for y := 0; y < tileSize-1; y++ {
+		for x := 0; x < tileSize-1; x++ {
+			p := tile[y*tileSize+x]
+			if p < tile[(y+1)*tileSize+x] {
+				hash[0] |= 1 << bit
+			}
+			if p < tile[y*tileSize+x+1] {
+				hash[1] |= 1 << bit
+			}
+			bit++
+		}
+	}
+	return
+}
+
+// A grid the query lined up with and the offset of its first tile within the other hash's grid.
+type tileVote struct {
+	x, y       int
+	offx, offy int
+}
+
+// Returns where a vote puts the query within the original, and whether the query stays within it. A crop that starts at
+// the original's edge is always on the grid of some phase, so the query can't start before it. Widths and heights are
+// only tried in steps, so the far side is allowed half a step of rounding.
+func (q *TileQuery) place(v tileVote) (TileMatch, bool) {
+	ax, ay := q.axes[v.x], q.axes[v.y]
+	x, y := float64(v.offx)-ax.phase, float64(v.offy)-ay.phase
+
+	steps := float64(q.n + 1)
+	if x < 0 || y < 0 || x+ax.steps > steps+0.5 || y+ay.steps > steps+0.5 {
+		return TileMatch{}, false
+	}
+	return TileMatch{X: x / steps, Y: y / steps, Width: ax.steps / steps, Height: ay.steps / steps}, true
+}
+
+// MatchTiles finds the grid and offset where the most of the query's tiles match a tile of o within maxDist, which is
+// how a cropped copy of an image is found when its global hash no longer matches. The returned match has a Count of 0
+// if o has no tiles, has a different grid to the one the query was hashed for, or no tiles matched.
+func (q *TileQuery) MatchTiles(o Hash, maxDist int) TileMatch {
+	if o.tileGrid() != q.n {
+		return TileMatch{}
+	}
+	return q.matchAll(newTileColumns(q.n, []*Hash{&o}), maxDist)[0]
+}
+
+// The tiles of many hashes with the same grid laid out in columns, so each probe of a query is compared against all of
+// them in a single pass rather than a tile at a time. A tree lays out its hashes once when it's built.
+type tileColumns struct {
+	hashes []*Hash
+	cols   *columns
+}
+
+// Lays out the tiles of every hash, which must all have an n by n grid.
+func newTileColumns(n int, hashes []*Hash) *tileColumns {
+	tiles := n * n
+	cols := newColumns(2, len(hashes)*tiles)
+	for _, h := range hashes {
+		for t := 0; t < tiles; t++ {
+			cols.add(h.Tiles[2*t : 2*t+2])
+		}
+	}
+	return &tileColumns{hashes: hashes, cols: cols}
+}
+
+// Matches the query against every hash in tc, which must have the query's grid, returning a match for each in order.
+func (q *TileQuery) matchAll(tc *tileColumns, maxDist int) []TileMatch {
+	tiles := q.n * q.n
+	votes := make([]map[tileVote]TileMatch, len(tc.hashes))
+	var dist []int32
+	for _, p := range q.probes {
+		dist = tc.cols.distances(p.hash[:], dist)
+		for i, d := range dist {
+			if int(d) > maxDist {
+				continue
+			}
+
+			k, t := i/tiles, i%tiles
+			if votes[k] == nil {
+				votes[k] = make(map[tileVote]TileMatch)
+			}
+			q.vote(votes[k], p, t%q.n, t/q.n, int(d))
+		}
+	}
+
+	matches := make([]TileMatch, len(tc.hashes))
+	for k := range votes {
+		matches[k] = q.best(votes[k])
+	}
+	return matches
+}
+
+// Counts a match between a probe and tile (ox, oy) of a hash towards the grid and offset it implies.
+func (q *TileQuery) vote(votes map[tileVote]TileMatch, p tileProbe, ox, oy, d int) {
+	v := tileVote{x: p.x, y: p.y, offx: ox - p.kx, offy: oy - p.ky}
+	m, ok := votes[v]
+	if !ok {
+		if m, ok = q.place(v); !ok {
+			return
+		}
+	}
+
+	m.Count++
+	m.Distance += d
+	votes[v] = m
+}
+
+// Returns the match with the most votes, then the lowest distance, then the largest area so the full image wins ties.
+func (q *TileQuery) best(votes map[tileVote]TileMatch) TileMatch {
+	var best TileMatch
+	for _, m := range votes {
+		if m.Count > best.Count || m.Count == best.Count && (m.Distance < best.Distance ||
+			m.Distance == best.Distance && m.Width*m.Height > best.Width*best.Height) {
+			best = m
+		}
+	}
+	return best
+}
+
+// NearestTiles returns every hash in the tree with at least minTiles tiles matching the query's within maxDist, sorted by
+// the number of tiles that matched and then by their distance. Each result's Tiles describes the match and Dist holds
+// its distance. Tile matches don't obey the triangle inequality the tree is built on, so every hash is checked.
+func (t *Tree) NearestTiles(e *TileQuery, maxDist, minTiles int) Queue {
+	var q Queue
+	tc, ok := t.tiles[e.n]
+	if !ok {
+		return q
+	}
+
+	for i, m := range e.matchAll(tc, maxDist) {
+		if m.Count > 0 && m.Count >= minTiles {
+			q = append(q, heapItem{Item: tc.hashes[i], Dist: m.Distance, Tiles: m})
+		}
+	}
+
+	sort.SliceStable(q, func(i, j int) bool {
+		if q[i].Tiles.Count != q[j].Tiles.Count {
+			return q[i].Tiles.Count > q[j].Tiles.Count
+		}
+		return q[i].Dist < q[j].Dist
+	})
+	return q
+}
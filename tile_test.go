@@ -0,0 +1,113 @@
+package imghash
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Crops at any position that keep most of the original must be found where they were cut from, including crops that
+// don't line up with the original's tile grid.
+func TestMatchTiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	img := blobImage(t, rng, 12, 500, 400)
+	opts := Options{Filter: FilterBilinear, Tiles: 4}
+
+	hash, err := HashImageWithOptions(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash.Tiles) != 2*4*4 {
+		t.Fatalf("hash has %d tile words, expected %d", len(hash.Tiles), 2*4*4)
+	}
+
+	other, err := HashImageWithOptions(blobImage(t, rng, 12, 500, 400), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := NewTree([]Hash{other, hash})
+
+	crops := []image.Rectangle{
+		image.Rect(100, 80, 500, 400), // Along the grid
+		image.Rect(37, 61, 460, 400),
+		image.Rect(0, 23, 311, 377),
+		image.Rect(143, 0, 500, 290),
+		img.Rect,
+	}
+
+	for _, r := range crops {
+		query, err := HashImageTiled(img.SubImage(r), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Each step of the grid is a fifth of the image, and the crop must be placed to within half of one
+		m := query.MatchTiles(hash, 16)
+		if m.Count < 3 || math.Abs(m.X*500-float64(r.Min.X)) > 50 || math.Abs(m.Y*400-float64(r.Min.Y)) > 40 ||
+			math.Abs(m.Width*500-float64(r.Dx())) > 50 || math.Abs(m.Height*400-float64(r.Dy())) > 40 {
+			t.Errorf("crop %v matched %+v", r, m)
+		}
+
+		if n := query.MatchTiles(other, 16).Count; n >= m.Count {
+			t.Errorf("crop %v matched %d tiles of another image and %d of its own", r, n, m.Count)
+		}
+
+		if q := tree.NearestTiles(query, 16, m.Count); len(q) == 0 || !q[0].Item.Equal(hash) || q[0].Tiles != m {
+			t.Errorf("NearestTiles gave %v, expected the original first", q)
+		}
+	}
+
+	// A query that starts a third of a step to the left of the original lines up with a grid placed off its edge, which
+	// must be refused even though the rest of the query was cut from the original
+	padded := blobImage(t, rng, 12, 400, 320)
+	draw.Draw(padded, image.Rect(33, 0, 400, 320), img, image.Pt(0, 40), draw.Src)
+	query, err := HashImageTiled(padded, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := query.MatchTiles(hash, 16); m.Count > 0 && m.X < 0 {
+		t.Errorf("query overhanging the left edge was placed at %+v", m)
+	}
+
+	query, err = HashImageTiled(img, Options{Filter: FilterBilinear, Tiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := query.MatchTiles(hash, 128); m.Count != 0 {
+		t.Errorf("a query for a 3x3 grid matched %d tiles of a 4x4 one", m.Count)
+	}
+
+	if _, err := HashImageTiled(img, Options{Filter: FilterBilinear}); err == nil {
+		t.Error("expected an error hashing a tile query without a grid size")
+	}
+	if _, err := HashImageWithOptions(img, Options{Filter: FilterBilinear, Tiles: 1}); err == nil {
+		t.Fatal("expected an error hashing a single tile")
+	}
+}
+
+// Tiles and their grid size must survive being written and read back.
+func TestFileTiles(t *testing.T) {
+	f := NewFile()
+	f.tiles = 2
+	for i := 0; i < 10; i++ {
+		h := randomHash(1, 1, uint32(i))
+		h.Tiles = make(BitSet, 8)
+		for w := range h.Tiles {
+			h.Tiles[w] = rand.Uint64()
+		}
+		f.hashes = append(f.hashes, h)
+	}
+
+	loaded := roundTrip(t, f)
+	if loaded.Tiles() != 2 {
+		t.Fatalf("tiles were %d, expected 2", loaded.Tiles())
+	}
+
+	for i, h := range loaded.hashes {
+		if !h.Tiles.Equal(f.hashes[i].Tiles) {
+			t.Fatalf("hash %d has tiles %s, expected %s", i, h.Tiles, f.hashes[i].Tiles)
+		}
+	}
+}
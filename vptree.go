@@ -2,10 +2,13 @@ package imghash
 
 import (
 	"container/heap"
+	"image"
 	"math"
 	"math/rand"
 	"sort"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // TODO: remove commented out code if tests succeed
@@ -28,14 +31,66 @@ type node struct {
 }
 
 type Tree struct {
-	work  []int
-	root  *node
-	count int
+	work   []int
+	root   *node
+	count  int
+	hasher Hasher
+
+	// The most bits masked off in any one hash, searches of masked hashes must look this much further.
+	maxMask int
+
+	// The number of bits in each hash, which is the hasher's unless the tree holds clip signatures, see Bits.
+	bits int
+
+	// Whether searches take colour into account, see SetColourMode.
+	colour ColourMode
+
+	// Turns result distances into confidences if set, see SetCalibration.
+	calibration *Calibration
+
+	// The metric results are measured by, and the one the tree is arranged by, see boundMetric.
+	metric, bound Metric
+
+	// Results scoring below this have their distance raised, see SetMinInformation.
+	minInformation uint8
+
+	// The tiles of every hash with them by grid size, and the features of every hash with keypoints, laid out once the
+	// tree is built so NearestTiles and NearestFeatures don't copy them on every search.
+	tiles    map[int]*tileColumns
+	features *featureColumns
+}
+
+// The parameters of a single search through the tree.
+type search struct {
+	check          bool
+	slack          int
+	colour         ColourMode
+	metric, bound  Metric
+	minInformation uint8
+	bits           int
+
+	// The query's information score, see queryInformation
+	queryInformation uint8
 }
 
 type heapItem struct {
 	Item *Hash
 	Dist int
+
+	// The orientation of the query that matched, only set by oriented searches.
+	Orientation Orientation
+
+	// How the tiles of the query lined up with the item, only set by NearestTiles.
+	Tiles TileMatch
+
+	// The bounding box of the query window that matched, only set by NearestWindows.
+	Region image.Rectangle
+
+	// How the local features of the query lined up with the item, only set by NearestFeatures.
+	Features FeatureMatch
+
+	// The probability that the item is of the same image as the query, only set if the tree has a calibration.
+	Confidence float64
 }
 
 // Less compares with > because we want it to be sorted by smallest to greatest distances from the reference node.
@@ -50,13 +105,99 @@ func (q *Queue) Swap(i, j int)      { (*q)[i], (*q)[j] = (*q)[j], (*q)[i] }
 
 // Constructs a new tree and returns it.
 func NewTree(p []Hash) *Tree {
+	t, err := NewTreeWithHasher(p, DefaultHasher)
+	if err != nil {
+		panic(err) // The default hasher is always registered
+	}
+	return t
+}
+
+// Constructs a new tree of hashes created by the named hasher, returning an error of type UnknownHasher if it is not registered.
+func NewTreeWithHasher(p []Hash, name string) (*Tree, error) {
+	return NewTreeWithMetric(p, name, MaskedMetric{})
+}
+
+// Identical to NewTreeWithHasher, but measures distances with the given metric instead of MaskedMetric.
+func NewTreeWithMetric(p []Hash, name string, metric Metric) (*Tree, error) {
+	hasher, err := LookupHasher(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMetric(metric); err != nil {
+		return nil, errors.Wrap(err, "building tree")
+	}
+
 	rand.Seed(time.Now().Unix())
 
 	t := new(Tree)
+	t.hasher, t.bits = hasher, hasher.Bits()
+	t.metric, t.bound = metric, boundMetric(metric)
 	t.count = len(p)
+	for i := range p {
+		if m := p[i].MaskCount(); m > t.maxMask {
+			t.maxMask = m
+		}
+	}
 	t.work = make([]int, t.count)
 	t.root = t.build(p)
-	return t
+	t.layout()
+	return t, nil
+}
+
+// Lays out the tiles and features of every hash in the tree for NearestTiles and NearestFeatures. The hashes are
+// pointed to in the order the tree is walked, since the tree never changes once it's built.
+func (t *Tree) layout() {
+	grids := make(map[int][]*Hash)
+	var features []*Hash
+	t.root.walk(func(h *Hash) {
+		if n := h.tileGrid(); n > 0 {
+			grids[n] = append(grids[n], h)
+		}
+		if h.Features != nil && len(h.Features.Keypoints) > 0 {
+			features = append(features, h)
+		}
+	})
+
+	t.tiles = make(map[int]*tileColumns, len(grids))
+	for n, hashes := range grids {
+		t.tiles[n] = newTileColumns(n, hashes)
+	}
+	t.features = newFeatureColumns(features)
+}
+
+// Constructs a new tree from the hashes of every file, returning an error if the files were created by different hashers
+// or with different options that change how images are hashed, such as the filter or preprocessing.
+func NewTreeFromFiles(files ...*File) (*Tree, error) {
+	return NewTreeFromFilesWithMetric(MaskedMetric{}, files...)
+}
+
+// Identical to NewTreeFromFiles, but measures distances with the given metric instead of MaskedMetric.
+func NewTreeFromFilesWithMetric(metric Metric, files ...*File) (*Tree, error) {
+	if len(files) == 0 {
+		return NewTreeWithMetric(nil, DefaultHasher, metric)
+	}
+
+	var p []Hash
+	for _, f := range files {
+		if err := files[0].comparable(f); err != nil {
+			return nil, errors.Wrap(err, "building tree")
+		}
+		p = append(p, f.hashes...)
+	}
+
+	t, err := NewTreeWithMetric(p, files[0].hasher, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files that ask for low information frames to be down-weighted pass their minimum on, the strictest one wins
+	for _, f := range files {
+		if f.information == InformationDownWeight && f.minInformation > t.minInformation {
+			t.minInformation = f.minInformation
+		}
+	}
+	return t, nil
 }
 
 // Faster than sort.Slice, and allows for some flexibility in future optimizations
@@ -85,8 +226,8 @@ func (t *Tree) build(p []Hash) *node {
 
 	// Construct working distances that we can then use to quickly sort the remaining points
 	t.work = t.work[:len(p)]
-	for i, p := range p {
-		t.work[i] = n.Point.Distance(p)
+	for i := range p {
+		t.work[i] = t.bound.Distance(&n.Point, &p[i])
 	}
 
 	// Sorting is slow without using a slice of the dists
@@ -94,7 +235,7 @@ func (t *Tree) build(p []Hash) *node {
 	// sort.Slice(s, func(i, j int) bool { return n.Point.Distance(s[i]) < n.Point.Distance(s[j]) })
 
 	half := len(p) / 2
-	n.Radius = n.Point.Distance(p[half])
+	n.Radius = t.bound.Distance(&n.Point, &p[half])
 	n.Near = t.build(p[1:half])
 	n.Far = t.build(p[half:])
 	return &n
@@ -105,6 +246,22 @@ func (t *Tree) Len() int {
 	return t.count
 }
 
+// Returns the hasher used to create the hashes in the tree.
+func (t *Tree) Hasher() Hasher {
+	return t.hasher
+}
+
+// Returns the number of bits in each hash in the tree, which is more than the hasher's Bits for a tree of clip
+// signatures, since each covers several segments of frames.
+func (t *Tree) Bits() int {
+	return t.bits
+}
+
+// Returns the metric the tree measures distances with.
+func (t *Tree) Metric() Metric {
+	return t.metric
+}
+
 //type comparable func(int) bool
 
 // func (t *Tree) nearest(q *Queue, e *Hash, c comparable) {
@@ -123,13 +280,62 @@ func (t *Tree) Len() int {
 // 	}
 // }
 
+// Sets whether searches require the colour of results to agree with the query. With ColourRequire the colour distance
+// is added to the distance of every result, so recoloured copies rank below the original or fall outside NearestDist.
+// Returns an error without changing the mode if the tree has a calibration fitted with another mode, which would no
+// longer apply, so it has to be replaced or cleared with SetCalibration first.
+func (t *Tree) SetColourMode(mode ColourMode) error {
+	if t.calibration != nil && t.calibration.colour != mode {
+		return errors.New("cannot change the colour mode of a tree with a calibration fitted to the current one")
+	}
+	t.colour = mode
+	return nil
+}
+
+// Sets the calibration that turns the distance of every result into a Confidence, or clears it if c is nil. Returns an
+// error if the calibration was fitted for a different hasher than the tree's or to hashes of a different size, such as
+// frame hashes for a tree of clip signatures, or to distances measured with a different metric or colour mode.
+// NearestTiles results aren't calibrated, since their distances are only over the tiles that matched.
+func (t *Tree) SetCalibration(c *Calibration) error {
+	if c == nil {
+		t.calibration = nil
+		return nil
+	}
+
+	if c.hasher != t.hasher.Name() {
+		return errors.Errorf("cannot use a %q calibration with a tree of %q hashes", c.hasher, t.hasher.Name())
+	} else if c.bits != t.bits {
+		return errors.Errorf("cannot use a calibration of %d bit hashes with a tree of %d bit hashes", c.bits, t.bits)
+	} else if c.metric != t.metric {
+		return errors.Errorf("cannot use a calibration of %#v distances with a tree measuring %#v distances", c.metric, t.metric)
+	} else if c.colour != t.colour {
+		return errors.New("cannot use a calibration fitted with a different colour mode to the tree's")
+	}
+	t.calibration = c
+	return nil
+}
+
+// Returns the calibration set by SetCalibration, if any.
+func (t *Tree) Calibration() *Calibration {
+	return t.calibration
+}
+
 // Returns the nearest items to q, doing a length == cap validation if check is true
 func (t *Tree) nearest(q *Queue, e *Hash, check bool) {
 	if t.root == nil {
 		return
 	}
 
-	t.root.search(q, e, check)
+	// Masked distances can be smaller than the true ones the tree is built on by up to the number of bits masked
+	// off in either hash, so the search has to reach that much further to be sure it finds everything.
+	s := search{check: check, colour: t.colour, metric: t.metric, bound: t.bound, minInformation: t.minInformation, bits: t.bits}
+	if s.minInformation > 0 {
+		s.queryInformation = queryInformation(e, s.bits)
+	}
+	if _, ok := t.metric.(MaskedMetric); ok {
+		s.slack = t.maxMask + e.MaskCount()
+	}
+	t.root.search(q, e, &s)
 
 	// Remove the MaxInt that is added by nearest searches
 	removeInit := (q.Len() > 0 && q.Max().Item == nil)
@@ -138,6 +344,12 @@ func (t *Tree) nearest(q *Queue, e *Hash, check bool) {
 	if removeInit {
 		q.Pop()
 	}
+
+	if t.calibration != nil {
+		for i := range *q {
+			(*q)[i].Confidence = t.calibration.Confidence((*q)[i].Dist)
+		}
+	}
 }
 
 // Returns the closest entry to e
@@ -186,33 +398,110 @@ func (t *Tree) NearestDist(e *Hash, d int) (q Queue) {
 	return
 }
 
+// Returns the closest N entries to any orientation of entry e, along with the orientation that matched each.
+func (t *Tree) NearestOriented(e *OrientedHash, n int) Queue {
+	return mergeSearches(n, orientations, func(o int) Queue { return withOrientation(t.NearestN(&e[o], n), Orientation(o)) })
+}
+
+// Returns all entries where the distance to any orientation of e is <= d, along with the orientation that matched each.
+func (t *Tree) NearestDistOriented(e *OrientedHash, d int) Queue {
+	return mergeSearches(-1, orientations, func(o int) Queue { return withOrientation(t.NearestDist(&e[o], d), Orientation(o)) })
+}
+
+// Sets the orientation of every item in the queue, returning it for convenience.
+func withOrientation(q Queue, o Orientation) Queue {
+	for i := range q {
+		q[i].Orientation = o
+	}
+	return q
+}
+
+// Runs count searches, keeping the closest result of each entry found, or the earliest if several are as close. The
+// results are sorted by distance and cut down to the closest n, unless n is negative.
+func mergeSearches(n, count int, search func(int) Queue) Queue {
+	best := make(map[*Hash]heapItem)
+	for i := 0; i < count; i++ {
+		for _, item := range search(i) {
+			if prev, ok := best[item.Item]; !ok || item.Dist < prev.Dist {
+				best[item.Item] = item
+			}
+		}
+	}
+
+	q := make(Queue, 0, len(best))
+	for _, item := range best {
+		q = append(q, item)
+	}
+
+	// Ties are broken by orientation and index so the results don't depend on map order
+	sort.Slice(q, func(i, j int) bool {
+		if q[i].Dist != q[j].Dist {
+			return q[i].Dist < q[j].Dist
+		} else if q[i].Orientation != q[j].Orientation {
+			return q[i].Orientation < q[j].Orientation
+		}
+		return q[i].Item.Index < q[j].Item.Index
+	})
+
+	if n >= 0 && len(q) > n {
+		q = q[:n]
+	}
+	return q
+}
+
+// Calls fn with every point in the tree, in no particular order.
+func (n *node) walk(fn func(*Hash)) {
+	if n == nil {
+		return
+	}
+
+	fn(&n.Point)
+	n.Near.walk(fn)
+	n.Far.walk(fn)
+}
+
 //func (n *node) search(q *Queue, e *Hash, comp comparable) {
-func (n *node) search(q *Queue, e *Hash, check bool) {
+func (n *node) search(q *Queue, e *Hash, s *search) {
 	// We've reached a leaf's child with nowhere to go
 	if n == nil {
 		return
 	}
 
 	// Gets the distance and comapres it to the max in the queue, popping if full and adding the new entry
-	threshold := e.Distance(n.Point)
-	if threshold <= q.Max().Dist {
-		if check && len(*q) == cap(*q) {
+	threshold := s.bound.Distance(e, &n.Point)
+	dist := threshold
+	if s.slack > 0 {
+		dist = s.metric.Distance(e, &n.Point)
+	}
+
+	// Colour only ever adds to the distance, so the tree can still be pruned by the luma distance alone
+	if s.colour == ColourRequire {
+		dist += e.ColourDistance(n.Point)
+	}
+
+	// So does the penalty for low information, which only ever pushes results further away
+	if s.minInformation > 0 {
+		dist += s.informationPenalty(&n.Point)
+	}
+
+	if dist <= q.Max().Dist {
+		if s.check && len(*q) == cap(*q) {
 			heap.Pop(q)
 		}
 
-		heap.Push(q, heapItem{&n.Point, threshold})
+		heap.Push(q, heapItem{Item: &n.Point, Dist: dist})
 	}
 
 	// Checks near or far node recursively
 	if threshold < n.Radius {
-		n.Near.search(q, e, check)
-		if threshold+q.Max().Dist >= n.Radius {
-			n.Far.search(q, e, check)
+		n.Near.search(q, e, s)
+		if threshold+q.Max().Dist+s.slack >= n.Radius {
+			n.Far.search(q, e, s)
 		}
 	} else {
-		n.Far.search(q, e, check)
-		if threshold-q.Max().Dist <= n.Radius {
-			n.Near.search(q, e, check)
+		n.Far.search(q, e, s)
+		if threshold-q.Max().Dist-s.slack <= n.Radius {
+			n.Near.search(q, e, s)
 		}
 	}
 }
@@ -0,0 +1,53 @@
+package imghash
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// A mirrored or rotated copy of an indexed image must be found at distance 0, in the orientation that undoes it.
+func TestNearestOriented(t *testing.T) {
+	var (
+		hashes []Hash
+		images []*image.NRGBA
+	)
+
+	hasher, _ := LookupHasher(DefaultHasher)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		img := randomImage(rng, image.NewNRGBA(image.Rect(0, 0, width, height))).(*image.NRGBA)
+		h, err := hasher.Hash(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.Index = uint32(i)
+		hashes = append(hashes, h)
+		images = append(images, img)
+	}
+
+	tree := NewTree(append([]Hash(nil), hashes...)) // Building the tree reorders the slice
+	tests := map[Orientation]Orientation{
+		OrientFlipH:     OrientFlipH,
+		OrientRotate90:  OrientRotate270,
+		OrientRotate180: OrientRotate180,
+		OrientTranspose: OrientTranspose,
+	}
+
+	for applied, undo := range tests {
+		query, err := orientedHash(orientImage(images[42], applied), hasher, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := tree.NearestOriented(query, 3)
+		if len(q) != 3 || q[0].Item.Index != 42 || q[0].Dist != 0 || q[0].Orientation != undo {
+			t.Fatalf("%s: closest match was %d at %d in %s, expected 42 at 0 in %s", applied, q[0].Item.Index, q[0].Dist, q[0].Orientation, undo)
+		}
+
+		if d, o := query.Distance(hashes[42]); d != 0 || o != undo {
+			t.Fatalf("%s: distance was %d in %s, expected 0 in %s", applied, d, o, undo)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package imghash
+
+import (
+	"image"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// The fractions of a query's width and height that sliding windows are cut at when Options.WindowScales is empty.
+// Every width is tried with every height, so a frame squashed into a meme with a caption above it is still covered.
+var DefaultWindowScales = []float64{1, 3.0 / 4, 1.0 / 2, 1.0 / 3}
+
+const (
+	// Windows move by this fraction of their own size each step.
+	windowStep = 4
+
+	// Queries are scaled down so their longest side is at most this many pixels before windows are cut from them,
+	// otherwise large collages would take far longer to hash than the extra detail is worth.
+	windowWorkSize = 512
+)
+
+// Returns the start of every window of the given size along a side, stepping by a quarter of the window.
+// The last window always ends at the edge, even if that is less than a full step from the one before it.
+func windowPositions(side, window int) []int {
+	step := window / windowStep
+	if step < 1 {
+		step = 1
+	}
+
+	var pos []int
+	for p := 0; p+window < side; p += step {
+		pos = append(pos, p)
+	}
+	return append(pos, side-window)
+}
+
+// Hashes multi-scale sliding windows over an image, setting the Region of each hash to the window it came from,
+// relative to the image's bounds. Windows smaller than the hasher's size are skipped. The area the image was
+// automatically cropped to is also returned, if any.
+func windowHashes(img image.Image, hasher Hasher, opts Options) ([]Hash, image.Rectangle, error) {
+	img, crop := prepareImage(img, opts)
+	b := img.Bounds()
+	offset := crop.Min
+
+	work := toNRGBA(img)
+	ratio := 1.0
+	if long := math.Max(float64(b.Dx()), float64(b.Dy())); long > windowWorkSize {
+		ratio = windowWorkSize / long
+
+		var err error
+		work, err = Resize(img, int(math.Round(float64(b.Dx())*ratio)), int(math.Round(float64(b.Dy())*ratio)), opts.Filter)
+		if err != nil {
+			return nil, crop, errors.Wrap(err, "scaling query")
+		}
+	}
+
+	scales := opts.WindowScales
+	if len(scales) == 0 {
+		scales = DefaultWindowScales
+	}
+
+	w, h := hasher.Size()
+	dx, dy := work.Rect.Dx(), work.Rect.Dy()
+
+	var hashes []Hash
+	for _, sh := range scales {
+		for _, sw := range scales {
+			if sw <= 0 || sw > 1 || sh <= 0 || sh > 1 {
+				return nil, crop, errors.Errorf("window scales must be greater than 0 and at most 1, not %gx%g", sw, sh)
+			}
+
+			ww, wh := int(math.Round(sw*float64(dx))), int(math.Round(sh*float64(dy)))
+			if ww < w || wh < h {
+				continue
+			}
+
+			for _, y := range windowPositions(dy, wh) {
+				for _, x := range windowPositions(dx, ww) {
+					r := image.Rect(x, y, x+ww, y+wh)
+					scaled, err := scaleForHash(work.SubImage(r), w, h, opts)
+					if err != nil {
+						return nil, crop, err
+					}
+
+					hash, err := hashScaled(scaled, hasher, opts)
+					if err != nil {
+						return nil, crop, errors.Wrapf(err, "hashing window %v", r)
+					}
+
+					// Windows are mapped back onto the original image, rounding outwards
+					hash.Region = image.Rect(
+						int(math.Floor(float64(r.Min.X)/ratio)), int(math.Floor(float64(r.Min.Y)/ratio)),
+						int(math.Ceil(float64(r.Max.X)/ratio)), int(math.Ceil(float64(r.Max.Y)/ratio)),
+					).Add(offset).Intersect(image.Rect(0, 0, b.Dx(), b.Dy()).Add(offset))
+					hash.Index = 1
+					hashes = append(hashes, hash)
+				}
+			}
+		}
+	}
+
+	if len(hashes) == 0 {
+		return nil, crop, errors.Errorf("a %dx%d image is too small to cut windows from", b.Dx(), b.Dy())
+	}
+	return hashes, crop, nil
+}
+
+// NearestWindows searches the tree with every window hashed from a query by NewFromPathWithOptions with
+// Options.Windows set, returning all entries within d of any window. Each entry keeps the window closest to it, and
+// its Region is that window's bounding box within the query.
+func (t *Tree) NearestWindows(windows []Hash, d int) Queue {
+	return mergeSearches(-1, len(windows), func(i int) Queue {
+		q := t.NearestDist(&windows[i], d)
+		for j := range q {
+			q[j].Region = windows[i].Region
+		}
+		return q
+	})
+}
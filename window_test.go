@@ -0,0 +1,90 @@
+package imghash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes an image to a PNG file in a temporary directory, returning its path.
+func writePNG(t *testing.T, img image.Image) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "image.png")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if err := png.Encode(out, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A frame pasted into a collage must be found by one of the query's windows, which must cover where it was pasted.
+func TestNearestWindows(t *testing.T) {
+	// Shifting a frame by a few pixels flips a different number of bits depending on its content, so both images are
+	// drawn from a fixed seed. The frame is smoother than the collage, as frames scaled into collages usually are.
+	rng := rand.New(rand.NewSource(1))
+	frame := blobImage(t, rng, 4, 160, 200)
+
+	indexed, err := HashImage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := NewTree([]Hash{indexed})
+
+	// The frame is a third of the width and half the height of the collage, first on the grid windows of that size step
+	// along and then a few pixels off it, where the window it was pasted nearest to must still be the one found
+	window := image.Rect(320, 100, 480, 300)
+	for _, at := range []image.Rectangle{window, window.Sub(image.Pt(4, 4))} {
+		collage := blobImage(t, rng, 12, 480, 400)
+		draw.Draw(collage, at, frame, image.Point{}, draw.Src)
+
+		if whole, err := HashImage(collage); err != nil {
+			t.Fatal(err)
+		} else if q := tree.NearestDist(&whole, 16); len(q) != 0 {
+			t.Fatalf("the whole collage matched the frame at distance %d", q[0].Dist)
+		}
+
+		query, err := NewFromPathWithOptions(writePNG(t, collage), Options{Filter: FilterBilinear, Windows: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := tree.NearestWindows(*query.Hashes(), 16)
+		if len(q) != 1 || q[0].Region != window {
+			t.Fatalf("windows found %v, expected the frame pasted at %v in the window at %v", q, at, window)
+		}
+	}
+
+	// Every window of a flat image has the same hash, but they are still different regions of the query
+	flat := image.NewNRGBA(image.Rect(0, 0, 480, 400))
+	draw.Draw(flat, flat.Rect, image.NewUniform(color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}), image.Point{}, draw.Src)
+
+	var windows int
+	for _, sh := range DefaultWindowScales {
+		for _, sw := range DefaultWindowScales {
+			windows += len(windowPositions(480, int(math.Round(sw*480)))) * len(windowPositions(400, int(math.Round(sh*400))))
+		}
+	}
+
+	query, err := NewFromPathWithOptions(writePNG(t, flat), Options{Filter: FilterBilinear, Windows: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if n := len(*query.Hashes()); n != windows {
+		t.Fatalf("a flat image kept %d of its %d windows", n, windows)
+	}
+
+	if _, err := NewFromPathWithOptions(t.TempDir(), Options{Filter: FilterBilinear, Windows: true}); err == nil {
+		t.Fatal("expected an error hashing windows of a directory")
+	}
+}